@@ -0,0 +1,123 @@
+package security
+
+import (
+	"context"
+	"github.com/dottics/dutil"
+	"github.com/google/uuid"
+	"io"
+)
+
+// CreateAPIKey handles the exchange with the security microservice to
+// create an API key for the logged-in user. The key is returned with the
+// APIKey and cannot be retrieved again, a Service authenticates with it
+// through the WithAPIKey option.
+func (s *Service) CreateAPIKey(p CreateAPIKeyPayload) (APIKey, string, dutil.Error) {
+	return s.CreateAPIKeyContext(context.Background(), p)
+}
+
+// CreateAPIKeyContext is CreateAPIKey bound to the context ctx.
+func (s *Service) CreateAPIKeyContext(ctx context.Context, p CreateAPIKeyPayload) (APIKey, string, dutil.Error) {
+	ctx = withOperation(ctx, "create_api_key")
+	u := s.endpoint("/api-keys", nil)
+
+	payload, e := dutil.MarshalReader(p)
+	if e != nil {
+		return APIKey{}, "", e
+	}
+	return s.apiKeyExchange(ctx, u.String(), payload, 201)
+}
+
+// ListAPIKeys handles the exchange with the security microservice to list
+// the API keys of the logged-in user, without the keys themselves.
+func (s *Service) ListAPIKeys() ([]APIKey, dutil.Error) {
+	return s.ListAPIKeysContext(context.Background())
+}
+
+// ListAPIKeysContext is ListAPIKeys bound to the context ctx.
+func (s *Service) ListAPIKeysContext(ctx context.Context) ([]APIKey, dutil.Error) {
+	ctx = withOperation(ctx, "list_api_keys")
+	u := s.endpoint("/api-keys", nil)
+
+	type data struct {
+		APIKeys []APIKey `json:"api_keys"`
+	}
+	resp := struct {
+		Message string              `json:"message"`
+		Data    data                `json:"data"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	res, e := s.NewRequestContext(ctx, "GET", u.String(), nil, nil)
+	if e != nil {
+		return nil, e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return nil, e
+	}
+
+	if res.StatusCode != 200 {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return nil, e
+	}
+
+	return resp.Data.APIKeys, nil
+}
+
+// RotateAPIKey handles the exchange with the security microservice to
+// replace the key of the API key with the UUID by a new key, keeping its
+// name and permission codes. The previous key can no longer be used.
+func (s *Service) RotateAPIKey(keyUUID uuid.UUID) (APIKey, string, dutil.Error) {
+	return s.RotateAPIKeyContext(context.Background(), keyUUID)
+}
+
+// RotateAPIKeyContext is RotateAPIKey bound to the context ctx.
+func (s *Service) RotateAPIKeyContext(ctx context.Context, keyUUID uuid.UUID) (APIKey, string, dutil.Error) {
+	ctx = withOperation(ctx, "rotate_api_key")
+	u := s.endpoint("/api-keys/"+keyUUID.String()+"/rotate", nil)
+	return s.apiKeyExchange(ctx, u.String(), nil, 200)
+}
+
+// RevokeAPIKey handles the exchange with the security microservice to
+// revoke the API key with the UUID.
+func (s *Service) RevokeAPIKey(keyUUID uuid.UUID) dutil.Error {
+	return s.RevokeAPIKeyContext(context.Background(), keyUUID)
+}
+
+// RevokeAPIKeyContext is RevokeAPIKey bound to the context ctx.
+func (s *Service) RevokeAPIKeyContext(ctx context.Context, keyUUID uuid.UUID) dutil.Error {
+	ctx = withOperation(ctx, "revoke_api_key")
+	u := s.endpoint("/api-keys/"+keyUUID.String(), nil)
+	return s.statusExchange(ctx, "DELETE", u.String(), nil)
+}
+
+// apiKeyExchange makes a POST exchange with the security microservice of
+// which the response data is an API key with its key, status is the status
+// of a successful response.
+func (s *Service) apiKeyExchange(ctx context.Context, target string, payload io.Reader, status int) (APIKey, string, dutil.Error) {
+	type data struct {
+		APIKey APIKey `json:"api_key"`
+		Key    string `json:"key"`
+	}
+	resp := struct {
+		Message string              `json:"message"`
+		Data    data                `json:"data"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	res, e := s.NewRequestContext(ctx, "POST", target, nil, payload)
+	if e != nil {
+		return APIKey{}, "", e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return APIKey{}, "", e
+	}
+
+	if res.StatusCode != status {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return APIKey{}, "", e
+	}
+
+	return resp.Data.APIKey, resp.Data.Key, nil
+}
@@ -0,0 +1,138 @@
+package security
+
+import (
+	"fmt"
+	"github.com/dottics/dutil"
+	"github.com/google/uuid"
+	"github.com/johannesscr/micro/microtest"
+	"testing"
+)
+
+func TestService_CreateAPIKey(t *testing.T) {
+	keyUUID := uuid.MustParse("5f1d7a3e-2b4c-4d6e-8f90-a1b2c3d4e5f6")
+
+	tests := []struct {
+		name     string
+		call     func(s *Service) (APIKey, string, dutil.Error)
+		path     string
+		exchange *microtest.Exchange
+		apiKey   APIKey
+		key      string
+		e        dutil.Error
+	}{
+		{
+			name: "create with permission codes the user does not have",
+			call: func(s *Service) (APIKey, string, dutil.Error) {
+				return s.CreateAPIKey(CreateAPIKeyPayload{Name: "batch", PermissionCodes: PermissionCodes{"xyz"}})
+			},
+			path: "/api-keys",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 403,
+					Body:   `{"message":"Forbidden","data":{},"errors":{"permission":["xyz"]}}`,
+				},
+			},
+			e: &dutil.Err{
+				Status: 403,
+				Errors: map[string][]string{
+					"permission": {"xyz"},
+				},
+			},
+		},
+		{
+			name: "create",
+			call: func(s *Service) (APIKey, string, dutil.Error) {
+				return s.CreateAPIKey(CreateAPIKeyPayload{Name: "batch", PermissionCodes: PermissionCodes{"abcd"}})
+			},
+			path: "/api-keys",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 201,
+					Body:   `{"message":"api key created","data":{"api_key":{"uuid":"5f1d7a3e-2b4c-4d6e-8f90-a1b2c3d4e5f6","name":"batch","prefix":"sk_1234","permission":["abcd"]},"key":"sk_1234567890"},"errors":{}}`,
+				},
+			},
+			apiKey: APIKey{UUID: keyUUID, Name: "batch", Prefix: "sk_1234", PermissionCodes: PermissionCodes{"abcd"}},
+			key:    "sk_1234567890",
+		},
+		{
+			name: "rotate",
+			call: func(s *Service) (APIKey, string, dutil.Error) { return s.RotateAPIKey(keyUUID) },
+			path: "/api-keys/5f1d7a3e-2b4c-4d6e-8f90-a1b2c3d4e5f6/rotate",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 200,
+					Body:   `{"message":"api key rotated","data":{"api_key":{"uuid":"5f1d7a3e-2b4c-4d6e-8f90-a1b2c3d4e5f6","name":"batch","prefix":"sk_0987","permission":["abcd"]},"key":"sk_0987654321"},"errors":{}}`,
+				},
+			},
+			apiKey: APIKey{UUID: keyUUID, Name: "batch", Prefix: "sk_0987", PermissionCodes: PermissionCodes{"abcd"}},
+			key:    "sk_0987654321",
+		},
+	}
+
+	s := NewService("my-very-secure-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			apiKey, key, e := tc.call(s)
+			if !dutil.ErrorEqual(e, tc.e) {
+				t.Errorf("expected error %v got %v", tc.e, e)
+			}
+			if fmt.Sprint(apiKey) != fmt.Sprint(tc.apiKey) {
+				t.Errorf("expected '%v' got '%v'", tc.apiKey, apiKey)
+			}
+			if key != tc.key {
+				t.Errorf("expected '%v' got '%v'", tc.key, key)
+			}
+			r := tc.exchange.Request
+			if r.Method != "POST" || r.URL.Path != tc.path {
+				t.Errorf("expected 'POST %v' got '%v %v'", tc.path, r.Method, r.URL.Path)
+			}
+		})
+	}
+}
+
+func TestService_ListAPIKeys(t *testing.T) {
+	s := NewService("my-very-secure-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	xe := []*microtest.Exchange{
+		{
+			Response: microtest.Response{
+				Status: 200,
+				Body:   `{"message":"api keys","data":{"api_keys":[{"uuid":"5f1d7a3e-2b4c-4d6e-8f90-a1b2c3d4e5f6","name":"batch","prefix":"sk_1234","permission":["abcd"],"last_used_at":"2022-05-01T12:00:00Z"}]},"errors":{}}`,
+			},
+		},
+		{
+			Response: microtest.Response{
+				Status: 200,
+				Body:   `{"message":"api key revoked","data":{},"errors":{}}`,
+			},
+		},
+	}
+	for _, x := range xe {
+		ms.Append(x)
+	}
+
+	xk, e := s.ListAPIKeys()
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if len(xk) != 1 || xk[0].Name != "batch" || xk[0].LastUsedAt == nil || xk[0].ExpiresAt != nil {
+		t.Errorf("unexpected api keys %v", xk)
+	}
+
+	e = s.RevokeAPIKey(xk[0].UUID)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	r := xe[1].Request
+	if r.Method != "DELETE" || r.URL.Path != "/api-keys/5f1d7a3e-2b4c-4d6e-8f90-a1b2c3d4e5f6" {
+		t.Errorf("unexpected request '%v %v'", r.Method, r.URL.Path)
+	}
+}
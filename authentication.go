@@ -1,22 +1,58 @@
 package security
 
 import (
+	"context"
 	"github.com/dottics/dutil"
 	"github.com/google/uuid"
 	"io"
 	"net/url"
+	"time"
 )
 
 // Login sends the payload to the micro-service. If the login is successful
 // a Redis session is created. And the user token is returned included in
 // the Headers Login parses the response and extracts the token, user data
-// and permissions codes.
+// and permissions codes. If the user has a second factor the error is a
+// MFARequiredError with the challenge to complete the login with VerifyMFA.
 func (s *Service) Login(payload io.Reader) (string, User, PermissionCodes, dutil.Error) {
-	s.URL.Path = "/login"
+	return s.LoginContext(context.Background(), payload)
+}
+
+// LoginContext is Login bound to the context ctx.
+func (s *Service) LoginContext(ctx context.Context, payload io.Reader) (string, User, PermissionCodes, dutil.Error) {
+	result, e := s.AuthenticateContext(ctx, payload)
+	if e != nil {
+		return "", User{}, nil, e
+	}
+	return result.Token, result.User, result.PermissionCodes, nil
+}
+
+// Authenticate is Login returning the LoginResult, which in addition to
+// the user token, user and permission codes has the refresh token and
+// expiry of the user token, if the security microservice issued them.
+func (s *Service) Authenticate(payload io.Reader) (LoginResult, dutil.Error) {
+	return s.AuthenticateContext(context.Background(), payload)
+}
 
+// AuthenticateContext is Authenticate bound to the context ctx.
+func (s *Service) AuthenticateContext(ctx context.Context, payload io.Reader) (LoginResult, dutil.Error) {
+	ctx = withOperation(ctx, "login")
+	u := s.endpoint("/login", nil)
+	return s.loginExchange(ctx, u.String(), payload)
+}
+
+// loginExchange makes an exchange with the security microservice of which
+// the response is that of a login. If the security microservice requires a
+// second factor it responds with 202 and the challenge, which is returned
+// as a MFARequiredError.
+func (s *Service) loginExchange(ctx context.Context, target string, payload io.Reader) (LoginResult, dutil.Error) {
 	type data struct {
 		User            User            `json:"user"`
 		PermissionCodes PermissionCodes `json:"permission"`
+		RefreshToken    string          `json:"refresh_token"`
+		ExpiresAt       time.Time       `json:"expires_at"`
+		Challenge       string          `json:"challenge"`
+		Methods         []string        `json:"methods"`
 	}
 	resp := struct {
 		Message string              `json:"message"`
@@ -24,32 +60,51 @@ func (s *Service) Login(payload io.Reader) (string, User, PermissionCodes, dutil
 		Errors  map[string][]string `json:"errors"`
 	}{}
 
-	res, e := s.NewRequest("POST", s.URL.String(), nil, payload)
+	res, e := s.NewRequestContext(ctx, "POST", target, nil, payload)
 	if e != nil {
-		return "", User{}, nil, e
+		return LoginResult{}, e
 	}
 	_, e = s.decode(res, &resp)
 	if e != nil {
-		return "", User{}, nil, e
+		return LoginResult{}, e
 	}
 
 	if res.StatusCode == 200 {
-		token := res.Header.Get("X-User-Token")
-		return token, resp.Data.User, resp.Data.PermissionCodes, nil
+		result := LoginResult{
+			TokenPair: TokenPair{
+				Token:        res.Header.Get("X-User-Token"),
+				RefreshToken: resp.Data.RefreshToken,
+				ExpiresAt:    resp.Data.ExpiresAt,
+			},
+			User:            resp.Data.User,
+			PermissionCodes: resp.Data.PermissionCodes,
+		}
+		return result, nil
 	}
-
-	e = &dutil.Err{
-		Status: res.StatusCode,
-		Errors: resp.Errors,
+	if res.StatusCode == 202 {
+		e := newMFARequiredError(MFAChallenge{
+			Challenge: resp.Data.Challenge,
+			Methods:   resp.Data.Methods,
+			ExpiresAt: resp.Data.ExpiresAt,
+		})
+		return LoginResult{}, e
 	}
-	return "", User{}, nil, e
+
+	e = newStatusError(res.StatusCode, resp.Errors)
+	return LoginResult{}, e
 }
 
 // Logout sends request to the micro-service, the header contains the user
 // token of the user to be logged out. The security-service returns 200 if
 // request was successful.
 func (s *Service) Logout() dutil.Error {
-	s.URL.Path = "/logout"
+	return s.LogoutContext(context.Background())
+}
+
+// LogoutContext is Logout bound to the context ctx.
+func (s *Service) LogoutContext(ctx context.Context) dutil.Error {
+	ctx = withOperation(ctx, "logout")
+	u := s.endpoint("/logout", nil)
 
 	resp := struct {
 		Message string              `json:"message"`
@@ -57,7 +112,7 @@ func (s *Service) Logout() dutil.Error {
 		Errors  map[string][]string `json:"errors"`
 	}{}
 
-	res, e := s.NewRequest("GET", s.URL.String(), nil, nil)
+	res, e := s.NewRequestContext(ctx, "GET", u.String(), nil, nil)
 	if e != nil {
 		return e
 	}
@@ -67,13 +122,11 @@ func (s *Service) Logout() dutil.Error {
 	}
 
 	if res.StatusCode == 200 {
+		s.revoked(Revocation{Token: s.Token()})
 		return nil
 	}
 
-	e = &dutil.Err{
-		Status: res.StatusCode,
-		Errors: resp.Errors,
-	}
+	e = newStatusError(res.StatusCode, resp.Errors)
 
 	return e
 }
@@ -82,7 +135,13 @@ func (s *Service) Logout() dutil.Error {
 // the body should contain the email of the user. The security service will
 // then return the password reset token otherwise an error.
 func (s *Service) PasswordResetToken(p PasswordResetTokenPayload) (string, dutil.Error) {
-	s.URL.Path = "/reset-password/token"
+	return s.PasswordResetTokenContext(context.Background(), p)
+}
+
+// PasswordResetTokenContext is PasswordResetToken bound to the context ctx.
+func (s *Service) PasswordResetTokenContext(ctx context.Context, p PasswordResetTokenPayload) (string, dutil.Error) {
+	ctx = withOperation(ctx, "password_reset_token")
+	u := s.endpoint("/reset-password/token", nil)
 
 	type data struct {
 		PasswordResetToken string `json:"password_reset_token"`
@@ -98,7 +157,7 @@ func (s *Service) PasswordResetToken(p PasswordResetTokenPayload) (string, dutil
 		return "", e
 	}
 
-	res, e := s.NewRequest("post", s.URL.String(), nil, payload)
+	res, e := s.NewRequestContext(ctx, "post", u.String(), nil, payload)
 	if e != nil {
 		return "", e
 	}
@@ -108,10 +167,7 @@ func (s *Service) PasswordResetToken(p PasswordResetTokenPayload) (string, dutil
 	}
 
 	if res.StatusCode != 200 {
-		e := &dutil.Err{
-			Status: res.StatusCode,
-			Errors: resp.Errors,
-		}
+		e := newStatusError(res.StatusCode, resp.Errors)
 		return "", e
 	}
 
@@ -121,7 +177,13 @@ func (s *Service) PasswordResetToken(p PasswordResetTokenPayload) (string, dutil
 // ResetPassword handles the exchange with the security microservice to
 // reset a user's password.
 func (s *Service) ResetPassword(p ResetPasswordPayload) dutil.Error {
-	s.URL.Path = "/reset-password/reset"
+	return s.ResetPasswordContext(context.Background(), p)
+}
+
+// ResetPasswordContext is ResetPassword bound to the context ctx.
+func (s *Service) ResetPasswordContext(ctx context.Context, p ResetPasswordPayload) dutil.Error {
+	ctx = withOperation(ctx, "reset_password")
+	u := s.endpoint("/reset-password/reset", nil)
 
 	resp := struct {
 		Message string              `json:"message"`
@@ -134,7 +196,7 @@ func (s *Service) ResetPassword(p ResetPasswordPayload) dutil.Error {
 		return e
 	}
 
-	res, e := s.NewRequest("post", s.URL.String(), nil, payload)
+	res, e := s.NewRequestContext(ctx, "post", u.String(), nil, payload)
 	if e != nil {
 		return e
 	}
@@ -144,30 +206,90 @@ func (s *Service) ResetPassword(p ResetPasswordPayload) dutil.Error {
 	}
 
 	if res.StatusCode != 200 {
-		e := &dutil.Err{
-			Status: res.StatusCode,
-			Errors: resp.Errors,
-		}
+		e := newStatusError(res.StatusCode, resp.Errors)
 		return e
 	}
 
 	return nil
 }
 
+// ChangePassword handles the exchange with the security microservice to
+// change the password of the logged-in user whose token is in the header of
+// the Service. If RevokeOtherSessions is set the security microservice ends
+// all other sessions of the user, and when it issues a new token for the
+// current session the token of the Service is replaced with it.
+//
+// A wrong current password is reported as ErrWrongPassword, a new password
+// that does not meet the password policy as ErrPasswordPolicy and a new
+// password that was used before as ErrPasswordReused.
+func (s *Service) ChangePassword(p ChangePasswordPayload) dutil.Error {
+	return s.ChangePasswordContext(context.Background(), p)
+}
+
+// ChangePasswordContext is ChangePassword bound to the context ctx.
+func (s *Service) ChangePasswordContext(ctx context.Context, p ChangePasswordPayload) dutil.Error {
+	ctx = withOperation(ctx, "change_password")
+	u := s.endpoint("/change-password", nil)
+
+	resp := struct {
+		Message string              `json:"message"`
+		Data    interface{}         `json:"data"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	payload, e := dutil.MarshalReader(p)
+	if e != nil {
+		return e
+	}
+
+	res, e := s.NewRequestContext(ctx, "POST", u.String(), nil, payload)
+	if e != nil {
+		return e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return e
+	}
+
+	if res.StatusCode != 200 {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return e
+	}
+
+	current := s.Token()
+	if token := res.Header.Get("X-User-Token"); token != "" {
+		s.SetToken(token)
+	}
+	if p.RevokeOtherSessions {
+		r := Revocation{Except: s.Token()}
+		if current != r.Except {
+			r.Token = current
+		}
+		s.revoked(r)
+	}
+	return nil
+}
+
 // RevokePasswordResetToken handles the exchange with the security
 // microservice to revoke a user's password reset token.
 func (s *Service) RevokePasswordResetToken(passwordResetToken uuid.UUID) dutil.Error {
-	s.URL.Path = "/revoke-password-reset-token"
+	return s.RevokePasswordResetTokenContext(context.Background(), passwordResetToken)
+}
+
+// RevokePasswordResetTokenContext is RevokePasswordResetToken bound to the
+// context ctx.
+func (s *Service) RevokePasswordResetTokenContext(ctx context.Context, passwordResetToken uuid.UUID) dutil.Error {
+	ctx = withOperation(ctx, "revoke_password_reset_token")
 	qs := url.Values{}
 	qs.Add("password_reset_token", passwordResetToken.String())
-	s.URL.RawQuery = qs.Encode()
+	u := s.endpoint("/revoke-password-reset-token", qs)
 
 	resp := struct {
 		Message string              `json:"message"`
 		Errors  map[string][]string `json:"errors"`
 	}{}
 
-	res, e := s.NewRequest("delete", s.URL.String(), nil, nil)
+	res, e := s.NewRequestContext(ctx, "delete", u.String(), nil, nil)
 	if e != nil {
 		return e
 	}
@@ -177,10 +299,7 @@ func (s *Service) RevokePasswordResetToken(passwordResetToken uuid.UUID) dutil.E
 	}
 
 	if res.StatusCode != 200 {
-		e := &dutil.Err{
-			Status: res.StatusCode,
-			Errors: resp.Errors,
-		}
+		e := newStatusError(res.StatusCode, resp.Errors)
 		return e
 	}
 
@@ -1,6 +1,8 @@
 package security
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/dottics/dutil"
 	"github.com/google/uuid"
@@ -423,3 +425,193 @@ func TestService_RevokePasswordResetToken(t *testing.T) {
 		})
 	}
 }
+
+func TestService_LoginContext(t *testing.T) {
+	s := NewService("")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	token, _, _, e := s.LoginContext(ctx, strings.NewReader(`{"email":"tp@test.dottics.com","password":"password123"}`))
+	if token != "" {
+		t.Errorf("expected empty token got '%v'", token)
+	}
+	if e == nil {
+		t.Fatalf("expected error got nil")
+	}
+	if dutil.Inst(e).Status != StatusClientClosedRequest {
+		t.Errorf("expected status %d got %d", StatusClientClosedRequest, dutil.Inst(e).Status)
+	}
+}
+
+func TestService_Authenticate(t *testing.T) {
+	s := NewService("")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	ms.Append(&microtest.Exchange{
+		Response: microtest.Response{
+			Status: 200,
+			Header: map[string][]string{
+				"X-User-Token": {"some-long-jwt-encrypted-token"},
+			},
+			Body: `{"message":"login successful","data":{"user":{"uuid":"9b615709-cc9a-48c3-b1ea-a04d4375ea86","active":true},"permission":["abcd"],"refresh_token":"some-refresh-token","expires_at":"2022-05-01T12:00:00Z"},"errors":{}}`,
+		},
+	})
+
+	result, e := s.Authenticate(strings.NewReader(`{"email":"tp@test.dottics.com","password":"correct-password"}`))
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if result.Token != "some-long-jwt-encrypted-token" {
+		t.Errorf("expected '%v' got '%v'", "some-long-jwt-encrypted-token", result.Token)
+	}
+	if result.RefreshToken != "some-refresh-token" {
+		t.Errorf("expected '%v' got '%v'", "some-refresh-token", result.RefreshToken)
+	}
+	if result.ExpiresAt.IsZero() {
+		t.Errorf("expected the expiry of the token")
+	}
+	if result.User.UUID != uuid.MustParse("9b615709-cc9a-48c3-b1ea-a04d4375ea86") {
+		t.Errorf("expected '%v' got '%v'", "9b615709-cc9a-48c3-b1ea-a04d4375ea86", result.User.UUID)
+	}
+	if !result.PermissionCodes.Has("abcd") {
+		t.Errorf("expected %v got %v", PermissionCodes{"abcd"}, result.PermissionCodes)
+	}
+}
+
+func TestService_ChangePassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  ChangePasswordPayload
+		exchange *microtest.Exchange
+		e        dutil.Error
+		kind     error
+		token    string
+	}{
+		{
+			name: "wrong current password",
+			payload: ChangePasswordPayload{
+				CurrentPassword: "wrong-password",
+				NewPassword:     "new-password",
+			},
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 400,
+					Body:   `{"message":"BadRequest","data":{},"errors":{"current_password":["incorrect"]}}`,
+				},
+			},
+			e: &dutil.Err{
+				Status: 400,
+				Errors: map[string][]string{
+					"current_password": {"incorrect"},
+				},
+			},
+			kind:  ErrWrongPassword,
+			token: "my-very-secure-token",
+		},
+		{
+			name: "password policy",
+			payload: ChangePasswordPayload{
+				CurrentPassword: "password",
+				NewPassword:     "short",
+			},
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 400,
+					Body:   `{"message":"BadRequest","data":{},"errors":{"password_policy":["at least 8 characters"]}}`,
+				},
+			},
+			e: &dutil.Err{
+				Status: 400,
+				Errors: map[string][]string{
+					"password_policy": {"at least 8 characters"},
+				},
+			},
+			kind:  ErrPasswordPolicy,
+			token: "my-very-secure-token",
+		},
+		{
+			name: "password reused",
+			payload: ChangePasswordPayload{
+				CurrentPassword: "password",
+				NewPassword:     "password",
+			},
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 400,
+					Body:   `{"message":"BadRequest","data":{},"errors":{"password_reuse":["password was used before"]}}`,
+				},
+			},
+			e: &dutil.Err{
+				Status: 400,
+				Errors: map[string][]string{
+					"password_reuse": {"password was used before"},
+				},
+			},
+			kind:  ErrPasswordReused,
+			token: "my-very-secure-token",
+		},
+		{
+			name: "password changed",
+			payload: ChangePasswordPayload{
+				CurrentPassword: "password",
+				NewPassword:     "new-password",
+			},
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 200,
+					Body:   `{"message":"password changed","data":{},"errors":{}}`,
+				},
+			},
+			e:     nil,
+			token: "my-very-secure-token",
+		},
+		{
+			name: "other sessions revoked",
+			payload: ChangePasswordPayload{
+				CurrentPassword:     "password",
+				NewPassword:         "new-password",
+				RevokeOtherSessions: true,
+			},
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 200,
+					Header: map[string][]string{
+						"X-User-Token": {"my-new-token"},
+					},
+					Body: `{"message":"password changed","data":{},"errors":{}}`,
+				},
+			},
+			e:     nil,
+			token: "my-new-token",
+		},
+	}
+
+	s := NewService("my-very-secure-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			e := s.ChangePassword(tc.payload)
+			if !dutil.ErrorEqual(e, tc.e) {
+				t.Errorf("expected error %v got %v", tc.e, e)
+			}
+			if tc.kind != nil && !errors.Is(e, tc.kind) {
+				t.Errorf("expected '%v' got '%v'", tc.kind, e)
+			}
+			if tc.exchange.Request.Header.Get("X-User-Token") != "my-very-secure-token" {
+				t.Errorf("expected '%v' got '%v'", "my-very-secure-token", tc.exchange.Request.Header.Get("X-User-Token"))
+			}
+			if s.Token() != tc.token {
+				t.Errorf("expected token '%v' got '%v'", tc.token, s.Token())
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"github.com/dottics/dutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is wrapped by the TransportError of an exchange that was
+// not made because the circuit breaker of the Service is open.
+var ErrCircuitOpen = errors.New("security: circuit breaker is open")
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all exchanges through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails all exchanges fast until the cool-down has passed.
+	BreakerOpen
+	// BreakerHalfOpen lets a limited number of trial exchanges through to
+	// determine whether the security service has recovered.
+	BreakerHalfOpen
+)
+
+// String returns the name of the state.
+func (st BreakerState) String() string {
+	switch st {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerSettings configures a CircuitBreaker, zero values are replaced by
+// their defaults.
+type BreakerSettings struct {
+	// FailureThreshold is the number of consecutive failed exchanges that
+	// opens the breaker, it defaults to 5.
+	FailureThreshold int
+	// CoolDown is the time the breaker stays open before it lets trial
+	// exchanges through, it defaults to 30 seconds.
+	CoolDown time.Duration
+	// HalfOpenMaxCalls is the number of concurrent trial exchanges let
+	// through while half-open, it defaults to 1.
+	HalfOpenMaxCalls int
+	// OnStateChange is called after every change of state, for example to
+	// raise an alert when the breaker opens.
+	OnStateChange func(from BreakerState, to BreakerState)
+}
+
+// CircuitBreaker stops exchanges with the security service while it is
+// failing, so that callers fail fast instead of waiting on an unavailable
+// service. An exchange fails if it could not be made or the security
+// service responded with a 5xx status.
+//
+// GetHome is always let through as a trial exchange, so that a health check
+// can close an open breaker as soon as the security service has recovered.
+// A CircuitBreaker is safe for concurrent use and may be shared by several
+// Service instances that exchange with the same security service.
+type CircuitBreaker struct {
+	settings BreakerSettings
+	// now returns the current time, it is replaced in tests
+	now func() time.Time
+
+	mu            sync.Mutex
+	state         BreakerState
+	failures      int
+	openedAt      time.Time
+	halfOpenCalls int
+}
+
+// NewCircuitBreaker creates a closed CircuitBreaker with the settings.
+func NewCircuitBreaker(settings BreakerSettings) *CircuitBreaker {
+	if settings.FailureThreshold <= 0 {
+		settings.FailureThreshold = 5
+	}
+	if settings.CoolDown <= 0 {
+		settings.CoolDown = 30 * time.Second
+	}
+	if settings.HalfOpenMaxCalls <= 0 {
+		settings.HalfOpenMaxCalls = 1
+	}
+	return &CircuitBreaker{
+		settings: settings,
+		now:      time.Now,
+	}
+}
+
+// WithCircuitBreaker sets the CircuitBreaker of the Service.
+func WithCircuitBreaker(cb *CircuitBreaker) Option {
+	return func(o *options) {
+		o.breaker = cb
+	}
+}
+
+// State returns the current state of the breaker.
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == BreakerOpen && cb.cooledDown() {
+		return BreakerHalfOpen
+	}
+	return cb.state
+}
+
+// allow reports whether an exchange may be made, a probe is let through
+// even if the breaker is open. If allow returns true the outcome of the
+// exchange must be reported with done.
+func (cb *CircuitBreaker) allow(probe bool) bool {
+	cb.mu.Lock()
+	from := cb.state
+	ok := true
+	switch cb.state {
+	case BreakerOpen:
+		if !probe && !cb.cooledDown() {
+			ok = false
+			break
+		}
+		cb.setState(BreakerHalfOpen)
+		cb.halfOpenCalls++
+	case BreakerHalfOpen:
+		if !probe && cb.halfOpenCalls >= cb.settings.HalfOpenMaxCalls {
+			ok = false
+			break
+		}
+		cb.halfOpenCalls++
+	}
+	to := cb.state
+	cb.mu.Unlock()
+
+	cb.notify(from, to)
+	return ok
+}
+
+// breakerOutcome is the outcome of an exchange let through by allow.
+type breakerOutcome int
+
+const (
+	breakerSuccess breakerOutcome = iota
+	breakerFailure
+	// breakerUnknown is the outcome of an exchange abandoned before the
+	// security service answered, which says nothing about its health.
+	breakerUnknown
+)
+
+// done records the outcome of an exchange let through by allow. An unknown
+// outcome releases the half-open call of the exchange without changing the
+// state or the failure count.
+func (cb *CircuitBreaker) done(outcome breakerOutcome) {
+	cb.mu.Lock()
+	from := cb.state
+	switch {
+	case outcome == breakerUnknown:
+		if cb.state == BreakerHalfOpen && cb.halfOpenCalls > 0 {
+			cb.halfOpenCalls--
+		}
+	case outcome == breakerSuccess:
+		cb.failures = 0
+		if cb.state == BreakerHalfOpen {
+			cb.setState(BreakerClosed)
+		}
+	case cb.state == BreakerHalfOpen:
+		cb.setState(BreakerOpen)
+	default:
+		cb.failures++
+		if cb.failures >= cb.settings.FailureThreshold {
+			cb.setState(BreakerOpen)
+		}
+	}
+	to := cb.state
+	cb.mu.Unlock()
+
+	cb.notify(from, to)
+}
+
+// setState changes the state and resets the counts of the previous state,
+// the caller must hold cb.mu.
+func (cb *CircuitBreaker) setState(state BreakerState) {
+	cb.state = state
+	cb.failures = 0
+	cb.halfOpenCalls = 0
+	if state == BreakerOpen {
+		cb.openedAt = cb.now()
+	}
+}
+
+// cooledDown reports whether the open breaker has been open for the
+// cool-down, the caller must hold cb.mu.
+func (cb *CircuitBreaker) cooledDown() bool {
+	return cb.now().Sub(cb.openedAt) >= cb.settings.CoolDown
+}
+
+// notify calls the OnStateChange callback if the state changed. It is
+// called without holding cb.mu, so the callback may use the breaker.
+func (cb *CircuitBreaker) notify(from BreakerState, to BreakerState) {
+	if from != to && cb.settings.OnStateChange != nil {
+		cb.settings.OnStateChange(from, to)
+	}
+}
+
+// outcomeOf returns the outcome of an exchange for the circuit breaker.
+// Exchanges abandoned by the caller's context have an unknown outcome, as
+// the security service did not answer.
+func outcomeOf(ctx context.Context, res *http.Response, e dutil.Error) breakerOutcome {
+	switch {
+	case e != nil && ctx.Err() != nil:
+		return breakerUnknown
+	case e != nil || res.StatusCode >= 500:
+		return breakerFailure
+	}
+	return breakerSuccess
+}
+
+// newCircuitOpenError creates the error of an exchange that was not made
+// because the circuit breaker is open.
+func newCircuitOpenError() *TransportError {
+	return &TransportError{
+		Err:   dutil.NewErr(http.StatusServiceUnavailable, "circuit_breaker", []string{"security service unavailable"}),
+		Cause: ErrCircuitOpen,
+	}
+}
+
+// withProbe returns a copy of ctx that marks the exchange as a probe of the
+// health of the security service.
+func withProbe(ctx context.Context) context.Context {
+	return context.WithValue(ctx, probeKey, true)
+}
+
+// isProbe reports whether ctx marks the exchange as a probe.
+func isProbe(ctx context.Context) bool {
+	probe, _ := ctx.Value(probeKey).(bool)
+	return probe
+}
@@ -0,0 +1,243 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var changes []string
+	cb := NewCircuitBreaker(BreakerSettings{
+		FailureThreshold: 2,
+		CoolDown:         time.Minute,
+		OnStateChange: func(from BreakerState, to BreakerState) {
+			changes = append(changes, from.String()+"->"+to.String())
+		},
+	})
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	cb.now = func() time.Time { return now }
+
+	// a success resets the consecutive failures
+	for _, outcome := range []breakerOutcome{breakerFailure, breakerSuccess, breakerFailure} {
+		if !cb.allow(false) {
+			t.Fatalf("expected a closed breaker to allow the exchange")
+		}
+		cb.done(outcome)
+	}
+	if cb.State() != BreakerClosed {
+		t.Errorf("expected '%v' got '%v'", BreakerClosed, cb.State())
+	}
+
+	// an unknown outcome does not reset the consecutive failures
+	cb.allow(false)
+	cb.done(breakerUnknown)
+
+	// the threshold opens the breaker
+	cb.allow(false)
+	cb.done(breakerFailure)
+	if cb.State() != BreakerOpen {
+		t.Errorf("expected '%v' got '%v'", BreakerOpen, cb.State())
+	}
+	if cb.allow(false) {
+		t.Errorf("expected an open breaker not to allow the exchange")
+	}
+
+	// after the cool-down a single trial exchange is let through
+	now = now.Add(time.Minute)
+	if cb.State() != BreakerHalfOpen {
+		t.Errorf("expected '%v' got '%v'", BreakerHalfOpen, cb.State())
+	}
+	if !cb.allow(false) {
+		t.Fatalf("expected a half-open breaker to allow a trial exchange")
+	}
+	if cb.allow(false) {
+		t.Errorf("expected a half-open breaker to allow only one trial exchange")
+	}
+	// an unknown trial releases the trial without changing the state
+	cb.done(breakerUnknown)
+	if cb.State() != BreakerHalfOpen {
+		t.Errorf("expected '%v' got '%v'", BreakerHalfOpen, cb.State())
+	}
+	if !cb.allow(false) {
+		t.Fatalf("expected a half-open breaker to allow a trial exchange")
+	}
+	// a failed trial opens the breaker again
+	cb.done(breakerFailure)
+	if cb.State() != BreakerOpen {
+		t.Errorf("expected '%v' got '%v'", BreakerOpen, cb.State())
+	}
+
+	// a probe is let through an open breaker and closes it
+	if !cb.allow(true) {
+		t.Fatalf("expected an open breaker to allow a probe")
+	}
+	cb.done(breakerSuccess)
+	if cb.State() != BreakerClosed {
+		t.Errorf("expected '%v' got '%v'", BreakerClosed, cb.State())
+	}
+
+	expected := []string{
+		"closed->open",
+		"open->half-open",
+		"half-open->open",
+		"open->half-open",
+		"half-open->closed",
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %v got %v", expected, changes)
+	}
+}
+
+// TestService_circuitBreaker tests that an open breaker fails exchanges
+// fast and that GetHome closes it once the security service recovers.
+func TestService_circuitBreaker(t *testing.T) {
+	var requests int32
+	var healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(500)
+			_, _ = w.Write([]byte(`{"message":"","data":{},"errors":{"internal_server_error":["down"]}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"message":"","data":{},"errors":{}}`))
+	}))
+	defer server.Close()
+
+	cb := NewCircuitBreaker(BreakerSettings{
+		FailureThreshold: 3,
+		CoolDown:         time.Hour,
+	})
+	s := NewServiceWithOptions(
+		WithBaseURL("http", strings.TrimPrefix(server.URL, "http://")),
+		WithCircuitBreaker(cb),
+	)
+
+	for i := 0; i < 3; i++ {
+		e := s.Logout()
+		if !errors.Is(e, ErrServer) {
+			t.Errorf("expected '%v' got '%v'", ErrServer, e)
+		}
+	}
+	if cb.State() != BreakerOpen {
+		t.Fatalf("expected '%v' got '%v'", BreakerOpen, cb.State())
+	}
+
+	e := s.Logout()
+	if !errors.Is(e, ErrCircuitOpen) {
+		t.Errorf("expected '%v' got '%v'", ErrCircuitOpen, e)
+	}
+	var te *TransportError
+	if !errors.As(e, &te) || te.Status != 503 {
+		t.Errorf("expected a transport error with status %d got %v", 503, e)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("expected %d requests got %d", 3, n)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	alive, e := s.GetHome()
+	if !alive || e != nil {
+		t.Errorf("expected the security service to be alive got %v %v", alive, e)
+	}
+	if cb.State() != BreakerClosed {
+		t.Errorf("expected '%v' got '%v'", BreakerClosed, cb.State())
+	}
+	if e := s.Logout(); e != nil {
+		t.Errorf("unexpected error: %v", e)
+	}
+}
+
+// TestService_circuitBreaker_canceled tests that a half-open trial
+// abandoned by the caller's context neither closes nor opens the breaker.
+func TestService_circuitBreaker_canceled(t *testing.T) {
+	received := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	cb := NewCircuitBreaker(BreakerSettings{
+		FailureThreshold: 1,
+		CoolDown:         time.Minute,
+	})
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	cb.now = func() time.Time { return now }
+	cb.allow(false)
+	cb.done(breakerFailure)
+	now = now.Add(time.Minute)
+
+	s := NewServiceWithOptions(
+		WithBaseURL("http", strings.TrimPrefix(server.URL, "http://")),
+		WithRetryPolicy(RetryPolicy{}),
+		WithLogger(NopLogger{}),
+		WithCircuitBreaker(cb),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	e := s.LogoutContext(ctx)
+	if !errors.Is(e, context.Canceled) {
+		t.Errorf("expected '%v' got '%v'", context.Canceled, e)
+	}
+
+	if cb.State() != BreakerHalfOpen {
+		t.Errorf("expected '%v' got '%v'", BreakerHalfOpen, cb.State())
+	}
+	if !cb.allow(false) {
+		t.Errorf("expected the half-open breaker to allow another trial exchange")
+	}
+}
+
+// TestService_circuitBreaker_probe tests that a probe against a failing
+// security service is a single attempt, which changes the state once to
+// half-open and once back to open.
+func TestService_circuitBreaker_probe(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	var changes int32
+	cb := NewCircuitBreaker(BreakerSettings{
+		FailureThreshold: 1,
+		CoolDown:         time.Hour,
+		OnStateChange: func(from BreakerState, to BreakerState) {
+			atomic.AddInt32(&changes, 1)
+		},
+	})
+	cb.allow(false)
+	cb.done(breakerFailure)
+	atomic.StoreInt32(&changes, 0)
+
+	s := NewServiceWithOptions(
+		WithBaseURL("http", strings.TrimPrefix(server.URL, "http://")),
+		WithLogger(NopLogger{}),
+		WithCircuitBreaker(cb),
+	)
+	alive, _ := s.GetHome()
+	if alive {
+		t.Errorf("expected the security service not to be alive")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected %d requests got %d", 1, n)
+	}
+	if n := atomic.LoadInt32(&changes); n != 2 {
+		t.Errorf("expected %d state changes got %d", 2, n)
+	}
+	if cb.State() != BreakerOpen {
+		t.Errorf("expected '%v' got '%v'", BreakerOpen, cb.State())
+	}
+}
@@ -0,0 +1,268 @@
+package security
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"github.com/dottics/dutil"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// Revocation describes the user tokens and sessions revoked by an exchange
+// of the Service, see WithRevocationHook.
+type Revocation struct {
+	// Token is a revoked user token, such as the token of a Logout.
+	Token string
+	// SessionID is the ID of a revoked session.
+	SessionID string
+	// UserUUID is the user of which all sessions are revoked, except the
+	// session of the Except token.
+	UserUUID uuid.UUID
+	// Except is the user token of the session that is kept. If there is no
+	// UserUUID the other sessions of the user of the Except token, or of
+	// the Token, are revoked.
+	Except string
+}
+
+// WithRevocationHook sets the hook that is called after the Service
+// revoked user tokens or sessions with Logout, RevokeSession,
+// RevokeAllSessions, DeactivateUser or ChangePassword with
+// RevokeOtherSessions, such as the Revoke method of a ValidationCache:
+//
+//	cache := security.NewValidationCache(validator, security.CacheConfig{})
+//	s := security.NewServiceWithOptions(security.WithEnv(), security.WithRevocationHook(cache.Revoke))
+func WithRevocationHook(hook func(Revocation)) Option {
+	return func(o *options) {
+		o.onRevoke = hook
+	}
+}
+
+// revoked calls the revocation hook of the Service, if it has one.
+func (s *Service) revoked(r Revocation) {
+	if s.onRevoke != nil {
+		s.onRevoke(r)
+	}
+}
+
+// CacheConfig configures a ValidationCache.
+type CacheConfig struct {
+	// Size is the maximum number of tokens in the cache, the least recently
+	// used token is evicted to make room. It defaults to 10000.
+	Size int
+	// TTL is the time a valid token is cached for, capped at the expiry of
+	// the token. It defaults to a minute.
+	TTL time.Duration
+	// NegativeTTL is the time a rejected token is cached for. It defaults
+	// to five seconds.
+	NegativeTTL time.Duration
+	// Timeout is the time a validation may take. A validation is shared by
+	// the concurrent callers with the same token, so it is not cancelled
+	// with the context of the caller that started it. It defaults to ten
+	// seconds.
+	Timeout time.Duration
+}
+
+// ValidationCache is a TokenValidator which caches the results of another
+// TokenValidator, such as a *Service, so that the security microservice is
+// not asked to validate the same token for every request. The tokens are
+// kept in a bounded LRU keyed by a hash of the token, and concurrent
+// validations of the same token are made once.
+//
+// Only valid tokens and tokens rejected by the security microservice with
+// 400, 401 or 403 are cached, errors such as a failed or rate limited
+// exchange are not. Revoke evicts revoked
+// tokens immediately. It is safe for concurrent use.
+type ValidationCache struct {
+	validator TokenValidator
+	config    CacheConfig
+	now       func() time.Time
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List // of *cacheEntry, most recently used first
+	calls   map[[sha256.Size]byte]*validation
+	// generation is incremented by every revocation, so that validations
+	// in flight during a revocation are not cached
+	generation uint64
+}
+
+// cacheEntry is the cached result of the validation of a token.
+type cacheEntry struct {
+	key       [sha256.Size]byte
+	info      TokenInfo
+	e         dutil.Error
+	expiresAt time.Time
+}
+
+// validation is a validation in flight, which concurrent validations of
+// the same token wait for.
+type validation struct {
+	done chan struct{}
+	info TokenInfo
+	e    dutil.Error
+}
+
+// NewValidationCache creates a ValidationCache in front of the validator.
+func NewValidationCache(validator TokenValidator, config CacheConfig) *ValidationCache {
+	if config.Size <= 0 {
+		config.Size = 10000
+	}
+	if config.TTL == 0 {
+		config.TTL = time.Minute
+	}
+	if config.NegativeTTL == 0 {
+		config.NegativeTTL = 5 * time.Second
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	return &ValidationCache{
+		validator: validator,
+		config:    config,
+		now:       time.Now,
+		entries:   make(map[[sha256.Size]byte]*list.Element),
+		lru:       list.New(),
+		calls:     make(map[[sha256.Size]byte]*validation),
+	}
+}
+
+// ValidateTokenContext returns the cached result of the validation of the
+// token, or else validates the token with the validator of the cache. The
+// values of ctx are carried to the validation, and if ctx ends first the
+// error is keyed "context", but the validation is not cancelled.
+func (c *ValidationCache) ValidateTokenContext(ctx context.Context, token string) (TokenInfo, dutil.Error) {
+	key := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		if c.now().Before(entry.expiresAt) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return entry.info, entry.e
+		}
+		c.remove(el)
+	}
+	v, ok := c.calls[key]
+	if !ok {
+		v = &validation{done: make(chan struct{})}
+		c.calls[key] = v
+		go c.validate(ctx, key, token, v, c.generation)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-v.done:
+		return v.info, v.e
+	case <-ctx.Done():
+		return TokenInfo{}, requestErr(ctx, ctx.Err())
+	}
+}
+
+// validate validates the token for the validation v in flight, and caches
+// the result unless the cache was revoked since the generation. It runs on
+// a context detached from ctx, so that the concurrent callers waiting for
+// v do not fail if the caller that started it goes away.
+func (c *ValidationCache) validate(ctx context.Context, key [sha256.Size]byte, token string, v *validation, generation uint64) {
+	ctx, cancel := detach(ctx, c.config.Timeout)
+	defer cancel()
+	v.info, v.e = c.validator.ValidateTokenContext(ctx, token)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if generation == c.generation {
+		c.store(key, v.info, v.e)
+	}
+	c.mu.Unlock()
+	close(v.done)
+}
+
+// store caches the result of the validation of the token with the key, if
+// it is cacheable. The caller must hold c.mu.
+func (c *ValidationCache) store(key [sha256.Size]byte, info TokenInfo, e dutil.Error) {
+	now := c.now()
+	expiresAt := now.Add(c.config.TTL)
+	var se *StatusError
+	switch {
+	case e == nil:
+		if !info.ExpiresAt.IsZero() && info.ExpiresAt.Before(expiresAt) {
+			expiresAt = info.ExpiresAt
+		}
+	case errors.As(e, &se) && (se.Status == 400 || se.Status == 401 || se.Status == 403):
+		// the token was rejected, other client errors such as 408 or 429
+		// say nothing about the token
+		expiresAt = now.Add(c.config.NegativeTTL)
+	default:
+		return
+	}
+	if !now.Before(expiresAt) {
+		return
+	}
+
+	entry := &cacheEntry{key: key, info: info, e: e, expiresAt: expiresAt}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.config.Size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes the element from the cache. The caller must hold c.mu.
+func (c *ValidationCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// Evict removes the token from the cache.
+func (c *ValidationCache) Evict(token string) {
+	c.Revoke(Revocation{Token: token})
+}
+
+// Revoke removes the tokens and sessions of the revocation from the cache,
+// it is the hook to set with WithRevocationHook.
+func (c *ValidationCache) Revoke(r Revocation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+
+	var token, except *cacheEntry
+	if el, ok := c.entries[sha256.Sum256([]byte(r.Token))]; ok && r.Token != "" {
+		token = el.Value.(*cacheEntry)
+	}
+	if el, ok := c.entries[sha256.Sum256([]byte(r.Except))]; ok && r.Except != "" {
+		except = el.Value.(*cacheEntry)
+	}
+	userUUID := r.UserUUID
+	if userUUID == uuid.Nil && r.Except != "" {
+		switch {
+		case except != nil && except.e == nil:
+			userUUID = except.info.User.UUID
+		case token != nil && token.e == nil:
+			userUUID = token.info.User.UUID
+		}
+	}
+
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		entry := el.Value.(*cacheEntry)
+		switch {
+		case entry == token:
+			c.remove(el)
+		case entry == except:
+		case r.SessionID != "" && entry.info.SessionID == r.SessionID:
+			c.remove(el)
+		case userUUID != uuid.Nil && entry.info.User.UUID == userUUID:
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+// Len returns the number of tokens in the cache.
+func (c *ValidationCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,394 @@
+package security
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/dottics/dutil"
+	"github.com/google/uuid"
+	"github.com/johannesscr/micro/microtest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingValidator is a TokenValidator which counts its validations and
+// validates the tokens in its map, other tokens are rejected.
+type countingValidator struct {
+	mu     sync.Mutex
+	calls  map[string]int
+	tokens map[string]TokenInfo
+	e      dutil.Error
+}
+
+func (v *countingValidator) ValidateTokenContext(ctx context.Context, token string) (TokenInfo, dutil.Error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.calls == nil {
+		v.calls = make(map[string]int)
+	}
+	v.calls[token]++
+	if v.e != nil {
+		return TokenInfo{}, v.e
+	}
+	info, ok := v.tokens[token]
+	if !ok {
+		return TokenInfo{}, newStatusError(401, map[string][]string{"auth": {"Invalid token"}})
+	}
+	return info, nil
+}
+
+func (v *countingValidator) count(token string) int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.calls[token]
+}
+
+func TestValidationCache_ttl(t *testing.T) {
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	v := &countingValidator{tokens: map[string]TokenInfo{
+		"long":  {SessionID: "a", ExpiresAt: now.Add(time.Hour)},
+		"short": {SessionID: "b", ExpiresAt: now.Add(10 * time.Second)},
+	}}
+	c := NewValidationCache(v, CacheConfig{TTL: time.Minute, NegativeTTL: 5 * time.Second})
+	c.now = func() time.Time { return now }
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		token   string
+		calls   int
+		e       error
+	}{
+		{name: "first validation", token: "long", calls: 1},
+		{name: "cached", elapsed: 30 * time.Second, token: "long", calls: 1},
+		{name: "ttl passed", elapsed: 31 * time.Second, token: "long", calls: 2},
+		{name: "short first validation", token: "short", calls: 1},
+		{name: "short capped at expiry", elapsed: 10 * time.Second, token: "short", calls: 2},
+		{name: "rejected", token: "unknown", calls: 1, e: ErrUnauthorised},
+		{name: "rejected cached", elapsed: 4 * time.Second, token: "unknown", calls: 1, e: ErrUnauthorised},
+		{name: "negative ttl passed", elapsed: time.Second, token: "unknown", calls: 2, e: ErrUnauthorised},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			now = now.Add(tc.elapsed)
+			_, e := c.ValidateTokenContext(context.Background(), tc.token)
+			if !errors.Is(e, tc.e) || (tc.e == nil && e != nil) {
+				t.Errorf("expected '%v' got '%v'", tc.e, e)
+			}
+			if n := v.count(tc.token); n != tc.calls {
+				t.Errorf("expected %d validations got %d", tc.calls, n)
+			}
+		})
+	}
+}
+
+func TestValidationCache_failuresNotCached(t *testing.T) {
+	tests := []struct {
+		name string
+		e    dutil.Error
+	}{
+		{name: "server error", e: newStatusError(503, map[string][]string{"server": {"unavailable"}})},
+		{name: "rate limited", e: newStatusError(429, map[string][]string{"rate_limit": {"Too many requests"}})},
+		{name: "request timeout", e: newStatusError(408, map[string][]string{"timeout": {"Request timeout"}})},
+		{name: "transport error", e: newTransportError(500, "request", errors.New("connection refused"))},
+		{name: "cancelled", e: requestErr(canceledContext(), context.Canceled)},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			v := &countingValidator{e: tc.e}
+			c := NewValidationCache(v, CacheConfig{})
+			for j := 0; j < 2; j++ {
+				_, e := c.ValidateTokenContext(context.Background(), "token")
+				if !dutil.ErrorEqual(e, tc.e) {
+					t.Errorf("expected '%v' got '%v'", tc.e, e)
+				}
+			}
+			if n := v.count("token"); n != 2 {
+				t.Errorf("expected 2 validations got %d", n)
+			}
+			if c.Len() != 0 {
+				t.Errorf("expected an empty cache got %d", c.Len())
+			}
+		})
+	}
+}
+
+// canceledContext returns a cancelled context.
+func canceledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+func TestValidationCache_lru(t *testing.T) {
+	v := &countingValidator{tokens: map[string]TokenInfo{"a": {}, "b": {}, "c": {}}}
+	c := NewValidationCache(v, CacheConfig{Size: 2})
+	ctx := context.Background()
+
+	for _, token := range []string{"a", "b", "a", "c", "a", "b"} {
+		_, _ = c.ValidateTokenContext(ctx, token)
+	}
+	// "b" was the least recently used when "c" was added
+	calls := map[string]int{"a": 1, "b": 2, "c": 1}
+	for token, n := range calls {
+		if v.count(token) != n {
+			t.Errorf("expected %d validations of '%v' got %d", n, token, v.count(token))
+		}
+	}
+	if c.Len() != 2 {
+		t.Errorf("expected 2 tokens got %d", c.Len())
+	}
+}
+
+func TestValidationCache_singleflight(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	v := TokenValidatorFunc(func(ctx context.Context, token string) (TokenInfo, dutil.Error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return TokenInfo{SessionID: "a"}, nil
+	})
+	c := NewValidationCache(v, CacheConfig{})
+
+	var wg sync.WaitGroup
+	xi := make([]TokenInfo, 10)
+	for i := range xi {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			xi[i], _ = c.ValidateTokenContext(context.Background(), "token")
+		}(i)
+	}
+	// let the validations start before the first one completes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected 1 validation got %d", n)
+	}
+	for _, info := range xi {
+		if info.SessionID != "a" {
+			t.Errorf("expected '%v' got '%v'", "a", info.SessionID)
+		}
+	}
+}
+
+// TestValidationCache_leaderCanceled tests that the callers waiting for a
+// validation do not fail when the caller that started it goes away.
+func TestValidationCache_leaderCanceled(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	v := TokenValidatorFunc(func(ctx context.Context, token string) (TokenInfo, dutil.Error) {
+		close(started)
+		<-release
+		if ctx.Err() != nil {
+			return TokenInfo{}, requestErr(ctx, ctx.Err())
+		}
+		return TokenInfo{SessionID: "a"}, nil
+	})
+	c := NewValidationCache(v, CacheConfig{})
+
+	ctx, cancel := context.WithCancel(WithRequestID(context.Background(), "request-1"))
+	leader := make(chan dutil.Error)
+	go func() {
+		_, e := c.ValidateTokenContext(ctx, "token")
+		leader <- e
+	}()
+	<-started
+	waiter := make(chan TokenInfo)
+	go func() {
+		info, _ := c.ValidateTokenContext(context.Background(), "token")
+		waiter <- info
+	}()
+
+	cancel()
+	e := <-leader
+	if !errors.Is(e, context.Canceled) {
+		t.Errorf("expected '%v' got '%v'", context.Canceled, e)
+	}
+	close(release)
+	if info := <-waiter; info.SessionID != "a" {
+		t.Errorf("expected '%v' got '%v'", "a", info.SessionID)
+	}
+	if c.Len() != 1 {
+		t.Errorf("expected the validation to be cached")
+	}
+}
+
+func TestDetach(t *testing.T) {
+	parent, cancel := context.WithCancel(WithRequestID(context.Background(), "request-1"))
+	ctx, cancelDetached := detach(parent, time.Hour)
+	defer cancelDetached()
+	cancel()
+
+	if ctx.Err() != nil {
+		t.Errorf("expected the detached context not to be cancelled got '%v'", ctx.Err())
+	}
+	if requestID, _ := RequestIDFromContext(ctx); requestID != "request-1" {
+		t.Errorf("expected '%v' got '%v'", "request-1", requestID)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		t.Errorf("expected the detached context to have a deadline")
+	}
+}
+
+func TestValidationCache_Revoke(t *testing.T) {
+	u1 := uuid.New()
+	u2 := uuid.New()
+	tokens := map[string]TokenInfo{
+		"u1-a": {User: User{UUID: u1}, SessionID: "s1"},
+		"u1-b": {User: User{UUID: u1}, SessionID: "s2"},
+		"u1-c": {User: User{UUID: u1}, SessionID: "s3"},
+		"u2-a": {User: User{UUID: u2}, SessionID: "s4"},
+	}
+
+	tests := []struct {
+		name       string
+		revocation Revocation
+		cached     string
+	}{
+		{name: "token", revocation: Revocation{Token: "u1-a"}, cached: "u1-b u1-c u2-a"},
+		{name: "session", revocation: Revocation{SessionID: "s2"}, cached: "u1-a u1-c u2-a"},
+		{name: "user", revocation: Revocation{UserUUID: u1}, cached: "u2-a"},
+		{name: "user except", revocation: Revocation{UserUUID: u1, Except: "u1-b"}, cached: "u1-b u2-a"},
+		{name: "others of the except token", revocation: Revocation{Except: "u1-c"}, cached: "u1-c u2-a"},
+		{name: "others of the rotated token", revocation: Revocation{Token: "u1-a", Except: "new"}, cached: "u2-a"},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			c := NewValidationCache(&countingValidator{tokens: tokens}, CacheConfig{})
+			for _, token := range []string{"u1-a", "u1-b", "u1-c", "u2-a"} {
+				_, _ = c.ValidateTokenContext(context.Background(), token)
+			}
+			c.Revoke(tc.revocation)
+
+			cached := ""
+			for _, token := range []string{"u1-a", "u1-b", "u1-c", "u2-a"} {
+				c.mu.Lock()
+				_, ok := c.entries[sha256Sum(token)]
+				c.mu.Unlock()
+				if ok {
+					if cached != "" {
+						cached += " "
+					}
+					cached += token
+				}
+			}
+			if cached != tc.cached {
+				t.Errorf("expected '%v' got '%v'", tc.cached, cached)
+			}
+		})
+	}
+}
+
+func TestValidationCache_revokedInFlight(t *testing.T) {
+	var c *ValidationCache
+	v := TokenValidatorFunc(func(ctx context.Context, token string) (TokenInfo, dutil.Error) {
+		// the token is revoked while it is being validated
+		c.Evict(token)
+		return TokenInfo{SessionID: "a"}, nil
+	})
+	c = NewValidationCache(v, CacheConfig{})
+
+	_, e := c.ValidateTokenContext(context.Background(), "token")
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if c.Len() != 0 {
+		t.Errorf("expected the revoked validation not to be cached")
+	}
+}
+
+func TestService_revocationHook(t *testing.T) {
+	userUUID := uuid.MustParse("9b615709-cc9a-48c3-b1ea-a04d4375ea86")
+	ok := `{"message":"successful","data":{},"errors":{}}`
+
+	tests := []struct {
+		name       string
+		call       func(s *Service) dutil.Error
+		header     map[string][]string
+		revocation Revocation
+	}{
+		{
+			name:       "logout",
+			call:       func(s *Service) dutil.Error { return s.Logout() },
+			revocation: Revocation{Token: "my-very-secure-token"},
+		},
+		{
+			name:       "revoke session",
+			call:       func(s *Service) dutil.Error { return s.RevokeSession("a1") },
+			revocation: Revocation{SessionID: "a1"},
+		},
+		{
+			name:       "revoke all sessions",
+			call:       func(s *Service) dutil.Error { return s.RevokeAllSessions(userUUID, false) },
+			revocation: Revocation{UserUUID: userUUID},
+		},
+		{
+			name:       "revoke all sessions except current",
+			call:       func(s *Service) dutil.Error { return s.RevokeAllSessions(userUUID, true) },
+			revocation: Revocation{UserUUID: userUUID, Except: "my-very-secure-token"},
+		},
+		{
+			name: "deactivate user",
+			call: func(s *Service) dutil.Error {
+				_, e := s.DeactivateUser(userUUID)
+				return e
+			},
+			revocation: Revocation{UserUUID: userUUID},
+		},
+		{
+			name: "change password revoking other sessions",
+			call: func(s *Service) dutil.Error {
+				return s.ChangePassword(ChangePasswordPayload{RevokeOtherSessions: true})
+			},
+			header:     map[string][]string{"X-User-Token": {"new-token"}},
+			revocation: Revocation{Token: "my-very-secure-token", Except: "new-token"},
+		},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			var xr []Revocation
+			s := NewServiceWithOptions(
+				WithToken("my-very-secure-token"),
+				WithRevocationHook(func(r Revocation) { xr = append(xr, r) }),
+			)
+			ms := microtest.MockServer(s)
+			defer ms.Server.Close()
+
+			// a failed exchange revokes nothing
+			ms.Append(&microtest.Exchange{
+				Response: microtest.Response{Status: 400, Body: `{"message":"BadRequest","data":{},"errors":{"auth":["invalid"]}}`},
+			})
+			if e := tc.call(s); e == nil {
+				t.Fatalf("expected an error")
+			}
+			ms.Append(&microtest.Exchange{
+				Response: microtest.Response{Status: 200, Header: tc.header, Body: ok},
+			})
+			if e := tc.call(s); e != nil {
+				t.Fatalf("unexpected error: %v", e)
+			}
+			if len(xr) != 1 || xr[0] != tc.revocation {
+				t.Errorf("expected [%v] got %v", tc.revocation, xr)
+			}
+		})
+	}
+}
+
+// sha256Sum returns the cache key of the token.
+func sha256Sum(token string) [32]byte {
+	return sha256.Sum256([]byte(token))
+}
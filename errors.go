@@ -0,0 +1,217 @@
+package security
+
+import (
+	"errors"
+	"github.com/dottics/dutil"
+	"strings"
+)
+
+// The kinds of failure reported by the security microservice. Errors
+// returned by the exchanges wrap one of these where the kind is known, and
+// can be tested for with errors.Is:
+//
+//	_, _, _, e := s.Login(payload)
+//	if errors.Is(e, security.ErrInvalidCredentials) {
+//		...
+//	}
+var (
+	ErrInvalidCredentials       = errors.New("security: invalid email or password")
+	ErrUserInactive             = errors.New("security: user is inactive")
+	ErrUnauthorised             = errors.New("security: unauthorised")
+	ErrTokenExpired             = errors.New("security: token expired")
+	ErrForbidden                = errors.New("security: forbidden")
+	ErrNotFound                 = errors.New("security: not found")
+	ErrResetTokenInvalid        = errors.New("security: password reset token invalid or expired")
+	ErrVerificationTokenInvalid = errors.New("security: verification token invalid or expired")
+	ErrConflict                 = errors.New("security: conflict")
+	ErrWrongPassword            = errors.New("security: wrong current password")
+	ErrPasswordPolicy           = errors.New("security: password does not meet the password policy")
+	ErrPasswordReused           = errors.New("security: password was used before")
+	ErrMFARequired              = errors.New("security: second factor required")
+	ErrMFACodeInvalid           = errors.New("security: second factor code invalid")
+	ErrMFAChallengeInvalid      = errors.New("security: second factor challenge invalid or expired")
+	ErrRecoveryCodeInvalid      = errors.New("security: recovery code invalid")
+	ErrRecoveryCodeUsed         = errors.New("security: recovery code already used")
+	ErrBadRequest               = errors.New("security: bad request")
+	ErrServer                   = errors.New("security: security service error")
+)
+
+// StatusError is the error of an exchange to which the security
+// microservice responded with an unsuccessful status. Its Status and Errors
+// are those of the response, and it wraps the kind of failure, one of the
+// Err variables, if it is known.
+type StatusError struct {
+	*dutil.Err
+	Kind error
+}
+
+// Unwrap returns the kind of failure.
+func (e *StatusError) Unwrap() error {
+	return e.Kind
+}
+
+// MFARequiredError is the error of a login with valid credentials that is
+// only completed with a second factor. It wraps ErrMFARequired and has the
+// Challenge to complete the login with VerifyMFA:
+//
+//	_, _, _, e := s.Login(payload)
+//	var mfa *security.MFARequiredError
+//	if errors.As(e, &mfa) {
+//		result, e := s.VerifyMFA(mfa.Challenge.Challenge, code)
+//		...
+//	}
+type MFARequiredError struct {
+	*dutil.Err
+	Challenge MFAChallenge
+}
+
+// Unwrap returns ErrMFARequired.
+func (e *MFARequiredError) Unwrap() error {
+	return ErrMFARequired
+}
+
+// TransportError is the error of an exchange that could not be made, such
+// as a failed connection or a cancelled context. It wraps the cause, so
+// errors.Is(e, context.Canceled) reports whether the exchange was
+// cancelled.
+type TransportError struct {
+	*dutil.Err
+	Cause error
+}
+
+// Unwrap returns the cause of the failed exchange.
+func (e *TransportError) Unwrap() error {
+	return e.Cause
+}
+
+// DecodeError is the error of an exchange of which the response could not
+// be read or decoded.
+type DecodeError struct {
+	*dutil.Err
+	Cause error
+}
+
+// Unwrap returns the cause of the decode failure.
+func (e *DecodeError) Unwrap() error {
+	return e.Cause
+}
+
+// newStatusError creates the StatusError for a response of the security
+// microservice with the status and errors.
+func newStatusError(status int, errs map[string][]string) *StatusError {
+	return &StatusError{
+		Err: &dutil.Err{
+			Status: status,
+			Errors: errs,
+		},
+		Kind: kindOf(status, errs),
+	}
+}
+
+// newMFARequiredError creates the MFARequiredError for the challenge.
+func newMFARequiredError(challenge MFAChallenge) *MFARequiredError {
+	return &MFARequiredError{
+		Err:       dutil.NewErr(202, "mfa", []string{"Second factor required"}),
+		Challenge: challenge,
+	}
+}
+
+// newTransportError creates the TransportError with the status for the
+// cause under the key.
+func newTransportError(status int, key string, cause error) *TransportError {
+	return &TransportError{
+		Err:   dutil.NewErr(status, key, []string{cause.Error()}),
+		Cause: cause,
+	}
+}
+
+// newDecodeError creates the DecodeError for the cause under the key.
+func newDecodeError(key string, cause error) *DecodeError {
+	return &DecodeError{
+		Err:   dutil.NewErr(500, key, []string{cause.Error()}),
+		Cause: cause,
+	}
+}
+
+// kindOf maps the status and errors of a response of the security
+// microservice to the kind of failure. The status determines the kind,
+// which is refined by the keys and messages of the errors:
+//
+//   - 400 with an "auth" error is invalid credentials
+//   - 400 with a "password_reset_token" error is an invalid reset token
+//   - 400 with a "verification_token" error is an invalid verification token
+//   - 400 with a "current_password" error is a wrong current password
+//   - 400 with a "password_policy" error is a password policy violation
+//   - 400 with a "password_reuse" error is a reused password
+//   - 400 with a "mfa_code" error is an invalid second factor code
+//   - 400 with a "mfa_challenge" error is an invalid second factor challenge
+//   - 400 with a "recovery_code" error is an invalid recovery code, or a used
+//     one if a message contains "used"
+//   - 401 with a message containing "expired" is an expired token
+//   - 403 with a message containing "inactive" is an inactive user
+func kindOf(status int, errs map[string][]string) error {
+	switch {
+	case status < 400:
+		return nil
+	case status == 401:
+		if hasMessage(errs, "expired") {
+			return ErrTokenExpired
+		}
+		return ErrUnauthorised
+	case status == 403:
+		if hasMessage(errs, "inactive") {
+			return ErrUserInactive
+		}
+		return ErrForbidden
+	case status == 404:
+		return ErrNotFound
+	case status == 409:
+		return ErrConflict
+	case status >= 500:
+		return ErrServer
+	}
+	if _, ok := errs["auth"]; ok {
+		return ErrInvalidCredentials
+	}
+	if _, ok := errs["password_reset_token"]; ok {
+		return ErrResetTokenInvalid
+	}
+	if _, ok := errs["verification_token"]; ok {
+		return ErrVerificationTokenInvalid
+	}
+	if _, ok := errs["current_password"]; ok {
+		return ErrWrongPassword
+	}
+	if _, ok := errs["password_policy"]; ok {
+		return ErrPasswordPolicy
+	}
+	if _, ok := errs["password_reuse"]; ok {
+		return ErrPasswordReused
+	}
+	if _, ok := errs["mfa_code"]; ok {
+		return ErrMFACodeInvalid
+	}
+	if _, ok := errs["mfa_challenge"]; ok {
+		return ErrMFAChallengeInvalid
+	}
+	if xs, ok := errs["recovery_code"]; ok {
+		if hasMessage(map[string][]string{"recovery_code": xs}, "used") {
+			return ErrRecoveryCodeUsed
+		}
+		return ErrRecoveryCodeInvalid
+	}
+	return ErrBadRequest
+}
+
+// hasMessage reports whether any of the error messages contains the
+// substring, ignoring case.
+func hasMessage(errs map[string][]string, substr string) bool {
+	for _, xs := range errs {
+		for _, s := range xs {
+			if strings.Contains(strings.ToLower(s), substr) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dottics/dutil"
+	"github.com/johannesscr/micro/microtest"
+	"strings"
+	"testing"
+)
+
+func TestKindOf(t *testing.T) {
+	tests := []struct {
+		status int
+		errs   map[string][]string
+		kind   error
+	}{
+		{status: 200, errs: nil, kind: nil},
+		{status: 400, errs: map[string][]string{"auth": {"Invalid email or password"}}, kind: ErrInvalidCredentials},
+		{status: 400, errs: map[string][]string{"password_reset_token": {"invalid"}}, kind: ErrResetTokenInvalid},
+		{status: 400, errs: map[string][]string{"email": {"required field"}}, kind: ErrBadRequest},
+		{status: 400, errs: map[string][]string{"verification_token": {"invalid"}}, kind: ErrVerificationTokenInvalid},
+		{status: 400, errs: map[string][]string{"current_password": {"incorrect"}}, kind: ErrWrongPassword},
+		{status: 400, errs: map[string][]string{"password_policy": {"too short"}}, kind: ErrPasswordPolicy},
+		{status: 400, errs: map[string][]string{"password_reuse": {"used before"}}, kind: ErrPasswordReused},
+		{status: 400, errs: map[string][]string{"mfa_code": {"invalid code"}}, kind: ErrMFACodeInvalid},
+		{status: 400, errs: map[string][]string{"mfa_challenge": {"expired"}}, kind: ErrMFAChallengeInvalid},
+		{status: 400, errs: map[string][]string{"recovery_code": {"invalid code"}}, kind: ErrRecoveryCodeInvalid},
+		{status: 400, errs: map[string][]string{"recovery_code": {"code already used"}}, kind: ErrRecoveryCodeUsed},
+		{status: 409, errs: map[string][]string{"email": {"already registered"}}, kind: ErrConflict},
+		{status: 401, errs: map[string][]string{"auth": {"Auth token required"}}, kind: ErrUnauthorised},
+		{status: 401, errs: map[string][]string{"auth": {"Token Expired", "Please login"}}, kind: ErrTokenExpired},
+		{status: 403, errs: map[string][]string{"auth": {"User is inactive"}}, kind: ErrUserInactive},
+		{status: 403, errs: map[string][]string{"permission": {"abcd"}}, kind: ErrForbidden},
+		{status: 404, errs: map[string][]string{"user": {"not found"}}, kind: ErrNotFound},
+		{status: 503, errs: map[string][]string{}, kind: ErrServer},
+	}
+
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d %d", i, tc.status), func(t *testing.T) {
+			kind := kindOf(tc.status, tc.errs)
+			if kind != tc.kind {
+				t.Errorf("expected '%v' got '%v'", tc.kind, kind)
+			}
+		})
+	}
+}
+
+// TestErrors tests that the errors returned by the exchanges work with
+// errors.Is and errors.As and are still comparable as dutil.Error.
+func TestErrors(t *testing.T) {
+	s := NewService("")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	payload := `{"email":"tp@test.dottics.com","password":"password123"}`
+
+	// status error
+	ms.Append(&microtest.Exchange{
+		Response: microtest.Response{
+			Status: 400,
+			Body:   `{"message":"BadRequest: unable to process request","data":{},"errors":{"auth":["Invalid email or password"]}}`,
+		},
+	})
+	_, _, _, e := s.Login(strings.NewReader(payload))
+	if !errors.Is(e, ErrInvalidCredentials) {
+		t.Errorf("expected '%v' got '%v'", ErrInvalidCredentials, e)
+	}
+	var se *StatusError
+	if !errors.As(e, &se) || se.Status != 400 {
+		t.Errorf("expected a status error with status %d got %v", 400, e)
+	}
+	expected := dutil.NewErr(400, "auth", []string{"Invalid email or password"})
+	if !dutil.ErrorEqual(e, expected) {
+		t.Errorf("expected '%v' got '%v'", expected, e)
+	}
+
+	// decode error
+	ms.Append(&microtest.Exchange{
+		Response: microtest.Response{
+			Status: 200,
+			Body:   `{"message":`,
+		},
+	})
+	_, _, _, e = s.Login(strings.NewReader(payload))
+	var de *DecodeError
+	if !errors.As(e, &de) {
+		t.Errorf("expected a decode error got %v", e)
+	}
+	if dutil.Inst(e).Status != 500 {
+		t.Errorf("expected status %d got %d", 500, dutil.Inst(e).Status)
+	}
+
+	// transport error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, _, e = s.LoginContext(ctx, strings.NewReader(payload))
+	var te *TransportError
+	if !errors.As(e, &te) {
+		t.Errorf("expected a transport error got %v", e)
+	}
+	if !errors.Is(e, context.Canceled) {
+		t.Errorf("expected '%v' got '%v'", context.Canceled, e)
+	}
+	if errors.Is(e, ErrServer) {
+		t.Errorf("expected a transport error not to be '%v'", ErrServer)
+	}
+}
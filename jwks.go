@@ -0,0 +1,135 @@
+package security
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/dottics/dutil"
+	"math/big"
+)
+
+// JSONWebKey is a public key of a JSON Web Key Set, RFC 7517. Only the
+// members of RSA, P-256 EC and Ed25519 OKP keys are decoded.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC and OKP keys
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// JSONWebKeySet is the set of public keys the security microservice signs
+// user tokens with.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// GetJWKS handles the exchange with the security microservice to get the
+// JSONWebKeySet published at /.well-known/jwks.json.
+func (s *Service) GetJWKS() (JSONWebKeySet, dutil.Error) {
+	return s.GetJWKSContext(context.Background())
+}
+
+// GetJWKSContext is GetJWKS bound to the context ctx.
+func (s *Service) GetJWKSContext(ctx context.Context) (JSONWebKeySet, dutil.Error) {
+	ctx = withOperation(ctx, "get_jwks")
+	u := s.endpoint("/.well-known/jwks.json", nil)
+
+	res, e := s.NewRequestContext(ctx, "GET", u.String(), nil, nil)
+	if e != nil {
+		return JSONWebKeySet{}, e
+	}
+
+	if res.StatusCode != 200 {
+		resp := struct {
+			Errors map[string][]string `json:"errors"`
+		}{}
+		// the error response may not be in the structure of the security
+		// microservice, the status is enough
+		_, _ = s.decode(res, &resp)
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return JSONWebKeySet{}, e
+	}
+
+	set := JSONWebKeySet{}
+	_, e = s.decode(res, &set)
+	if e != nil {
+		return JSONWebKeySet{}, e
+	}
+	return set, nil
+}
+
+// PublicKey decodes the public key of the JSONWebKey, which is a
+// *rsa.PublicKey, a *ecdsa.PublicKey or an ed25519.PublicKey.
+func (k JSONWebKey) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("jwk %s: n: %w", k.Kid, err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("jwk %s: e: %w", k.Kid, err)
+		}
+		if !e.IsInt64() || e.Int64() < 2 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("jwk %s: invalid exponent", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("jwk %s: unsupported curve %q", k.Kid, k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("jwk %s: x: %w", k.Kid, err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("jwk %s: y: %w", k.Kid, err)
+		}
+		curve := elliptic.P256()
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("jwk %s: point is not on the curve", k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("jwk %s: unsupported curve %q", k.Kid, k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("jwk %s: x: %w", k.Kid, err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("jwk %s: invalid key size", k.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("jwk %s: unsupported key type %q", k.Kid, k.Kty)
+}
+
+// decodeBigInt decodes the unsigned big-endian integer of the base64url
+// string s.
+func decodeBigInt(s string) (*big.Int, error) {
+	xb, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(xb) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(xb), nil
+}
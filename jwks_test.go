@@ -0,0 +1,35 @@
+package security
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestJSONWebKey_PublicKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  JSONWebKey
+		err  bool
+	}{
+		{name: "unsupported key type", key: JSONWebKey{Kty: "oct", Kid: "a"}, err: true},
+		{name: "unsupported curve", key: JSONWebKey{Kty: "EC", Kid: "a", Crv: "P-521"}, err: true},
+		{name: "point not on the curve", key: JSONWebKey{Kty: "EC", Kid: "a", Crv: "P-256", X: "AQ", Y: "AQ"}, err: true},
+		{name: "rsa without modulus", key: JSONWebKey{Kty: "RSA", Kid: "a", E: "AQAB"}, err: true},
+		{name: "rsa", key: JSONWebKey{Kty: "RSA", Kid: "a", N: "AQAB", E: "AQAB"}},
+		{name: "ed25519 invalid size", key: JSONWebKey{Kty: "OKP", Kid: "a", Crv: "Ed25519", X: "AQAB"}, err: true},
+		{name: "ed25519", key: JSONWebKey{Kty: "OKP", Kid: "a", Crv: "Ed25519", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			pub, err := tc.key.PublicKey()
+			if (err != nil) != tc.err {
+				t.Errorf("expected error %v got '%v'", tc.err, err)
+			}
+			if (pub == nil) != tc.err {
+				t.Errorf("expected a key %v got %v", !tc.err, pub)
+			}
+		})
+	}
+}
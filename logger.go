@@ -0,0 +1,175 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Logger records the attempts of the exchanges of a Service. A Service
+// created by NewService logs to the standard logger, see WithLogger.
+type Logger interface {
+	LogExchange(ctx context.Context, r ExchangeRecord)
+}
+
+// ExchangeRecord is the structured record of an attempt of an exchange with
+// the security microservice. Query and Header are redacted, so that tokens
+// sent to the security microservice are not logged.
+type ExchangeRecord struct {
+	Method string
+	// Path is the path of the request, without the query string.
+	Path string
+	// Query is the query string with every value replaced by "REDACTED".
+	Query string
+	// Header is the header of the request with the values of the user
+	// token, API key, authorization and cookie headers replaced.
+	Header http.Header
+	// Status is the status of the response, or 0 if there is none.
+	Status int
+	// Latency is the time until the response header was received.
+	Latency time.Duration
+	// RequestID is the X-Request-ID of the request or else of the
+	// response, if any.
+	RequestID string
+	// Attempt is the number of the attempt of the exchange, starting at
+	// 1, see RetryPolicy.
+	Attempt int
+	// Err is the error of an attempt without a response, with the query
+	// string of the URL of a *url.Error redacted.
+	Err error
+}
+
+// WithLogger sets the Logger of the exchanges of the Service, such as a
+// NopLogger to not log the exchanges.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// NopLogger is a Logger which discards the records.
+type NopLogger struct{}
+
+// LogExchange does nothing.
+func (NopLogger) LogExchange(context.Context, ExchangeRecord) {}
+
+// stdLogger is a Logger which prints the records to a *log.Logger.
+type stdLogger struct {
+	l *log.Logger
+}
+
+// NewStdLogger creates a Logger which prints a line for every record to the
+// logger l, such as log.Default().
+func NewStdLogger(l *log.Logger) Logger {
+	return stdLogger{l: l}
+}
+
+// LogExchange prints the record.
+func (s stdLogger) LogExchange(_ context.Context, r ExchangeRecord) {
+	target := r.Path
+	if r.Query != "" {
+		target += "?" + r.Query
+	}
+	status := fmt.Sprint(r.Status)
+	if r.Err != nil {
+		status = r.Err.Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "- security-service -> [ %v %v ] <- %s (%v, attempt %d",
+		r.Method, target, status, r.Latency.Round(time.Microsecond), r.Attempt)
+	if r.RequestID != "" {
+		fmt.Fprintf(&b, ", request id %s", r.RequestID)
+	}
+	b.WriteString(")")
+	s.l.Print(b.String())
+}
+
+// redacted is the value logged instead of a secret.
+const redacted = "REDACTED"
+
+// secretHeaders are the headers of which the values are redacted.
+var secretHeaders = []string{"X-User-Token", "X-API-Key", "Authorization", "Cookie"}
+
+// newExchangeRecord creates the redacted record of the attempt of the
+// request req, of which res, which may be nil, is the response.
+func newExchangeRecord(ctx context.Context, req *http.Request, res *http.Response, latency time.Duration, err error) ExchangeRecord {
+	r := ExchangeRecord{
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Query:     redactQuery(req.URL.Query()),
+		Header:    redactHeader(req.Header),
+		Latency:   latency,
+		RequestID: req.Header.Get("X-Request-ID"),
+		Attempt:   attemptOf(ctx),
+		Err:       redactErr(err),
+	}
+	if res != nil {
+		r.Status = res.StatusCode
+		if r.RequestID == "" {
+			r.RequestID = res.Header.Get("X-Request-ID")
+		}
+	}
+	return r
+}
+
+// redactQuery encodes the query with every value redacted.
+func redactQuery(query url.Values) string {
+	xq := make(url.Values, len(query))
+	for key, values := range query {
+		for range values {
+			xq.Add(key, redacted)
+		}
+	}
+	// the encoded "REDACTED" is the same, so it is readable
+	return xq.Encode()
+}
+
+// redactErr returns the error err of an attempt with the query string of
+// the URL of a *url.Error redacted, as the client includes the URL in the
+// error.
+func redactErr(err error) error {
+	var ue *url.Error
+	if !errors.As(err, &ue) {
+		return err
+	}
+	target := ue.URL
+	if u, err := url.Parse(ue.URL); err == nil {
+		u.RawQuery = redactQuery(u.Query())
+		target = u.String()
+	} else if i := strings.IndexByte(target, '?'); i >= 0 {
+		target = target[:i+1] + redacted
+	}
+	return &url.Error{Op: ue.Op, URL: target, Err: ue.Err}
+}
+
+// redactHeader returns a copy of the header with the values of the
+// secretHeaders redacted.
+func redactHeader(header http.Header) http.Header {
+	h := header.Clone()
+	for _, key := range secretHeaders {
+		if h.Get(key) != "" {
+			h.Set(key, redacted)
+		}
+	}
+	return h
+}
+
+// withAttempt returns a copy of ctx that carries the number of the attempt
+// of an exchange.
+func withAttempt(ctx context.Context, attempt int) context.Context {
+	return context.WithValue(ctx, attemptKey, attempt)
+}
+
+// attemptOf returns the number of the attempt of an exchange carried by
+// ctx, an exchange that is not retried is the first attempt.
+func attemptOf(ctx context.Context) int {
+	if attempt, ok := ctx.Value(attemptKey).(int); ok {
+		return attempt
+	}
+	return 1
+}
@@ -0,0 +1,41 @@
+//go:build go1.21
+
+package security
+
+import (
+	"context"
+	"log/slog"
+)
+
+// slogLogger is a Logger which logs the records to a *slog.Logger.
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger creates a Logger which logs the records to the logger l,
+// at the error level for the attempts that failed or of which the status
+// is 5xx and at the info level otherwise.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l: l}
+}
+
+// LogExchange logs the record.
+func (s slogLogger) LogExchange(ctx context.Context, r ExchangeRecord) {
+	level := slog.LevelInfo
+	if r.Err != nil || r.Status >= 500 {
+		level = slog.LevelError
+	}
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("path", r.Path),
+		slog.String("query", r.Query),
+		slog.Int("status", r.Status),
+		slog.Duration("latency", r.Latency),
+		slog.String("request_id", r.RequestID),
+		slog.Int("attempt", r.Attempt),
+	}
+	if r.Err != nil {
+		attrs = append(attrs, slog.String("error", r.Err.Error()))
+	}
+	s.l.LogAttrs(ctx, level, "security-service exchange", attrs...)
+}
@@ -0,0 +1,63 @@
+//go:build go1.21
+
+package security
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNewSlogLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	rs := newRetryServer(503)
+	defer rs.Close()
+	rs.header.Set("X-Request-ID", "request-1")
+
+	s := rs.service()
+	s.logger = NewSlogLogger(slog.New(slog.NewJSONHandler(buf, nil)))
+	_, e := s.NewRequest(http.MethodGet, rs.URL+"/home?token=secret", nil, nil)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected '%v' got '%v'", 2, len(lines))
+	}
+	tests := []struct {
+		level   string
+		status  float64
+		attempt float64
+	}{
+		{level: "ERROR", status: 503, attempt: 1},
+		{level: "INFO", status: 200, attempt: 2},
+	}
+	for i, tc := range tests {
+		record := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(lines[i]), &record); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if record["level"] != tc.level {
+			t.Errorf("expected '%v' got '%v'", tc.level, record["level"])
+		}
+		if record["status"] != tc.status {
+			t.Errorf("expected '%v' got '%v'", tc.status, record["status"])
+		}
+		if record["attempt"] != tc.attempt {
+			t.Errorf("expected '%v' got '%v'", tc.attempt, record["attempt"])
+		}
+		if record["path"] != "/home" {
+			t.Errorf("expected '%v' got '%v'", "/home", record["path"])
+		}
+		if record["query"] != "token=REDACTED" {
+			t.Errorf("expected '%v' got '%v'", "token=REDACTED", record["query"])
+		}
+		if record["request_id"] != "request-1" {
+			t.Errorf("expected '%v' got '%v'", "request-1", record["request_id"])
+		}
+	}
+}
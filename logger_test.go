@@ -0,0 +1,272 @@
+package security
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingLogger is a Logger which records the records.
+type recordingLogger struct {
+	mu      sync.Mutex
+	records []ExchangeRecord
+}
+
+func (l *recordingLogger) LogExchange(_ context.Context, r ExchangeRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, r)
+}
+
+func TestWithLogger(t *testing.T) {
+	l := &recordingLogger{}
+	s := NewServiceWithOptions(WithLogger(l))
+	if s.logger != l {
+		t.Errorf("expected '%v' got '%v'", l, s.logger)
+	}
+	s = NewServiceWithOptions()
+	if _, ok := s.logger.(stdLogger); !ok {
+		t.Errorf("expected '%v' got '%T'", "stdLogger", s.logger)
+	}
+}
+
+func TestService_logger_redacted(t *testing.T) {
+	rs := newRetryServer()
+	defer rs.Close()
+
+	l := &recordingLogger{}
+	s := rs.service()
+	s.logger = l
+	s.SetToken("my secret token")
+	s.Header.Set("X-API-Key", "my secret key")
+
+	token := uuid.New()
+	e := s.RevokePasswordResetToken(token)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+
+	if len(l.records) != 1 {
+		t.Fatalf("expected '%v' got '%v'", 1, len(l.records))
+	}
+	r := l.records[0]
+	if r.Path != "/revoke-password-reset-token" {
+		t.Errorf("expected '%v' got '%v'", "/revoke-password-reset-token", r.Path)
+	}
+	if r.Query != "password_reset_token=REDACTED" {
+		t.Errorf("expected '%v' got '%v'", "password_reset_token=REDACTED", r.Query)
+	}
+	for _, key := range []string{"X-User-Token", "X-API-Key"} {
+		if r.Header.Get(key) != "REDACTED" {
+			t.Errorf("expected '%v' got '%v'", "REDACTED", r.Header.Get(key))
+		}
+	}
+	if r.Status != 200 {
+		t.Errorf("expected '%v' got '%v'", 200, r.Status)
+	}
+	if r.Attempt != 1 {
+		t.Errorf("expected '%v' got '%v'", 1, r.Attempt)
+	}
+	// the header of the Service is not redacted
+	if s.Token() != "my secret token" {
+		t.Errorf("expected '%v' got '%v'", "my secret token", s.Token())
+	}
+}
+
+func TestService_logger_attempts(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		requestID string
+		attempts  []int
+	}{
+		{
+			name:     "single attempt",
+			attempts: []int{200},
+		},
+		{
+			name:      "retried attempts",
+			statuses:  []int{503, 502},
+			requestID: "request-1",
+			attempts:  []int{503, 502, 200},
+		},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			rs := newRetryServer(tc.statuses...)
+			defer rs.Close()
+			if tc.requestID != "" {
+				rs.header.Set("X-Request-ID", tc.requestID)
+			}
+
+			l := &recordingLogger{}
+			s := rs.service()
+			s.logger = l
+			_, e := s.NewRequest(http.MethodGet, rs.URL+"/home", nil, nil)
+			if e != nil {
+				t.Fatalf("unexpected error: %v", e)
+			}
+
+			if len(l.records) != len(tc.attempts) {
+				t.Fatalf("expected '%v' got '%v'", len(tc.attempts), len(l.records))
+			}
+			for j, status := range tc.attempts {
+				r := l.records[j]
+				if r.Attempt != j+1 {
+					t.Errorf("expected '%v' got '%v'", j+1, r.Attempt)
+				}
+				if r.Status != status {
+					t.Errorf("expected '%v' got '%v'", status, r.Status)
+				}
+				if r.RequestID != tc.requestID {
+					t.Errorf("expected '%v' got '%v'", tc.requestID, r.RequestID)
+				}
+			}
+		})
+	}
+}
+
+func TestService_logger_error(t *testing.T) {
+	l := &recordingLogger{}
+	s := NewServiceWithOptions(
+		WithBaseURL("http", "security.dottics.com"),
+		WithRetryPolicy(RetryPolicy{}),
+		WithLogger(l),
+		WithTransport(roundTripperFunc(func(*http.Request) (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		})),
+	)
+
+	_, e := s.NewRequest(http.MethodGet, "http://security.dottics.com/home", nil, nil)
+	if e == nil {
+		t.Fatalf("expected an error")
+	}
+	if len(l.records) != 1 {
+		t.Fatalf("expected '%v' got '%v'", 1, len(l.records))
+	}
+	r := l.records[0]
+	if r.Status != 0 {
+		t.Errorf("expected '%v' got '%v'", 0, r.Status)
+	}
+	if r.Err == nil || !strings.Contains(r.Err.Error(), "connection refused") {
+		t.Errorf("expected '%v' got '%v'", "connection refused", r.Err)
+	}
+}
+
+func TestNewStdLogger(t *testing.T) {
+	tests := []struct {
+		name   string
+		record ExchangeRecord
+		output string
+	}{
+		{
+			name: "response",
+			record: ExchangeRecord{
+				Method:    "GET",
+				Path:      "/home",
+				Query:     "token=REDACTED",
+				Status:    200,
+				RequestID: "request-1",
+				Attempt:   1,
+			},
+			output: "- security-service -> [ GET /home?token=REDACTED ] <- 200 (0s, attempt 1, request id request-1)\n",
+		},
+		{
+			name: "error",
+			record: ExchangeRecord{
+				Method:  "POST",
+				Path:    "/login",
+				Attempt: 2,
+				Err:     errors.New("connection refused"),
+			},
+			output: "- security-service -> [ POST /login ] <- connection refused (0s, attempt 2)\n",
+		},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			NewStdLogger(log.New(buf, "", 0)).LogExchange(context.Background(), tc.record)
+			if buf.String() != tc.output {
+				t.Errorf("expected '%v' got '%v'", tc.output, buf.String())
+			}
+		})
+	}
+}
+
+func TestNopLogger(t *testing.T) {
+	var l Logger = NopLogger{}
+	l.LogExchange(context.Background(), ExchangeRecord{})
+}
+
+func TestService_logger_transportRedacted(t *testing.T) {
+	buf := &bytes.Buffer{}
+	s := NewServiceWithOptions(
+		WithBaseURL("http", "security.dottics.com"),
+		WithRetryPolicy(RetryPolicy{}),
+		WithLogger(NewStdLogger(log.New(buf, "", 0))),
+		WithTransport(roundTripperFunc(func(*http.Request) (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		})),
+	)
+
+	token := uuid.New()
+	e := s.RevokePasswordResetToken(token)
+	if e == nil {
+		t.Fatalf("expected an error")
+	}
+	if strings.Contains(buf.String(), token.String()) {
+		t.Errorf("expected the password reset token to be redacted got '%v'", buf.String())
+	}
+	if !strings.Contains(buf.String(), "password_reset_token=REDACTED\": connection refused") {
+		t.Errorf("expected the redacted URL and the error got '%v'", buf.String())
+	}
+}
+
+func TestRedactErr(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		text string
+	}{
+		{
+			name: "url error",
+			err:  &url.Error{Op: "Get", URL: "http://security.dottics.com/home?token=secret", Err: errors.New("connection refused")},
+			text: `Get "http://security.dottics.com/home?token=REDACTED": connection refused`,
+		},
+		{
+			name: "unparsable url",
+			err:  &url.Error{Op: "Get", URL: "http://security dottics%zz/home?token=secret", Err: errors.New("connection refused")},
+			text: `Get "http://security dottics%zz/home?REDACTED": connection refused`,
+		},
+		{
+			name: "other error",
+			err:  errors.New("connection refused"),
+			text: "connection refused",
+		},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			err := redactErr(tc.err)
+			if err.Error() != tc.text {
+				t.Errorf("expected '%v' got '%v'", tc.text, err.Error())
+			}
+			if cause := errors.Unwrap(tc.err); cause != nil && !errors.Is(err, cause) {
+				t.Errorf("expected the cause to be kept")
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package security
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics observes the exchanges of a Service, such as a Registry. An
+// exchange is observed once, including its retries and the refresh of the
+// user token, see WithMetrics.
+type Metrics interface {
+	ObserveExchange(ctx context.Context, o Observation)
+}
+
+// Observation is the observation of an exchange with the security
+// microservice.
+type Observation struct {
+	// Operation is the name of the exchange, such as "login", "logout" or
+	// "password_reset_token". Requests made with NewRequest are the
+	// operation "request".
+	Operation string
+	Method    string
+	// Status is the status of the response, or 0 if there is none.
+	Status int
+	// Duration is the time of the whole exchange until the response
+	// header of its last attempt was received, including its retries,
+	// the backoff between them and the refresh of the user token.
+	Duration time.Duration
+	// Err is the error of an exchange without a response.
+	Err error
+}
+
+// The outcomes of an exchange.
+const (
+	// OutcomeSuccess is an exchange with a 1xx, 2xx or 3xx response.
+	OutcomeSuccess = "success"
+	// OutcomeFailure is an exchange with a 4xx or 5xx response.
+	OutcomeFailure = "failure"
+	// OutcomeError is an exchange without a response, such as a
+	// TransportError or an exchange rejected by an open CircuitBreaker.
+	OutcomeError = "error"
+)
+
+// StatusClass returns the class of the status of the observation, such as
+// "2xx", or "none" if the exchange has no response.
+func (o Observation) StatusClass() string {
+	if o.Status < 100 || o.Status > 599 {
+		return "none"
+	}
+	return strconv.Itoa(o.Status/100) + "xx"
+}
+
+// Outcome returns the outcome of the exchange, one of OutcomeSuccess,
+// OutcomeFailure and OutcomeError.
+func (o Observation) Outcome() string {
+	switch {
+	case o.Status < 100 || o.Status > 599:
+		return OutcomeError
+	case o.Status >= 400:
+		return OutcomeFailure
+	default:
+		return OutcomeSuccess
+	}
+}
+
+// WithMetrics sets the Metrics which observe the exchanges of the Service.
+// A Service has no Metrics by default.
+func WithMetrics(m Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+// withOperation returns a copy of ctx that carries the name of the
+// operation of an exchange.
+func withOperation(ctx context.Context, operation string) context.Context {
+	return context.WithValue(ctx, operationKey, operation)
+}
+
+// operationOf returns the name of the operation carried by ctx, requests
+// made with NewRequest are the operation "request".
+func operationOf(ctx context.Context) string {
+	if operation, ok := ctx.Value(operationKey).(string); ok {
+		return operation
+	}
+	return "request"
+}
+
+// observe passes the observation of the exchange to the Metrics of the
+// Service, if it has any.
+func (s *Service) observe(ctx context.Context, method string, start time.Time, res *http.Response, e error) {
+	if s.metrics == nil {
+		return
+	}
+	o := Observation{
+		Operation: operationOf(ctx),
+		Method:    strings.ToUpper(method),
+		Duration:  time.Since(start),
+	}
+	if res != nil {
+		o.Status = res.StatusCode
+	} else {
+		o.Err = e
+	}
+	s.metrics.ObserveExchange(ctx, o)
+}
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of the
+// exchange duration histogram of a Registry.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry is the default Metrics, it counts the exchanges by operation,
+// status class and outcome, and keeps a histogram of their duration by
+// operation and outcome. It is an http.Handler which serves the metrics in
+// the Prometheus text exposition format:
+//
+//	security_service_exchanges_total{operation,status_class,outcome}
+//	security_service_exchange_duration_seconds{operation,outcome}
+//
+// A Registry is safe for concurrent use.
+type Registry struct {
+	buckets []float64
+
+	mu        sync.Mutex
+	exchanges map[exchangeLabels]uint64
+	durations map[durationLabels]*histogram
+}
+
+// exchangeLabels are the labels of the exchanges counter.
+type exchangeLabels struct {
+	operation   string
+	statusClass string
+	outcome     string
+}
+
+// durationLabels are the labels of the exchange duration histogram.
+type durationLabels struct {
+	operation string
+	outcome   string
+}
+
+// histogram is a histogram of which counts[i] is the number of
+// observations less than or equal to the i-th bucket.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewRegistry creates a Registry of which the duration histogram has the
+// buckets, the DefaultBuckets if none are given.
+func NewRegistry(buckets ...float64) *Registry {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	xb := append([]float64(nil), buckets...)
+	sort.Float64s(xb)
+	return &Registry{
+		buckets:   xb,
+		exchanges: make(map[exchangeLabels]uint64),
+		durations: make(map[durationLabels]*histogram),
+	}
+}
+
+// ObserveExchange counts the exchange and adds its duration to the
+// histogram.
+func (r *Registry) ObserveExchange(_ context.Context, o Observation) {
+	seconds := o.Duration.Seconds()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exchanges[exchangeLabels{o.Operation, o.StatusClass(), o.Outcome()}]++
+	key := durationLabels{o.Operation, o.Outcome()}
+	h, ok := r.durations[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(r.buckets))}
+		r.durations[key] = h
+	}
+	for i, upper := range r.buckets {
+		if seconds <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// Exchanges returns the number of exchanges counted of the operation with
+// the status class and outcome.
+func (r *Registry) Exchanges(operation string, statusClass string, outcome string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.exchanges[exchangeLabels{operation, statusClass, outcome}]
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format to
+// w, the series are sorted by their labels. The metrics are copied before
+// they are written, so that a slow writer does not hold up the exchanges.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	exchanges := make(map[exchangeLabels]uint64, len(r.exchanges))
+	for key, n := range r.exchanges {
+		exchanges[key] = n
+	}
+	durations := make(map[durationLabels]histogram, len(r.durations))
+	for key, h := range r.durations {
+		durations[key] = histogram{
+			counts: append([]uint64(nil), h.counts...),
+			count:  h.count,
+			sum:    h.sum,
+		}
+	}
+	r.mu.Unlock()
+
+	xe := make([]exchangeLabels, 0, len(exchanges))
+	for key := range exchanges {
+		xe = append(xe, key)
+	}
+	xd := make([]durationLabels, 0, len(durations))
+	for key := range durations {
+		xd = append(xd, key)
+	}
+	sort.Slice(xe, func(i, j int) bool {
+		a, b := xe[i], xe[j]
+		if a.operation != b.operation {
+			return a.operation < b.operation
+		}
+		if a.statusClass != b.statusClass {
+			return a.statusClass < b.statusClass
+		}
+		return a.outcome < b.outcome
+	})
+	sort.Slice(xd, func(i, j int) bool {
+		a, b := xd[i], xd[j]
+		if a.operation != b.operation {
+			return a.operation < b.operation
+		}
+		return a.outcome < b.outcome
+	})
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	fmt.Fprintln(cw, "# HELP security_service_exchanges_total The number of exchanges with the security service.")
+	fmt.Fprintln(cw, "# TYPE security_service_exchanges_total counter")
+	for _, key := range xe {
+		fmt.Fprintf(cw, "security_service_exchanges_total{operation=\"%s\",status_class=\"%s\",outcome=\"%s\"} %d\n",
+			escapeLabel(key.operation), key.statusClass, key.outcome, exchanges[key])
+	}
+	fmt.Fprintln(cw, "# HELP security_service_exchange_duration_seconds The duration of exchanges with the security service.")
+	fmt.Fprintln(cw, "# TYPE security_service_exchange_duration_seconds histogram")
+	for _, key := range xd {
+		h := durations[key]
+		labels := fmt.Sprintf("operation=\"%s\",outcome=\"%s\"", escapeLabel(key.operation), key.outcome)
+		for i, upper := range r.buckets {
+			fmt.Fprintf(cw, "security_service_exchange_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				labels, strconv.FormatFloat(upper, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(cw, "security_service_exchange_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(cw, "security_service_exchange_duration_seconds_sum{%s} %s\n",
+			labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(cw, "security_service_exchange_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = r.WriteTo(w)
+}
+
+// countingWriter counts the bytes written to w and keeps the first error.
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// labelEscaper escapes the label values of the text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes the label value v.
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
@@ -0,0 +1,255 @@
+package security
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics is a Metrics which records the observations.
+type recordingMetrics struct {
+	mu           sync.Mutex
+	observations []Observation
+}
+
+func (m *recordingMetrics) ObserveExchange(_ context.Context, o Observation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observations = append(m.observations, o)
+}
+
+func TestObservation(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		statusClass string
+		outcome     string
+	}{
+		{name: "ok", status: 200, statusClass: "2xx", outcome: OutcomeSuccess},
+		{name: "redirect", status: 302, statusClass: "3xx", outcome: OutcomeSuccess},
+		{name: "bad request", status: 400, statusClass: "4xx", outcome: OutcomeFailure},
+		{name: "unavailable", status: 503, statusClass: "5xx", outcome: OutcomeFailure},
+		{name: "no response", status: 0, statusClass: "none", outcome: OutcomeError},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			o := Observation{Status: tc.status}
+			if o.StatusClass() != tc.statusClass {
+				t.Errorf("expected '%v' got '%v'", tc.statusClass, o.StatusClass())
+			}
+			if o.Outcome() != tc.outcome {
+				t.Errorf("expected '%v' got '%v'", tc.outcome, o.Outcome())
+			}
+		})
+	}
+}
+
+func TestService_metrics(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		call      func(s *Service) error
+		operation string
+		method    string
+		status    int
+	}{
+		{
+			name:      "logout",
+			call:      func(s *Service) error { return s.Logout() },
+			operation: "logout",
+			method:    "GET",
+			status:    200,
+		},
+		{
+			name:      "retried once observed",
+			statuses:  []int{503, 503, 503},
+			call:      func(s *Service) error { return s.Logout() },
+			operation: "logout",
+			method:    "GET",
+			status:    503,
+		},
+		{
+			name:     "password reset token",
+			statuses: []int{404},
+			call: func(s *Service) error {
+				_, e := s.PasswordResetToken(PasswordResetTokenPayload{Email: "tp@test.dottics.com"})
+				return e
+			},
+			operation: "password_reset_token",
+			method:    "POST",
+			status:    404,
+		},
+		{
+			name: "request",
+			call: func(s *Service) error {
+				_, e := s.NewRequest("get", s.URL.String()+"/home", nil, nil)
+				return e
+			},
+			operation: "request",
+			method:    "GET",
+			status:    200,
+		},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			rs := newRetryServer(tc.statuses...)
+			defer rs.Close()
+
+			m := &recordingMetrics{}
+			s := rs.service()
+			s.metrics = m
+			_ = tc.call(s)
+
+			if len(m.observations) != 1 {
+				t.Fatalf("expected '%v' got '%v'", 1, len(m.observations))
+			}
+			o := m.observations[0]
+			if o.Operation != tc.operation {
+				t.Errorf("expected '%v' got '%v'", tc.operation, o.Operation)
+			}
+			if o.Method != tc.method {
+				t.Errorf("expected '%v' got '%v'", tc.method, o.Method)
+			}
+			if o.Status != tc.status {
+				t.Errorf("expected '%v' got '%v'", tc.status, o.Status)
+			}
+			if o.Duration <= 0 {
+				t.Errorf("expected a duration got '%v'", o.Duration)
+			}
+		})
+	}
+}
+
+func TestService_metrics_error(t *testing.T) {
+	r := NewRegistry()
+	s := NewServiceWithOptions(
+		WithBaseURL("http", "security.dottics.com"),
+		WithRetryPolicy(RetryPolicy{}),
+		WithLogger(NopLogger{}),
+		WithMetrics(r),
+		WithTransport(roundTripperFunc(func(*http.Request) (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		})),
+	)
+
+	e := s.Logout()
+	if e == nil {
+		t.Fatalf("expected an error")
+	}
+	if n := r.Exchanges("logout", "none", OutcomeError); n != 1 {
+		t.Errorf("expected '%v' got '%v'", 1, n)
+	}
+}
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := NewRegistry(0.1, 0.5)
+	r.ObserveExchange(context.Background(), Observation{Operation: "login", Status: 200, Duration: 50 * time.Millisecond})
+	r.ObserveExchange(context.Background(), Observation{Operation: "login", Status: 401, Duration: 200 * time.Millisecond})
+	r.ObserveExchange(context.Background(), Observation{Operation: "login", Status: 200, Duration: time.Second})
+	r.ObserveExchange(context.Background(), Observation{Operation: "logout", Duration: 0})
+
+	expected := `# HELP security_service_exchanges_total The number of exchanges with the security service.
+# TYPE security_service_exchanges_total counter
+security_service_exchanges_total{operation="login",status_class="2xx",outcome="success"} 2
+security_service_exchanges_total{operation="login",status_class="4xx",outcome="failure"} 1
+security_service_exchanges_total{operation="logout",status_class="none",outcome="error"} 1
+# HELP security_service_exchange_duration_seconds The duration of exchanges with the security service.
+# TYPE security_service_exchange_duration_seconds histogram
+security_service_exchange_duration_seconds_bucket{operation="login",outcome="failure",le="0.1"} 0
+security_service_exchange_duration_seconds_bucket{operation="login",outcome="failure",le="0.5"} 1
+security_service_exchange_duration_seconds_bucket{operation="login",outcome="failure",le="+Inf"} 1
+security_service_exchange_duration_seconds_sum{operation="login",outcome="failure"} 0.2
+security_service_exchange_duration_seconds_count{operation="login",outcome="failure"} 1
+security_service_exchange_duration_seconds_bucket{operation="login",outcome="success",le="0.1"} 1
+security_service_exchange_duration_seconds_bucket{operation="login",outcome="success",le="0.5"} 1
+security_service_exchange_duration_seconds_bucket{operation="login",outcome="success",le="+Inf"} 2
+security_service_exchange_duration_seconds_sum{operation="login",outcome="success"} 1.05
+security_service_exchange_duration_seconds_count{operation="login",outcome="success"} 2
+security_service_exchange_duration_seconds_bucket{operation="logout",outcome="error",le="0.1"} 1
+security_service_exchange_duration_seconds_bucket{operation="logout",outcome="error",le="0.5"} 1
+security_service_exchange_duration_seconds_bucket{operation="logout",outcome="error",le="+Inf"} 1
+security_service_exchange_duration_seconds_sum{operation="logout",outcome="error"} 0
+security_service_exchange_duration_seconds_count{operation="logout",outcome="error"} 1
+`
+	buf := &bytes.Buffer{}
+	n, err := r.WriteTo(buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if buf.String() != expected {
+		t.Errorf("expected '%v' got '%v'", expected, buf.String())
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("expected '%v' got '%v'", buf.Len(), n)
+	}
+}
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.ObserveExchange(context.Background(), Observation{Operation: `a"b`, Status: 200})
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("expected '%v' got '%v'", "text/plain; version=0.0.4", ct)
+	}
+	series := `security_service_exchanges_total{operation="a\"b",status_class="2xx",outcome="success"} 1`
+	if !strings.Contains(rec.Body.String(), series) {
+		t.Errorf("expected '%v' in '%v'", series, rec.Body.String())
+	}
+}
+
+// blockingWriter is an io.Writer which blocks until release is closed.
+type blockingWriter struct {
+	writing chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.writing) })
+	<-w.release
+	return len(p), nil
+}
+
+// TestRegistry_WriteTo_slowWriter tests that a slow scrape does not hold up
+// the observation of exchanges.
+func TestRegistry_WriteTo_slowWriter(t *testing.T) {
+	r := NewRegistry()
+	for i := 0; i < 200; i++ {
+		r.ObserveExchange(context.Background(), Observation{Operation: fmt.Sprintf("operation_%d", i), Status: 200})
+	}
+
+	w := &blockingWriter{writing: make(chan struct{}), release: make(chan struct{})}
+	written := make(chan struct{})
+	go func() {
+		_, _ = r.WriteTo(w)
+		close(written)
+	}()
+	<-w.writing
+
+	observed := make(chan struct{})
+	go func() {
+		r.ObserveExchange(context.Background(), Observation{Operation: "login", Status: 200})
+		close(observed)
+	}()
+	select {
+	case <-observed:
+	case <-time.After(time.Second):
+		t.Errorf("expected the exchange to be observed while the metrics are written")
+	}
+	close(w.release)
+	<-written
+}
@@ -0,0 +1,228 @@
+package security
+
+import (
+	"context"
+	"github.com/dottics/dutil"
+	"io"
+)
+
+// VerifyMFA handles the exchange with the security microservice to
+// complete the login of the challenge, see MFARequiredError, with the code
+// of the second factor of the user. The result is that of a login without
+// a second factor.
+func (s *Service) VerifyMFA(challenge string, code string) (LoginResult, dutil.Error) {
+	return s.VerifyMFAContext(context.Background(), challenge, code)
+}
+
+// VerifyMFAContext is VerifyMFA bound to the context ctx.
+func (s *Service) VerifyMFAContext(ctx context.Context, challenge string, code string) (LoginResult, dutil.Error) {
+	ctx = withOperation(ctx, "verify_mfa")
+	u := s.endpoint("/login/mfa", nil)
+
+	payload, e := dutil.MarshalReader(VerifyMFAPayload{Challenge: challenge, Code: code})
+	if e != nil {
+		return LoginResult{}, e
+	}
+	return s.loginExchange(ctx, u.String(), payload)
+}
+
+// EnrollTOTP handles the exchange with the security microservice to start
+// the enrolment of a TOTP authenticator for the logged-in user. The
+// enrolment is pending until it is confirmed with ConfirmTOTP.
+func (s *Service) EnrollTOTP() (TOTPEnrollment, dutil.Error) {
+	return s.EnrollTOTPContext(context.Background())
+}
+
+// EnrollTOTPContext is EnrollTOTP bound to the context ctx.
+func (s *Service) EnrollTOTPContext(ctx context.Context) (TOTPEnrollment, dutil.Error) {
+	ctx = withOperation(ctx, "enroll_totp")
+	u := s.endpoint("/mfa/totp/enroll", nil)
+
+	type data struct {
+		TOTPEnrollment
+	}
+	resp := struct {
+		Message string              `json:"message"`
+		Data    data                `json:"data"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	res, e := s.NewRequestContext(ctx, "POST", u.String(), nil, nil)
+	if e != nil {
+		return TOTPEnrollment{}, e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return TOTPEnrollment{}, e
+	}
+
+	if res.StatusCode != 200 {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return TOTPEnrollment{}, e
+	}
+
+	return resp.Data.TOTPEnrollment, nil
+}
+
+// ConfirmTOTP handles the exchange with the security microservice to
+// confirm the pending TOTP enrolment of the logged-in user with a code of
+// the authenticator. Once confirmed a login requires a second factor.
+func (s *Service) ConfirmTOTP(code string) dutil.Error {
+	return s.ConfirmTOTPContext(context.Background(), code)
+}
+
+// ConfirmTOTPContext is ConfirmTOTP bound to the context ctx.
+func (s *Service) ConfirmTOTPContext(ctx context.Context, code string) dutil.Error {
+	ctx = withOperation(ctx, "confirm_totp")
+	u := s.endpoint("/mfa/totp/confirm", nil)
+
+	payload, e := dutil.MarshalReader(TOTPCodePayload{Code: code})
+	if e != nil {
+		return e
+	}
+	return s.statusExchange(ctx, "POST", u.String(), payload)
+}
+
+// DisableTOTP handles the exchange with the security microservice to
+// remove the TOTP authenticator of the logged-in user, which is proven with
+// a code of the authenticator.
+func (s *Service) DisableTOTP(code string) dutil.Error {
+	return s.DisableTOTPContext(context.Background(), code)
+}
+
+// DisableTOTPContext is DisableTOTP bound to the context ctx.
+func (s *Service) DisableTOTPContext(ctx context.Context, code string) dutil.Error {
+	ctx = withOperation(ctx, "disable_totp")
+	u := s.endpoint("/mfa/totp/disable", nil)
+
+	payload, e := dutil.MarshalReader(TOTPCodePayload{Code: code})
+	if e != nil {
+		return e
+	}
+	return s.statusExchange(ctx, "POST", u.String(), payload)
+}
+
+// VerifyRecoveryCode handles the exchange with the security microservice
+// to complete the login of the challenge, see MFARequiredError, with a
+// recovery code instead of the code of the second factor. Each recovery
+// code can only be used once.
+func (s *Service) VerifyRecoveryCode(challenge string, recoveryCode string) (LoginResult, dutil.Error) {
+	return s.VerifyRecoveryCodeContext(context.Background(), challenge, recoveryCode)
+}
+
+// VerifyRecoveryCodeContext is VerifyRecoveryCode bound to the context ctx.
+func (s *Service) VerifyRecoveryCodeContext(ctx context.Context, challenge string, recoveryCode string) (LoginResult, dutil.Error) {
+	ctx = withOperation(ctx, "verify_recovery_code")
+	u := s.endpoint("/login/mfa/recovery", nil)
+
+	payload, e := dutil.MarshalReader(RecoveryCodePayload{Challenge: challenge, RecoveryCode: recoveryCode})
+	if e != nil {
+		return LoginResult{}, e
+	}
+	return s.loginExchange(ctx, u.String(), payload)
+}
+
+// GenerateRecoveryCodes handles the exchange with the security
+// microservice to generate the recovery codes of the logged-in user, which
+// has a second factor. The codes are only returned by this exchange and by
+// RegenerateRecoveryCodes.
+func (s *Service) GenerateRecoveryCodes() ([]string, dutil.Error) {
+	return s.GenerateRecoveryCodesContext(context.Background())
+}
+
+// GenerateRecoveryCodesContext is GenerateRecoveryCodes bound to the
+// context ctx.
+func (s *Service) GenerateRecoveryCodesContext(ctx context.Context) ([]string, dutil.Error) {
+	ctx = withOperation(ctx, "generate_recovery_codes")
+	u := s.endpoint("/mfa/recovery-codes", nil)
+	return s.recoveryCodesExchange(ctx, u.String(), nil)
+}
+
+// RegenerateRecoveryCodes handles the exchange with the security
+// microservice to replace the recovery codes of the logged-in user with new
+// ones, which is proven with a code of the second factor. The previous
+// recovery codes can no longer be used.
+func (s *Service) RegenerateRecoveryCodes(code string) ([]string, dutil.Error) {
+	return s.RegenerateRecoveryCodesContext(context.Background(), code)
+}
+
+// RegenerateRecoveryCodesContext is RegenerateRecoveryCodes bound to the
+// context ctx.
+func (s *Service) RegenerateRecoveryCodesContext(ctx context.Context, code string) ([]string, dutil.Error) {
+	ctx = withOperation(ctx, "regenerate_recovery_codes")
+	u := s.endpoint("/mfa/recovery-codes/regenerate", nil)
+
+	payload, e := dutil.MarshalReader(RegenerateRecoveryCodesPayload{Code: code})
+	if e != nil {
+		return nil, e
+	}
+	return s.recoveryCodesExchange(ctx, u.String(), payload)
+}
+
+// RemainingRecoveryCodes handles the exchange with the security
+// microservice to get the number of unused recovery codes of the logged-in
+// user.
+func (s *Service) RemainingRecoveryCodes() (int, dutil.Error) {
+	return s.RemainingRecoveryCodesContext(context.Background())
+}
+
+// RemainingRecoveryCodesContext is RemainingRecoveryCodes bound to the
+// context ctx.
+func (s *Service) RemainingRecoveryCodesContext(ctx context.Context) (int, dutil.Error) {
+	ctx = withOperation(ctx, "remaining_recovery_codes")
+	u := s.endpoint("/mfa/recovery-codes", nil)
+
+	type data struct {
+		Remaining int `json:"remaining"`
+	}
+	resp := struct {
+		Message string              `json:"message"`
+		Data    data                `json:"data"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	res, e := s.NewRequestContext(ctx, "GET", u.String(), nil, nil)
+	if e != nil {
+		return 0, e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return 0, e
+	}
+
+	if res.StatusCode != 200 {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return 0, e
+	}
+
+	return resp.Data.Remaining, nil
+}
+
+// recoveryCodesExchange makes a POST exchange with the security
+// microservice of which the response data is a set of recovery codes.
+func (s *Service) recoveryCodesExchange(ctx context.Context, target string, payload io.Reader) ([]string, dutil.Error) {
+	type data struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	resp := struct {
+		Message string              `json:"message"`
+		Data    data                `json:"data"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	res, e := s.NewRequestContext(ctx, "POST", target, nil, payload)
+	if e != nil {
+		return nil, e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return nil, e
+	}
+
+	if res.StatusCode != 201 {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return nil, e
+	}
+
+	return resp.Data.RecoveryCodes, nil
+}
@@ -0,0 +1,353 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dottics/dutil"
+	"github.com/johannesscr/micro/microtest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestService_Login_mfaRequired(t *testing.T) {
+	s := NewService("")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	ms.Append(&microtest.Exchange{
+		Response: microtest.Response{
+			Status: 202,
+			Body:   `{"message":"second factor required","data":{"challenge":"some-challenge","methods":["totp"],"expires_at":"2022-05-01T12:05:00Z"},"errors":{}}`,
+		},
+	})
+
+	token, _, _, e := s.Login(strings.NewReader(`{"email":"tp@test.dottics.com","password":"correct-password"}`))
+	if token != "" {
+		t.Errorf("expected no token got '%v'", token)
+	}
+	if !errors.Is(e, ErrMFARequired) {
+		t.Fatalf("expected '%v' got '%v'", ErrMFARequired, e)
+	}
+	var mfa *MFARequiredError
+	if !errors.As(e, &mfa) {
+		t.Fatalf("expected a MFARequiredError got %T", e)
+	}
+	challenge := MFAChallenge{
+		Challenge: "some-challenge",
+		Methods:   []string{"totp"},
+		ExpiresAt: time.Date(2022, 5, 1, 12, 5, 0, 0, time.UTC),
+	}
+	if fmt.Sprint(mfa.Challenge) != fmt.Sprint(challenge) {
+		t.Errorf("expected '%v' got '%v'", challenge, mfa.Challenge)
+	}
+	if dutil.Inst(e).Status != 202 {
+		t.Errorf("expected status 202 got %d", dutil.Inst(e).Status)
+	}
+}
+
+func TestService_VerifyMFA(t *testing.T) {
+	tests := []struct {
+		name     string
+		exchange *microtest.Exchange
+		token    string
+		e        error
+	}{
+		{
+			name: "invalid code",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 400,
+					Body:   `{"message":"BadRequest","data":{},"errors":{"mfa_code":["invalid code"]}}`,
+				},
+			},
+			e: ErrMFACodeInvalid,
+		},
+		{
+			name: "expired challenge",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 400,
+					Body:   `{"message":"BadRequest","data":{},"errors":{"mfa_challenge":["expired"]}}`,
+				},
+			},
+			e: ErrMFAChallengeInvalid,
+		},
+		{
+			name: "login successful",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 200,
+					Header: map[string][]string{
+						"X-User-Token": {"some-long-jwt-encrypted-token"},
+					},
+					Body: `{"message":"login successful","data":{"user":{"active":true},"permission":["abcd"]},"errors":{}}`,
+				},
+			},
+			token: "some-long-jwt-encrypted-token",
+		},
+	}
+
+	s := NewService("")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			result, e := s.VerifyMFA("some-challenge", "123456")
+			if !errors.Is(e, tc.e) || (tc.e == nil && e != nil) {
+				t.Errorf("expected '%v' got '%v'", tc.e, e)
+			}
+			if result.Token != tc.token {
+				t.Errorf("expected '%v' got '%v'", tc.token, result.Token)
+			}
+			r := tc.exchange.Request
+			if r.Method != "POST" || r.URL.Path != "/login/mfa" {
+				t.Errorf("expected 'POST /login/mfa' got '%v %v'", r.Method, r.URL.Path)
+			}
+		})
+	}
+}
+
+func TestService_EnrollTOTP(t *testing.T) {
+	s := NewService("my-very-secure-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	ms.Append(&microtest.Exchange{
+		Response: microtest.Response{
+			Status: 200,
+			Body:   `{"message":"totp enrolment pending","data":{"secret":"JBSWY3DPEHPK3PXP","uri":"otpauth://totp/dottics:tp@test.dottics.com?secret=JBSWY3DPEHPK3PXP"},"errors":{}}`,
+		},
+	})
+
+	enrolment, e := s.EnrollTOTP()
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if enrolment.Secret != "JBSWY3DPEHPK3PXP" || !strings.HasPrefix(enrolment.URI, "otpauth://totp/") {
+		t.Errorf("unexpected enrolment %v", enrolment)
+	}
+}
+
+func TestService_totpCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		call     func(s *Service) dutil.Error
+		path     string
+		exchange *microtest.Exchange
+		e        dutil.Error
+	}{
+		{
+			name: "confirm invalid code",
+			call: func(s *Service) dutil.Error { return s.ConfirmTOTP("000000") },
+			path: "/mfa/totp/confirm",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 400,
+					Body:   `{"message":"BadRequest","data":{},"errors":{"mfa_code":["invalid code"]}}`,
+				},
+			},
+			e: &dutil.Err{
+				Status: 400,
+				Errors: map[string][]string{
+					"mfa_code": {"invalid code"},
+				},
+			},
+		},
+		{
+			name: "confirm",
+			call: func(s *Service) dutil.Error { return s.ConfirmTOTP("123456") },
+			path: "/mfa/totp/confirm",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{Status: 200, Body: `{"message":"totp enabled","data":{},"errors":{}}`},
+			},
+		},
+		{
+			name: "disable",
+			call: func(s *Service) dutil.Error { return s.DisableTOTP("123456") },
+			path: "/mfa/totp/disable",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{Status: 200, Body: `{"message":"totp disabled","data":{},"errors":{}}`},
+			},
+		},
+	}
+
+	s := NewService("my-very-secure-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			e := tc.call(s)
+			if !dutil.ErrorEqual(e, tc.e) {
+				t.Errorf("expected error %v got %v", tc.e, e)
+			}
+			r := tc.exchange.Request
+			if r.Method != "POST" || r.URL.Path != tc.path {
+				t.Errorf("expected 'POST %v' got '%v %v'", tc.path, r.Method, r.URL.Path)
+			}
+		})
+	}
+}
+
+func TestService_VerifyRecoveryCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		exchange *microtest.Exchange
+		token    string
+		e        error
+	}{
+		{
+			name: "used code",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 400,
+					Body:   `{"message":"BadRequest","data":{},"errors":{"recovery_code":["code already used"]}}`,
+				},
+			},
+			e: ErrRecoveryCodeUsed,
+		},
+		{
+			name: "invalid code",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 400,
+					Body:   `{"message":"BadRequest","data":{},"errors":{"recovery_code":["invalid code"]}}`,
+				},
+			},
+			e: ErrRecoveryCodeInvalid,
+		},
+		{
+			name: "login successful",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 200,
+					Header: map[string][]string{
+						"X-User-Token": {"some-long-jwt-encrypted-token"},
+					},
+					Body: `{"message":"login successful","data":{"user":{"active":true},"permission":["abcd"]},"errors":{}}`,
+				},
+			},
+			token: "some-long-jwt-encrypted-token",
+		},
+	}
+
+	s := NewService("")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			result, e := s.VerifyRecoveryCode("some-challenge", "abcde-12345")
+			if !errors.Is(e, tc.e) || (tc.e == nil && e != nil) {
+				t.Errorf("expected '%v' got '%v'", tc.e, e)
+			}
+			if result.Token != tc.token {
+				t.Errorf("expected '%v' got '%v'", tc.token, result.Token)
+			}
+			r := tc.exchange.Request
+			if r.Method != "POST" || r.URL.Path != "/login/mfa/recovery" {
+				t.Errorf("expected 'POST /login/mfa/recovery' got '%v %v'", r.Method, r.URL.Path)
+			}
+		})
+	}
+}
+
+func TestService_recoveryCodes(t *testing.T) {
+	body := `{"message":"recovery codes generated","data":{"recovery_codes":["abcde-12345","fghij-67890"]},"errors":{}}`
+
+	tests := []struct {
+		name     string
+		call     func(s *Service) ([]string, dutil.Error)
+		path     string
+		exchange *microtest.Exchange
+		codes    string
+		e        dutil.Error
+	}{
+		{
+			name: "generate without second factor",
+			call: func(s *Service) ([]string, dutil.Error) { return s.GenerateRecoveryCodes() },
+			path: "/mfa/recovery-codes",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 400,
+					Body:   `{"message":"BadRequest","data":{},"errors":{"mfa":["totp not enabled"]}}`,
+				},
+			},
+			e: &dutil.Err{
+				Status: 400,
+				Errors: map[string][]string{
+					"mfa": {"totp not enabled"},
+				},
+			},
+		},
+		{
+			name:     "generate",
+			call:     func(s *Service) ([]string, dutil.Error) { return s.GenerateRecoveryCodes() },
+			path:     "/mfa/recovery-codes",
+			exchange: &microtest.Exchange{Response: microtest.Response{Status: 201, Body: body}},
+			codes:    "abcde-12345,fghij-67890",
+		},
+		{
+			name:     "regenerate",
+			call:     func(s *Service) ([]string, dutil.Error) { return s.RegenerateRecoveryCodes("123456") },
+			path:     "/mfa/recovery-codes/regenerate",
+			exchange: &microtest.Exchange{Response: microtest.Response{Status: 201, Body: body}},
+			codes:    "abcde-12345,fghij-67890",
+		},
+	}
+
+	s := NewService("my-very-secure-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			xc, e := tc.call(s)
+			if !dutil.ErrorEqual(e, tc.e) {
+				t.Errorf("expected error %v got %v", tc.e, e)
+			}
+			if strings.Join(xc, ",") != tc.codes {
+				t.Errorf("expected '%v' got '%v'", tc.codes, strings.Join(xc, ","))
+			}
+			r := tc.exchange.Request
+			if r.Method != "POST" || r.URL.Path != tc.path {
+				t.Errorf("expected 'POST %v' got '%v %v'", tc.path, r.Method, r.URL.Path)
+			}
+		})
+	}
+}
+
+func TestService_RemainingRecoveryCodes(t *testing.T) {
+	s := NewService("my-very-secure-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	ms.Append(&microtest.Exchange{
+		Response: microtest.Response{
+			Status: 200,
+			Body:   `{"message":"recovery codes","data":{"remaining":7},"errors":{}}`,
+		},
+	})
+
+	n, e := s.RemainingRecoveryCodes()
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if n != 7 {
+		t.Errorf("expected 7 got %d", n)
+	}
+}
@@ -0,0 +1,172 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"github.com/dottics/dutil"
+	"net/http"
+	"strings"
+)
+
+// TokenValidator validates a user token and returns what is known about the
+// token. *Service is a TokenValidator that asks the security microservice.
+type TokenValidator interface {
+	ValidateTokenContext(ctx context.Context, token string) (TokenInfo, dutil.Error)
+}
+
+// TokenValidatorFunc is an adapter to use an ordinary function as a
+// TokenValidator.
+type TokenValidatorFunc func(ctx context.Context, token string) (TokenInfo, dutil.Error)
+
+// ValidateTokenContext calls f(ctx, token).
+func (f TokenValidatorFunc) ValidateTokenContext(ctx context.Context, token string) (TokenInfo, dutil.Error) {
+	return f(ctx, token)
+}
+
+// MiddlewareConfig configures the authentication Middleware.
+type MiddlewareConfig struct {
+	// Validator validates the token of every incoming request, usually it
+	// is a *Service shared by all requests, or a ValidationCache or
+	// Verifier in front of it.
+	Validator TokenValidator
+	// AllowInactive lets requests of inactive users through, by default
+	// they are rejected as forbidden.
+	AllowInactive bool
+}
+
+// Middleware authenticates every incoming request with the user token
+// taken from the X-User-Token header, or else from a Bearer Authorization
+// header. If the token is valid the TokenInfo of the token is added to the
+// request context, see TokenInfoFromContext, UserFromContext and
+// PermissionCodesFromContext. Otherwise, the request is rejected with a
+// 401 or 403 response in the same shape as the security microservice
+// responses, or with a 5xx response keyed "security_service" if the token
+// could not be validated. The request ID and trace context of the request are
+// propagated to the security microservice, see PropagationContext.
+func Middleware(cfg MiddlewareConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := RequestToken(r)
+			if token == "" {
+				e := dutil.NewErr(401, "auth", []string{"Auth token required", "Please login"})
+				respondErr(w, r, e)
+				return
+			}
+
+			ctx := PropagationContext(r)
+			info, e := cfg.Validator.ValidateTokenContext(ctx, token)
+			if e != nil {
+				err := dutil.Inst(e)
+				switch {
+				case rejected(e):
+					err = &dutil.Err{Status: 401, Errors: err.Errors}
+				case err.Status == 403:
+				default:
+					// the token could not be validated, such as when the
+					// security service is unavailable or rate limited, which
+					// says nothing about the token. The details, such as the
+					// URL of a failed exchange, are not for the client.
+					status := err.Status
+					if status < 500 {
+						status = 503
+					}
+					err = dutil.NewErr(status, "security_service", []string{"Unable to validate the token"})
+				}
+				respondErr(w, r, err)
+				return
+			}
+			if !info.User.Active && !cfg.AllowInactive {
+				e := dutil.NewErr(403, "auth", []string{"User is inactive"})
+				respondErr(w, r, e)
+				return
+			}
+
+			ctx = ContextWithTokenInfo(ctx, info)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// rejected reports whether the error e of a validation means the token was
+// not accepted, rather than that it could not be validated.
+func rejected(e dutil.Error) bool {
+	switch dutil.Inst(e).Status {
+	case 400, 401:
+		return true
+	}
+	return errors.Is(e, ErrUnauthorised) || errors.Is(e, ErrTokenExpired) || errors.Is(e, ErrInvalidCredentials)
+}
+
+// RequestToken returns the user token of the incoming request r. The
+// X-User-Token header takes precedence over a Bearer Authorization header.
+// If r has no token an empty string is returned.
+func RequestToken(r *http.Request) string {
+	if token := r.Header.Get("X-User-Token"); token != "" {
+		return token
+	}
+	auth := r.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		return strings.TrimSpace(auth[len(prefix):])
+	}
+	return ""
+}
+
+// contextKey is the type of the keys of the values this package adds to a
+// context, to prevent collisions with keys of other packages.
+type contextKey int
+
+const (
+	tokenInfoKey contextKey = iota
+	idempotencyKeyKey
+	probeKey
+	noRefreshKey
+	attemptKey
+	operationKey
+	traceContextKey
+	requestIDKey
+)
+
+// ContextWithTokenInfo returns a copy of ctx that carries the TokenInfo of
+// an authenticated request.
+func ContextWithTokenInfo(ctx context.Context, info TokenInfo) context.Context {
+	return context.WithValue(ctx, tokenInfoKey, info)
+}
+
+// TokenInfoFromContext returns the TokenInfo carried by ctx and whether
+// ctx carries one.
+func TokenInfoFromContext(ctx context.Context) (TokenInfo, bool) {
+	info, ok := ctx.Value(tokenInfoKey).(TokenInfo)
+	return info, ok
+}
+
+// UserFromContext returns the authenticated User carried by ctx and whether
+// ctx carries one.
+func UserFromContext(ctx context.Context) (User, bool) {
+	info, ok := TokenInfoFromContext(ctx)
+	return info.User, ok
+}
+
+// PermissionCodesFromContext returns the permission codes of the
+// authenticated user carried by ctx and whether ctx carries them.
+func PermissionCodesFromContext(ctx context.Context) (PermissionCodes, bool) {
+	info, ok := TokenInfoFromContext(ctx)
+	return info.PermissionCodes, ok
+}
+
+// respondErr writes the error e to the client in the same response
+// structure as the security microservice uses.
+func respondErr(w http.ResponseWriter, r *http.Request, e dutil.Error) {
+	err := dutil.Inst(e)
+	message := http.StatusText(err.Status)
+	if err.Status == 401 {
+		message = "Unauthorised"
+	}
+	resp := &dutil.Resp{
+		Status:  err.Status,
+		Message: strings.ReplaceAll(message, " ", "") + ": unable to process request",
+		Data:    struct{}{},
+		Errors:  err.Errors,
+	}
+	resp.Respond(w, r)
+}
@@ -0,0 +1,212 @@
+package security
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dottics/dutil"
+	"github.com/google/uuid"
+	"github.com/johannesscr/micro/microtest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	u := User{
+		UUID:      uuid.MustParse("9b615709-cc9a-48c3-b1ea-a04d4375ea86"),
+		FirstName: "james",
+		LastName:  "bond",
+		Active:    true,
+	}
+	validator := TokenValidatorFunc(func(ctx context.Context, token string) (TokenInfo, dutil.Error) {
+		switch token {
+		case "valid-token":
+			return TokenInfo{User: u, PermissionCodes: PermissionCodes{"abcd"}}, nil
+		case "inactive-token":
+			inactive := u
+			inactive.Active = false
+			return TokenInfo{User: inactive}, nil
+		case "server-error":
+			return TokenInfo{}, dutil.NewErr(500, "internal_server_error", []string{"some internal error"})
+		case "unreachable":
+			err := &url.Error{Op: "Get", URL: "http://127.0.0.1:1/token/validate", Err: errors.New("connection refused")}
+			return TokenInfo{}, newTransportError(500, "request", err)
+		case "rate-limited":
+			return TokenInfo{}, newStatusError(429, map[string][]string{"rate": {"slow down"}})
+		case "not-found":
+			return TokenInfo{}, newStatusError(404, map[string][]string{"not_found": {"Not found"}})
+		case "expired-token":
+			return TokenInfo{}, newStatusError(401, map[string][]string{"auth": {"Token expired", "Please login"}})
+		}
+		return TokenInfo{}, dutil.NewErr(400, "auth", []string{"Invalid token"})
+	})
+
+	tests := []struct {
+		name    string
+		headers map[string][]string
+		status  int
+		errors  dutil.Errors
+	}{
+		{
+			name:    "no token",
+			headers: map[string][]string{},
+			status:  401,
+			errors:  dutil.Errors{"auth": {"Auth token required", "Please login"}},
+		},
+		{
+			name:    "invalid token",
+			headers: map[string][]string{"X-User-Token": {"invalid-token"}},
+			status:  401,
+			errors:  dutil.Errors{"auth": {"Invalid token"}},
+		},
+		{
+			name:    "inactive user",
+			headers: map[string][]string{"X-User-Token": {"inactive-token"}},
+			status:  403,
+			errors:  dutil.Errors{"auth": {"User is inactive"}},
+		},
+		{
+			name:    "security service error",
+			headers: map[string][]string{"X-User-Token": {"server-error"}},
+			status:  500,
+			errors:  dutil.Errors{"security_service": {"Unable to validate the token"}},
+		},
+		{
+			name:    "security service unreachable",
+			headers: map[string][]string{"X-User-Token": {"unreachable"}},
+			status:  500,
+			errors:  dutil.Errors{"security_service": {"Unable to validate the token"}},
+		},
+		{
+			name:    "expired token",
+			headers: map[string][]string{"X-User-Token": {"expired-token"}},
+			status:  401,
+			errors:  dutil.Errors{"auth": {"Token expired", "Please login"}},
+		},
+		{
+			name:    "security service rate limited",
+			headers: map[string][]string{"X-User-Token": {"rate-limited"}},
+			status:  503,
+			errors:  dutil.Errors{"security_service": {"Unable to validate the token"}},
+		},
+		{
+			name:    "validation route not found",
+			headers: map[string][]string{"X-User-Token": {"not-found"}},
+			status:  503,
+			errors:  dutil.Errors{"security_service": {"Unable to validate the token"}},
+		},
+		{
+			name:    "valid user token",
+			headers: map[string][]string{"X-User-Token": {"valid-token"}},
+			status:  200,
+		},
+		{
+			name:    "valid bearer token",
+			headers: map[string][]string{"Authorization": {"Bearer valid-token"}},
+			status:  200,
+		},
+	}
+
+	mw := Middleware(MiddlewareConfig{Validator: validator})
+	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserFromContext(r.Context())
+		if !ok || user != u {
+			t.Errorf("expected user %v got %v", u, user)
+		}
+		xp, ok := PermissionCodesFromContext(r.Context())
+		if !ok || len(xp) != 1 || xp[0] != "abcd" {
+			t.Errorf("expected permission codes %v got %v", PermissionCodes{"abcd"}, xp)
+		}
+		w.WriteHeader(200)
+	}))
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			r := microtest.NewRequest("GET", "/users", nil, tc.headers, nil)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			res, xb := microtest.ReadRecorder(rec)
+			if res.StatusCode != tc.status {
+				t.Errorf("expected status %d got %d", tc.status, res.StatusCode)
+			}
+			if tc.errors == nil {
+				return
+			}
+			resp := dutil.Resp{}
+			err := json.Unmarshal(xb, &resp)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			e := &dutil.Err{Status: tc.status, Errors: resp.Errors}
+			if !dutil.ErrorEqual(e, &dutil.Err{Status: tc.status, Errors: tc.errors}) {
+				t.Errorf("expected errors %v got %v", tc.errors, resp.Errors)
+			}
+		})
+	}
+}
+
+// TestMiddleware_service tests that the middleware validates the token of
+// the incoming request with the security service.
+func TestMiddleware_service(t *testing.T) {
+	s := NewService("")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	ex := &microtest.Exchange{
+		Response: microtest.Response{
+			Status: 200,
+			Body:   `{"message":"token valid","data":{"user":{"uuid":"9b615709-cc9a-48c3-b1ea-a04d4375ea86","active":true},"permission":["abcd"],"session_id":"3f0a3e1c"},"errors":{}}`,
+		},
+	}
+	ms.Append(ex)
+
+	called := false
+	handler := Middleware(MiddlewareConfig{Validator: s})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		info, ok := TokenInfoFromContext(r.Context())
+		if !ok {
+			t.Errorf("expected token info in the context")
+		}
+		if info.SessionID != "3f0a3e1c" {
+			t.Errorf("expected '%v' got '%v'", "3f0a3e1c", info.SessionID)
+		}
+	}))
+
+	r := microtest.NewRequest("GET", "/users", nil, map[string][]string{"Authorization": {"bearer user-token"}}, nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if !called {
+		t.Errorf("expected the next handler to be called")
+	}
+	if ex.Request.Header.Get("X-User-Token") != "user-token" {
+		t.Errorf("expected '%v' got '%v'", "user-token", ex.Request.Header.Get("X-User-Token"))
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	tests := []struct {
+		headers map[string][]string
+		token   string
+	}{
+		{headers: map[string][]string{}, token: ""},
+		{headers: map[string][]string{"Authorization": {"Basic dXNlcjpwYXNz"}}, token: ""},
+		{headers: map[string][]string{"Authorization": {"Bearer "}}, token: ""},
+		{headers: map[string][]string{"Authorization": {"BEARER abc"}}, token: "abc"},
+		{headers: map[string][]string{"X-User-Token": {"xyz"}, "Authorization": {"Bearer abc"}}, token: "xyz"},
+	}
+
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			r := microtest.NewRequest("GET", "/", nil, tc.headers, nil)
+			token := RequestToken(r)
+			if token != tc.token {
+				t.Errorf("expected '%v' got '%v'", tc.token, token)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package security
+
+import (
+	"net/http"
+	"os"
+	"time"
+)
+
+// options collects the configuration given to NewServiceWithOptions before
+// the Service is built from it.
+type options struct {
+	scheme    string
+	host      string
+	header    http.Header
+	client    *http.Client
+	transport http.RoundTripper
+	timeout   time.Duration
+	retry     RetryPolicy
+	breaker   *CircuitBreaker
+	refresher *refresher
+	onRevoke  func(Revocation)
+	logger    Logger
+	metrics   Metrics
+	tracer    Tracer
+}
+
+// Option configures a Service created with NewServiceWithOptions.
+type Option func(*options)
+
+// WithEnv reads the scheme and host of the security service from the
+// SECURITY_SERVICE_SCHEME and SECURITY_SERVICE_HOST environmental variables.
+func WithEnv() Option {
+	return func(o *options) {
+		o.scheme = os.Getenv("SECURITY_SERVICE_SCHEME")
+		o.host = os.Getenv("SECURITY_SERVICE_HOST")
+	}
+}
+
+// WithBaseURL sets the scheme and host of the security service, it is the
+// option equivalent of SetURL.
+func WithBaseURL(scheme string, host string) Option {
+	return func(o *options) {
+		o.scheme = scheme
+		o.host = host
+	}
+}
+
+// WithToken sets the user token sent as the X-User-Token header with every
+// exchange.
+func WithToken(token string) Option {
+	return WithHeader("X-User-Token", token)
+}
+
+// WithAPIKey sets the API key sent as the X-API-Key header with every
+// exchange, to authenticate with the API key instead of a user token. The
+// X-User-Token header set before, such as by NewService, is removed.
+func WithAPIKey(key string) Option {
+	return func(o *options) {
+		o.header.Del("X-User-Token")
+		o.header.Set("X-API-Key", key)
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent with every exchange.
+func WithUserAgent(userAgent string) Option {
+	return WithHeader("User-Agent", userAgent)
+}
+
+// WithHeader sets an additional default header sent with every exchange.
+// Headers set by an exchange itself take precedence.
+func WithHeader(key string, value string) Option {
+	return func(o *options) {
+		o.header.Set(key, value)
+	}
+}
+
+// WithHTTPClient sets the client used to make the exchanges. The client is
+// copied, so WithTransport and WithTimeout do not modify the client given.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.client = c
+	}
+}
+
+// WithTransport sets the http.RoundTripper of the client used to make the
+// exchanges, such as a transport with a custom TLS config or proxy, or a
+// stub transport in tests.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(o *options) {
+		o.transport = rt
+	}
+}
+
+// WithTimeout sets the default time limit for an exchange, including
+// connecting, any redirects and reading the response body. A zero timeout
+// means no timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// httpClient builds the client for the Service from the options.
+func (o *options) httpClient() *http.Client {
+	c := &http.Client{}
+	if o.client != nil {
+		*c = *o.client
+	}
+	if o.transport != nil {
+		c.Transport = o.transport
+	}
+	if o.timeout != 0 {
+		c.Timeout = o.timeout
+	}
+	return c
+}
@@ -0,0 +1,142 @@
+package security
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripperFunc is a stub http.RoundTripper for tests that should not
+// reach the network.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestNewServiceWithOptions(t *testing.T) {
+	var req *http.Request
+	rt := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		req = r
+		return &http.Response{
+			StatusCode: 200,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader(`{}`)),
+		}, nil
+	})
+
+	s := NewServiceWithOptions(
+		WithBaseURL("https", "security.dottics.com"),
+		WithToken("my secret token"),
+		WithUserAgent("gateway/1.0"),
+		WithHeader("X-Tenant", "dottics"),
+		WithTransport(rt),
+		WithTimeout(5*time.Second),
+	)
+
+	if s.URL.Scheme != "https" {
+		t.Errorf("expected '%v' got '%v'", "https", s.URL.Scheme)
+	}
+	if s.URL.Host != "security.dottics.com" {
+		t.Errorf("expected '%v' got '%v'", "security.dottics.com", s.URL.Host)
+	}
+	if s.client.Timeout != 5*time.Second {
+		t.Errorf("expected '%v' got '%v'", 5*time.Second, s.client.Timeout)
+	}
+
+	_, e := s.NewRequest("GET", s.URL.String(), nil, nil)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if req == nil {
+		t.Fatalf("expected the request to use the transport")
+	}
+	headers := map[string]string{
+		"Content-Type": "application/json",
+		"X-User-Token": "my secret token",
+		"User-Agent":   "gateway/1.0",
+		"X-Tenant":     "dottics",
+	}
+	for key, value := range headers {
+		if req.Header.Get(key) != value {
+			t.Errorf("expected %s '%v' got '%v'", key, value, req.Header.Get(key))
+		}
+	}
+}
+
+func TestWithAPIKey(t *testing.T) {
+	var req *http.Request
+	rt := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		req = r
+		return &http.Response{
+			StatusCode: 200,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader(`{}`)),
+		}, nil
+	})
+
+	s := NewServiceWithOptions(
+		WithToken("my secret token"),
+		WithAPIKey("my-api-key"),
+		WithTransport(rt),
+	)
+	_, e := s.NewRequest("GET", s.URL.String(), nil, nil)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if req.Header.Get("X-API-Key") != "my-api-key" {
+		t.Errorf("expected '%v' got '%v'", "my-api-key", req.Header.Get("X-API-Key"))
+	}
+	if _, ok := req.Header["X-User-Token"]; ok {
+		t.Errorf("expected no user token got '%v'", req.Header.Get("X-User-Token"))
+	}
+}
+
+func TestNewServiceWithOptions_env(t *testing.T) {
+	err := os.Setenv("SECURITY_SERVICE_SCHEME", "https")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = os.Setenv("SECURITY_SERVICE_HOST", "env.dottics.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// without WithEnv the environment is ignored
+	s1 := NewServiceWithOptions()
+	if s1.URL.Host != "" {
+		t.Errorf("expected '%v' got '%v'", "", s1.URL.Host)
+	}
+	// a later option overrides the environment
+	s2 := NewServiceWithOptions(WithEnv(), WithBaseURL("http", "localhost:8080"))
+	if s2.URL.Host != "localhost:8080" {
+		t.Errorf("expected '%v' got '%v'", "localhost:8080", s2.URL.Host)
+	}
+	s3 := NewServiceWithOptions(WithEnv())
+	if s3.URL.Scheme != "https" {
+		t.Errorf("expected '%v' got '%v'", "https", s3.URL.Scheme)
+	}
+	if s3.URL.Host != "env.dottics.com" {
+		t.Errorf("expected '%v' got '%v'", "env.dottics.com", s3.URL.Host)
+	}
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	c := &http.Client{
+		Timeout: time.Second,
+	}
+	s := NewServiceWithOptions(WithHTTPClient(c), WithTimeout(time.Minute))
+
+	if s.client == c {
+		t.Errorf("expected the client to be copied")
+	}
+	if c.Timeout != time.Second {
+		t.Errorf("expected the given client to be unchanged got timeout %v", c.Timeout)
+	}
+	if s.client.Timeout != time.Minute {
+		t.Errorf("expected '%v' got '%v'", time.Minute, s.client.Timeout)
+	}
+}
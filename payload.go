@@ -1,5 +1,7 @@
 package security
 
+import "time"
+
 type LoginPayload struct {
 	Email    string
 	Password string
@@ -14,3 +16,82 @@ type ResetPasswordPayload struct {
 	PasswordResetToken string `json:"password_reset_token"`
 	Password           string `json:"password"`
 }
+
+type RefreshTokenPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type RegisterPayload struct {
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	Email         string `json:"email"`
+	ContactNumber string `json:"contact_number"`
+	Password      string `json:"password"`
+}
+
+type VerifyEmailPayload struct {
+	VerificationToken string `json:"verification_token"`
+}
+
+type ResendVerificationPayload struct {
+	Email string `json:"email"`
+}
+
+type ChangePasswordPayload struct {
+	CurrentPassword     string `json:"current_password"`
+	NewPassword         string `json:"new_password"`
+	RevokeOtherSessions bool   `json:"revoke_other_sessions"`
+}
+
+// UpdateUserPayload is a partial update of a user, only the fields that are
+// not nil are sent and changed. UserChanges creates the payload of the
+// fields that differ between two users.
+type UpdateUserPayload struct {
+	FirstName     *string `json:"first_name,omitempty"`
+	LastName      *string `json:"last_name,omitempty"`
+	ContactNumber *string `json:"contact_number,omitempty"`
+}
+
+type CreateRolePayload struct {
+	Name            string          `json:"name"`
+	Description     string          `json:"description"`
+	PermissionCodes PermissionCodes `json:"permission_codes"`
+}
+
+// UpdateRolePayload is a partial update of a role, only the fields that are
+// not nil are sent and changed.
+type UpdateRolePayload struct {
+	Name        *string `json:"name,omitempty"`
+	Description *string `json:"description,omitempty"`
+}
+
+type RolePermissionsPayload struct {
+	PermissionCodes PermissionCodes `json:"permission_codes"`
+}
+
+type VerifyMFAPayload struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+type TOTPCodePayload struct {
+	Code string `json:"code"`
+}
+
+type RegenerateRecoveryCodesPayload struct {
+	Code string `json:"code"`
+}
+
+type RecoveryCodePayload struct {
+	Challenge    string `json:"challenge"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// CreateAPIKeyPayload creates an API key with the permission codes, which
+// must be permission codes of the user. A nil ExpiresAt is a key that does
+// not expire.
+type CreateAPIKeyPayload struct {
+	Name            string          `json:"name"`
+	PermissionCodes PermissionCodes `json:"permission_codes"`
+	ExpiresAt       *time.Time      `json:"expires_at,omitempty"`
+}
@@ -0,0 +1,137 @@
+package security
+
+import (
+	"github.com/dottics/dutil"
+	"net/http"
+	"sort"
+)
+
+// Has reports whether the permission code is one of the permission codes.
+func (xp PermissionCodes) Has(code string) bool {
+	for _, c := range xp {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAll reports whether every one of the codes is one of the permission
+// codes. HasAll is true if no codes are given.
+func (xp PermissionCodes) HasAll(codes ...string) bool {
+	return xp.Set().HasAll(codes...)
+}
+
+// HasAny reports whether at least one of the codes is one of the permission
+// codes. HasAny is false if no codes are given.
+func (xp PermissionCodes) HasAny(codes ...string) bool {
+	return xp.Set().HasAny(codes...)
+}
+
+// Set returns the permission codes as a PermissionSet, for when many codes
+// need to be looked up.
+func (xp PermissionCodes) Set() PermissionSet {
+	return NewPermissionSet(xp...)
+}
+
+// PermissionSet is a set of permission codes with constant time lookups.
+type PermissionSet map[string]struct{}
+
+// NewPermissionSet creates a PermissionSet of the codes.
+func NewPermissionSet(codes ...string) PermissionSet {
+	ps := make(PermissionSet, len(codes))
+	for _, c := range codes {
+		ps[c] = struct{}{}
+	}
+	return ps
+}
+
+// Has reports whether the permission code is in the set.
+func (ps PermissionSet) Has(code string) bool {
+	_, ok := ps[code]
+	return ok
+}
+
+// HasAll reports whether every one of the codes is in the set. HasAll is
+// true if no codes are given.
+func (ps PermissionSet) HasAll(codes ...string) bool {
+	return len(ps.Missing(codes...)) == 0
+}
+
+// HasAny reports whether at least one of the codes is in the set. HasAny is
+// false if no codes are given.
+func (ps PermissionSet) HasAny(codes ...string) bool {
+	for _, c := range codes {
+		if ps.Has(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Missing returns the codes that are not in the set, in the order given.
+func (ps PermissionSet) Missing(codes ...string) []string {
+	var xs []string
+	for _, c := range codes {
+		if !ps.Has(c) {
+			xs = append(xs, c)
+		}
+	}
+	return xs
+}
+
+// Codes returns the permission codes in the set sorted in ascending order.
+func (ps PermissionSet) Codes() PermissionCodes {
+	xp := make(PermissionCodes, 0, len(ps))
+	for c := range ps {
+		xp = append(xp, c)
+	}
+	sort.Strings(xp)
+	return xp
+}
+
+// RequirePermissions only lets a request through if the authenticated user
+// has every one of the permission codes. It must be used after Middleware,
+// which adds the permission codes of the user to the request context. A
+// request without an authenticated user is rejected with 401 and a request
+// of a user missing permission codes is rejected with 403 listing the codes
+// that are missing.
+func RequirePermissions(codes ...string) func(http.Handler) http.Handler {
+	return requirePermissions(func(ps PermissionSet) []string {
+		return ps.Missing(codes...)
+	})
+}
+
+// RequireAnyPermission only lets a request through if the authenticated
+// user has at least one of the permission codes. Requests are rejected in
+// the same way as RequirePermissions.
+func RequireAnyPermission(codes ...string) func(http.Handler) http.Handler {
+	return requirePermissions(func(ps PermissionSet) []string {
+		if ps.HasAny(codes...) {
+			return nil
+		}
+		return codes
+	})
+}
+
+// requirePermissions is the middleware shared by RequirePermissions and
+// RequireAnyPermission, missing returns the permission codes the request is
+// missing given the permission codes of the user.
+func requirePermissions(missing func(PermissionSet) []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			xp, ok := PermissionCodesFromContext(r.Context())
+			if !ok {
+				e := dutil.NewErr(401, "auth", []string{"Auth token required", "Please login"})
+				respondErr(w, r, e)
+				return
+			}
+			if xs := missing(xp.Set()); len(xs) > 0 {
+				e := dutil.NewErr(403, "permission", xs)
+				respondErr(w, r, e)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package security
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dottics/dutil"
+	"github.com/johannesscr/micro/microtest"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestPermissionCodes(t *testing.T) {
+	xp := PermissionCodes{"abcd", "1234", "ab34"}
+
+	tests := []struct {
+		name   string
+		codes  []string
+		has    bool
+		hasAll bool
+		hasAny bool
+	}{
+		{name: "none", codes: nil, has: false, hasAll: true, hasAny: false},
+		{name: "one present", codes: []string{"1234"}, has: true, hasAll: true, hasAny: true},
+		{name: "one absent", codes: []string{"zzzz"}, has: false, hasAll: false, hasAny: false},
+		{name: "all present", codes: []string{"abcd", "ab34"}, has: true, hasAll: true, hasAny: true},
+		{name: "some present", codes: []string{"abcd", "zzzz"}, has: true, hasAll: false, hasAny: true},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			if len(tc.codes) > 0 {
+				if b := xp.Has(tc.codes[0]); b != tc.has {
+					t.Errorf("Has: expected %v got %v", tc.has, b)
+				}
+				if b := xp.Set().Has(tc.codes[0]); b != tc.has {
+					t.Errorf("PermissionSet.Has: expected %v got %v", tc.has, b)
+				}
+			}
+			if b := xp.HasAll(tc.codes...); b != tc.hasAll {
+				t.Errorf("HasAll: expected %v got %v", tc.hasAll, b)
+			}
+			if b := xp.HasAny(tc.codes...); b != tc.hasAny {
+				t.Errorf("HasAny: expected %v got %v", tc.hasAny, b)
+			}
+		})
+	}
+}
+
+func TestPermissionSet_Codes(t *testing.T) {
+	ps := NewPermissionSet("abcd", "1234", "abcd")
+	xp := ps.Codes()
+	if !reflect.DeepEqual(xp, PermissionCodes{"1234", "abcd"}) {
+		t.Errorf("expected %v got %v", PermissionCodes{"1234", "abcd"}, xp)
+	}
+	missing := ps.Missing("zzzz", "abcd", "yyyy")
+	if !reflect.DeepEqual(missing, []string{"zzzz", "yyyy"}) {
+		t.Errorf("expected %v got %v", []string{"zzzz", "yyyy"}, missing)
+	}
+}
+
+func TestRequirePermissions(t *testing.T) {
+	tests := []struct {
+		name       string
+		middleware func(http.Handler) http.Handler
+		info       *TokenInfo
+		status     int
+		errors     dutil.Errors
+	}{
+		{
+			name:       "not authenticated",
+			middleware: RequirePermissions("abcd"),
+			info:       nil,
+			status:     401,
+			errors:     dutil.Errors{"auth": {"Auth token required", "Please login"}},
+		},
+		{
+			name:       "missing permissions",
+			middleware: RequirePermissions("abcd", "1234", "ab34"),
+			info:       &TokenInfo{PermissionCodes: PermissionCodes{"1234"}},
+			status:     403,
+			errors:     dutil.Errors{"permission": {"abcd", "ab34"}},
+		},
+		{
+			name:       "all permissions",
+			middleware: RequirePermissions("abcd", "1234"),
+			info:       &TokenInfo{PermissionCodes: PermissionCodes{"1234", "abcd"}},
+			status:     200,
+		},
+		{
+			name:       "none of any permissions",
+			middleware: RequireAnyPermission("abcd", "ab34"),
+			info:       &TokenInfo{PermissionCodes: PermissionCodes{"1234"}},
+			status:     403,
+			errors:     dutil.Errors{"permission": {"abcd", "ab34"}},
+		},
+		{
+			name:       "one of any permissions",
+			middleware: RequireAnyPermission("abcd", "1234"),
+			info:       &TokenInfo{PermissionCodes: PermissionCodes{"1234"}},
+			status:     200,
+		},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			handler := tc.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(200)
+			}))
+
+			r := microtest.NewRequest("GET", "/users", nil, map[string][]string{}, nil)
+			if tc.info != nil {
+				r = r.WithContext(ContextWithTokenInfo(context.Background(), *tc.info))
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			res, xb := microtest.ReadRecorder(rec)
+			if res.StatusCode != tc.status {
+				t.Errorf("expected status %d got %d", tc.status, res.StatusCode)
+			}
+			if tc.errors == nil {
+				return
+			}
+			resp := dutil.Resp{}
+			err := json.Unmarshal(xb, &resp)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(resp.Errors, tc.errors) {
+				t.Errorf("expected errors %v got %v", tc.errors, resp.Errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package security
+
+import (
+	"context"
+	"github.com/dottics/dutil"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// WithAutoRefresh makes the Service renew its user token with the refresh
+// token when the security service responds 401 to an exchange, after which
+// the exchange is made once more with the new user token. onRefresh, which
+// may be nil, is called with every new TokenPair so that the caller can
+// persist it; it is called while other refreshes wait, so it must not make
+// exchanges with the Service itself.
+//
+// Exchanges that send their own user token, such as ValidateToken, are not
+// refreshed.
+func WithAutoRefresh(refreshToken string, onRefresh func(TokenPair)) Option {
+	return func(o *options) {
+		o.refresher = &refresher{
+			refreshToken: refreshToken,
+			onRefresh:    onRefresh,
+		}
+	}
+}
+
+// refresher holds the refresh token of a Service with auto-refresh.
+type refresher struct {
+	// mu guards refreshToken and serialises refreshes
+	mu           sync.Mutex
+	refreshToken string
+	onRefresh    func(TokenPair)
+}
+
+// SetToken sets the user token sent as the X-User-Token header with every
+// exchange.
+func (s *Service) SetToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Header == nil {
+		s.Header = make(http.Header)
+	}
+	s.Header.Set("X-User-Token", token)
+}
+
+// Token returns the user token of the Service.
+func (s *Service) Token() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Header.Get("X-User-Token")
+}
+
+// refreshable reports whether an exchange made with ctx and the headers is
+// refreshed when it is unauthorised.
+func (s *Service) refreshable(ctx context.Context, headers map[string][]string) bool {
+	if s.refresher == nil {
+		return false
+	}
+	if noRefresh, _ := ctx.Value(noRefreshKey).(bool); noRefresh {
+		return false
+	}
+	for key := range headers {
+		if http.CanonicalHeaderKey(key) == "X-User-Token" {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutRefresh returns a copy of ctx with which an exchange is not
+// refreshed.
+func withoutRefresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRefreshKey, true)
+}
+
+// sendRefreshing makes the exchange and, if it is unauthorised, refreshes
+// the user token and makes the exchange once more.
+func (s *Service) sendRefreshing(ctx context.Context, method string, target string, headers map[string][]string, payload io.Reader) (*http.Response, dutil.Error) {
+	body, e := replayable(payload)
+	if e != nil {
+		return nil, e
+	}
+	stale := s.Token()
+	res, e := s.send(ctx, method, target, headers, body())
+	if e != nil || res.StatusCode != 401 {
+		return res, e
+	}
+	if !s.refresh(ctx, stale) {
+		return res, nil
+	}
+	discard(res)
+	return s.send(ctx, method, target, headers, body())
+}
+
+// refresh renews the user token that was rejected as stale and reports
+// whether the Service has a new user token. If another exchange already
+// renewed the stale token it is not renewed again.
+func (s *Service) refresh(ctx context.Context, stale string) bool {
+	r := s.refresher
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s.Token() != stale {
+		return true
+	}
+
+	pair, e := s.RefreshTokenContext(ctx, r.refreshToken)
+	if e != nil || pair.Token == "" {
+		return false
+	}
+	s.SetToken(pair.Token)
+	if pair.RefreshToken != "" {
+		r.refreshToken = pair.RefreshToken
+	}
+	if r.onRefresh != nil {
+		r.onRefresh(pair)
+	}
+	return true
+}
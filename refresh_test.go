@@ -0,0 +1,137 @@
+package security
+
+import (
+	"encoding/json"
+	"github.com/johannesscr/micro/microtest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestService_autoRefresh(t *testing.T) {
+	var pairs []TokenPair
+	s := NewServiceWithOptions(
+		WithToken("expired-token"),
+		WithAutoRefresh("refresh-token", func(pair TokenPair) {
+			pairs = append(pairs, pair)
+		}),
+	)
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	exchanges := []*microtest.Exchange{
+		{
+			Response: microtest.Response{
+				Status: 401,
+				Body:   `{"message":"Unauthorised","data":{},"errors":{"auth":["Token expired"]}}`,
+			},
+		},
+		{
+			Response: microtest.Response{
+				Status: 200,
+				Header: map[string][]string{"X-User-Token": {"new-user-token"}},
+				Body:   `{"message":"token refresh successful","data":{"refresh_token":"new-refresh-token"},"errors":{}}`,
+			},
+		},
+		{
+			Response: microtest.Response{
+				Status: 200,
+				Body:   `{"message":"password reset successful","data":null,"errors":null}`,
+			},
+		},
+	}
+	for _, ex := range exchanges {
+		ms.Append(ex)
+	}
+
+	e := s.ResetPassword(ResetPasswordPayload{Email: "tp@test.dottics.com", Password: "password"})
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+
+	if exchanges[0].Request.Header.Get("X-User-Token") != "expired-token" {
+		t.Errorf("expected '%v' got '%v'", "expired-token", exchanges[0].Request.Header.Get("X-User-Token"))
+	}
+	if exchanges[1].Request.URL.Path != "/token/refresh" {
+		t.Errorf("expected '%v' got '%v'", "/token/refresh", exchanges[1].Request.URL.Path)
+	}
+	if exchanges[2].Request.Header.Get("X-User-Token") != "new-user-token" {
+		t.Errorf("expected '%v' got '%v'", "new-user-token", exchanges[2].Request.Header.Get("X-User-Token"))
+	}
+	if s.Token() != "new-user-token" {
+		t.Errorf("expected '%v' got '%v'", "new-user-token", s.Token())
+	}
+	if len(pairs) != 1 || pairs[0].RefreshToken != "new-refresh-token" {
+		t.Errorf("expected the new token pair to be passed to the callback got %v", pairs)
+	}
+	if s.refresher.refreshToken != "new-refresh-token" {
+		t.Errorf("expected '%v' got '%v'", "new-refresh-token", s.refresher.refreshToken)
+	}
+}
+
+// TestService_autoRefresh_concurrent tests that concurrent exchanges
+// rejected with the same stale token refresh it only once.
+func TestService_autoRefresh_concurrent(t *testing.T) {
+	var refreshes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token/refresh" {
+			atomic.AddInt32(&refreshes, 1)
+			w.Header().Set("X-User-Token", "new-user-token")
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{}})
+			return
+		}
+		if r.Header.Get("X-User-Token") != "new-user-token" {
+			w.WriteHeader(401)
+		}
+		_, _ = w.Write([]byte(`{"message":"","data":{},"errors":{}}`))
+	}))
+	defer server.Close()
+
+	s := NewServiceWithOptions(
+		WithBaseURL("http", strings.TrimPrefix(server.URL, "http://")),
+		WithToken("expired-token"),
+		WithAutoRefresh("refresh-token", nil),
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if e := s.Logout(); e != nil {
+				t.Errorf("unexpected error: %v", e)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&refreshes); n != 1 {
+		t.Errorf("expected %d refresh got %d", 1, n)
+	}
+}
+
+// TestService_autoRefresh_validateToken tests that an exchange with its
+// own user token is not refreshed.
+func TestService_autoRefresh_validateToken(t *testing.T) {
+	s := NewServiceWithOptions(WithAutoRefresh("refresh-token", nil))
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	ms.Append(&microtest.Exchange{
+		Response: microtest.Response{
+			Status: 401,
+			Body:   `{"message":"Unauthorised","data":{},"errors":{"auth":["Token expired"]}}`,
+		},
+	})
+
+	_, e := s.ValidateToken("expired-token")
+	if e == nil {
+		t.Fatalf("expected an error")
+	}
+	if len(ms.Exchanges) != 1 {
+		t.Errorf("expected %d exchange got %d", 1, len(ms.Exchanges))
+	}
+}
@@ -0,0 +1,128 @@
+package security
+
+import (
+	"context"
+	"github.com/dottics/dutil"
+)
+
+// Register handles the exchange with the security microservice to register
+// a new user. The created user is returned, which is inactive until the
+// user's email is verified with VerifyEmail.
+func (s *Service) Register(p RegisterPayload) (User, dutil.Error) {
+	return s.RegisterContext(context.Background(), p)
+}
+
+// RegisterContext is Register bound to the context ctx.
+func (s *Service) RegisterContext(ctx context.Context, p RegisterPayload) (User, dutil.Error) {
+	ctx = withOperation(ctx, "register")
+	u := s.endpoint("/register", nil)
+
+	type data struct {
+		User User `json:"user"`
+	}
+	resp := struct {
+		Message string              `json:"message"`
+		Data    data                `json:"data"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	payload, e := dutil.MarshalReader(p)
+	if e != nil {
+		return User{}, e
+	}
+
+	res, e := s.NewRequestContext(ctx, "POST", u.String(), nil, payload)
+	if e != nil {
+		return User{}, e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return User{}, e
+	}
+
+	if res.StatusCode != 201 {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return User{}, e
+	}
+
+	return resp.Data.User, nil
+}
+
+// VerifyEmail handles the exchange with the security microservice to
+// verify a user's email with the verification token sent to the user.
+func (s *Service) VerifyEmail(verificationToken string) dutil.Error {
+	return s.VerifyEmailContext(context.Background(), verificationToken)
+}
+
+// VerifyEmailContext is VerifyEmail bound to the context ctx.
+func (s *Service) VerifyEmailContext(ctx context.Context, verificationToken string) dutil.Error {
+	ctx = withOperation(ctx, "verify_email")
+	u := s.endpoint("/verify-email", nil)
+
+	resp := struct {
+		Message string              `json:"message"`
+		Data    interface{}         `json:"data"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	payload, e := dutil.MarshalReader(VerifyEmailPayload{VerificationToken: verificationToken})
+	if e != nil {
+		return e
+	}
+
+	res, e := s.NewRequestContext(ctx, "POST", u.String(), nil, payload)
+	if e != nil {
+		return e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return e
+	}
+
+	if res.StatusCode != 200 {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return e
+	}
+
+	return nil
+}
+
+// ResendVerification handles the exchange with the security microservice
+// to send a new verification token to the email of a user whose email is
+// not yet verified.
+func (s *Service) ResendVerification(email string) dutil.Error {
+	return s.ResendVerificationContext(context.Background(), email)
+}
+
+// ResendVerificationContext is ResendVerification bound to the context ctx.
+func (s *Service) ResendVerificationContext(ctx context.Context, email string) dutil.Error {
+	ctx = withOperation(ctx, "resend_verification")
+	u := s.endpoint("/verify-email/resend", nil)
+
+	resp := struct {
+		Message string              `json:"message"`
+		Data    interface{}         `json:"data"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	payload, e := dutil.MarshalReader(ResendVerificationPayload{Email: email})
+	if e != nil {
+		return e
+	}
+
+	res, e := s.NewRequestContext(ctx, "POST", u.String(), nil, payload)
+	if e != nil {
+		return e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return e
+	}
+
+	if res.StatusCode != 200 {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return e
+	}
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dottics/dutil"
+	"github.com/google/uuid"
+	"github.com/johannesscr/micro/microtest"
+	"testing"
+)
+
+func TestService_Register(t *testing.T) {
+	type E struct {
+		user User
+		e    dutil.Error
+	}
+	tests := []struct {
+		name     string
+		payload  RegisterPayload
+		exchange *microtest.Exchange
+		E        E
+	}{
+		{
+			name: "email taken",
+			payload: RegisterPayload{
+				Email:    "tp@test.dottics.com",
+				Password: "password",
+			},
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 409,
+					Body:   `{"message":"Conflict: unable to process request","data":{},"errors":{"email":["already registered"]}}`,
+				},
+			},
+			E: E{
+				user: User{},
+				e: &dutil.Err{
+					Status: 409,
+					Errors: map[string][]string{
+						"email": {"already registered"},
+					},
+				},
+			},
+		},
+		{
+			name: "registered",
+			payload: RegisterPayload{
+				FirstName: "james",
+				LastName:  "bond",
+				Email:     "jb@test.dottics.com",
+				Password:  "password",
+			},
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 201,
+					Body:   `{"message":"registration successful","data":{"user":{"uuid":"9b615709-cc9a-48c3-b1ea-a04d4375ea86","first_name":"james","last_name":"bond","email":"jb@test.dottics.com","active":false}},"errors":{}}`,
+				},
+			},
+			E: E{
+				user: User{
+					UUID:      uuid.MustParse("9b615709-cc9a-48c3-b1ea-a04d4375ea86"),
+					FirstName: "james",
+					LastName:  "bond",
+					Email:     "jb@test.dottics.com",
+				},
+				e: nil,
+			},
+		},
+	}
+
+	s := NewService("")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			u, e := s.Register(tc.payload)
+			if !dutil.ErrorEqual(e, tc.E.e) {
+				t.Errorf("expected error %v got %v", tc.E.e, e)
+			}
+			if u != tc.E.user {
+				t.Errorf("expected user %v got %v", tc.E.user, u)
+			}
+			if tc.exchange.Request.Method != "POST" || tc.exchange.Request.URL.Path != "/register" {
+				t.Errorf("expected '%v' got '%v %v'", "POST /register", tc.exchange.Request.Method, tc.exchange.Request.URL.Path)
+			}
+		})
+	}
+}
+
+func TestService_VerifyEmail(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		exchange *microtest.Exchange
+		e        dutil.Error
+		kind     error
+	}{
+		{
+			name:  "invalid verification token",
+			token: "f7c349f6-fbde-4241-871d-6a20827ef74e",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 400,
+					Body:   `{"message":"BadRequest","data":{},"errors":{"verification_token":["invalid or expired"]}}`,
+				},
+			},
+			e: &dutil.Err{
+				Status: 400,
+				Errors: map[string][]string{
+					"verification_token": {"invalid or expired"},
+				},
+			},
+			kind: ErrVerificationTokenInvalid,
+		},
+		{
+			name:  "email verified",
+			token: "f7c349f6-fbde-4241-871d-6a20827ef74e",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 200,
+					Body:   `{"message":"email verified","data":{},"errors":{}}`,
+				},
+			},
+			e: nil,
+		},
+	}
+
+	s := NewService("")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			e := s.VerifyEmail(tc.token)
+			if !dutil.ErrorEqual(e, tc.e) {
+				t.Errorf("expected error %v got %v", tc.e, e)
+			}
+			if tc.kind != nil && !errors.Is(e, tc.kind) {
+				t.Errorf("expected '%v' got '%v'", tc.kind, e)
+			}
+			if tc.exchange.Request.URL.Path != "/verify-email" {
+				t.Errorf("expected '%v' got '%v'", "/verify-email", tc.exchange.Request.URL.Path)
+			}
+		})
+	}
+}
+
+func TestService_ResendVerification(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		exchange *microtest.Exchange
+		e        dutil.Error
+	}{
+		{
+			name:  "user not found",
+			email: "i@dont.exist",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 404,
+					Body:   `{"message":"NotFound","data":{},"errors":{"user":["not found"]}}`,
+				},
+			},
+			e: &dutil.Err{
+				Status: 404,
+				Errors: map[string][]string{
+					"user": {"not found"},
+				},
+			},
+		},
+		{
+			name:  "verification resent",
+			email: "jb@test.dottics.com",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 200,
+					Body:   `{"message":"verification sent","data":{},"errors":{}}`,
+				},
+			},
+			e: nil,
+		},
+	}
+
+	s := NewService("")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			e := s.ResendVerification(tc.email)
+			if !dutil.ErrorEqual(e, tc.e) {
+				t.Errorf("expected error %v got %v", tc.e, e)
+			}
+			if tc.exchange.Request.URL.Path != "/verify-email/resend" {
+				t.Errorf("expected '%v' got '%v'", "/verify-email/resend", tc.exchange.Request.URL.Path)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package security
+
+import (
+	"bytes"
+	"context"
+	"github.com/dottics/dutil"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy determines whether and when a failed exchange is attempted
+// again. An exchange is retried when it could not be made, or when the
+// security service responded with one of the RetryableStatus statuses.
+//
+// Only idempotent exchanges (GET, HEAD, OPTIONS, PUT and DELETE) are
+// retried, a POST exchange is only retried if its context carries an
+// idempotency key, see WithIdempotencyKey.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of an exchange,
+	// including the first. One or less disables retries.
+	MaxAttempts int
+	// InitialBackoff is the time to wait before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the time to wait before a retry. A Retry-After
+	// response header asking for a longer wait stops the retries.
+	MaxBackoff time.Duration
+	// Multiplier is the factor the backoff grows by after every retry.
+	Multiplier float64
+	// Jitter is the fraction, between 0 and 1, of the backoff that is
+	// randomised to spread out retries of concurrent exchanges.
+	Jitter float64
+	// RetryableStatus are the response statuses that are retried.
+	RetryableStatus []int
+}
+
+// DefaultRetryPolicy is the RetryPolicy of a Service created with
+// NewService or NewServiceWithOptions.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:     3,
+		InitialBackoff:  100 * time.Millisecond,
+		MaxBackoff:      2 * time.Second,
+		Multiplier:      2,
+		Jitter:          0.2,
+		RetryableStatus: []int{429, 502, 503, 504},
+	}
+}
+
+// WithRetryPolicy sets the RetryPolicy of the Service. Use a policy with
+// MaxAttempts of 1 to disable retries.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(o *options) {
+		o.retry = p
+	}
+}
+
+// WithIdempotencyKey returns a copy of ctx that carries the idempotency
+// key. An exchange made with the context sends the key as the
+// Idempotency-Key header, and a POST exchange is retried as the security
+// service will not apply it twice.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey, key)
+}
+
+// idempotencyKey returns the idempotency key carried by ctx, if any.
+func idempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyKey).(string)
+	return key
+}
+
+// attempts returns the maximum number of attempts of an exchange with the
+// method made with the context ctx.
+func (p RetryPolicy) attempts(ctx context.Context, method string) int {
+	if p.MaxAttempts <= 1 {
+		return 1
+	}
+	switch strings.ToUpper(method) {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return p.MaxAttempts
+	}
+	if idempotencyKey(ctx) != "" {
+		return p.MaxAttempts
+	}
+	return 1
+}
+
+// retryable reports whether the attempt that returned res and e should be
+// retried.
+func (p RetryPolicy) retryable(ctx context.Context, res *http.Response, e dutil.Error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if e != nil {
+		te, ok := e.(*TransportError)
+		return ok && te.Cause != ErrCircuitOpen
+	}
+	for _, status := range p.RetryableStatus {
+		if res.StatusCode == status {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the time to wait after the attempt, numbered from 1,
+// which responded with res. It returns false if the response asks for a
+// longer wait than MaxBackoff.
+func (p RetryPolicy) backoff(attempt int, res *http.Response) (time.Duration, bool) {
+	if res != nil {
+		if d, ok := retryAfter(res.Header.Get("Retry-After")); ok {
+			return d, d <= p.MaxBackoff
+		}
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	d := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d -= d * p.Jitter * rand.Float64()
+	}
+	return time.Duration(d), true
+}
+
+// retryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date.
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// sleep waits for the duration d or until ctx is done, whichever is first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// replayable reads the payload so that it can be sent with every attempt
+// of an exchange. The returned function returns a new reader of the
+// payload for every attempt.
+func replayable(payload io.Reader) (func() io.Reader, dutil.Error) {
+	if payload == nil {
+		return func() io.Reader { return nil }, nil
+	}
+	xb, err := io.ReadAll(payload)
+	if err != nil {
+		return nil, newTransportError(500, "request", err)
+	}
+	return func() io.Reader { return bytes.NewReader(xb) }, nil
+}
+
+// discard drains and closes the body of a response that is not returned to
+// the caller, so that its connection can be reused.
+func discard(res *http.Response) {
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+}
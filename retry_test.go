@@ -0,0 +1,229 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dottics/dutil"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// retryServer is a test server that responds with the statuses in order,
+// and records the requests it received.
+type retryServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	header   http.Header
+	requests []*http.Request
+	bodies   []string
+}
+
+func newRetryServer(statuses ...int) *retryServer {
+	rs := &retryServer{statuses: statuses, header: make(http.Header)}
+	rs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		xb, _ := ioutil.ReadAll(r.Body)
+		rs.mu.Lock()
+		n := len(rs.requests)
+		rs.requests = append(rs.requests, r)
+		rs.bodies = append(rs.bodies, string(xb))
+		rs.mu.Unlock()
+
+		status := 200
+		if n < len(rs.statuses) {
+			status = rs.statuses[n]
+		}
+		for key := range rs.header {
+			w.Header().Set(key, rs.header.Get(key))
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"message":"","data":{},"errors":{}}`))
+	}))
+	return rs
+}
+
+func (rs *retryServer) service() *Service {
+	s := NewServiceWithOptions(WithRetryPolicy(RetryPolicy{
+		MaxAttempts:     3,
+		InitialBackoff:  time.Millisecond,
+		MaxBackoff:      10 * time.Millisecond,
+		Multiplier:      2,
+		RetryableStatus: []int{429, 502, 503, 504},
+	}))
+	s.SetURL("http", strings.TrimPrefix(rs.URL, "http://"))
+	return s
+}
+
+func TestService_NewRequestContext_retry(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		call     func(s *Service) dutil.Error
+		attempts int
+		status   int
+	}{
+		{
+			name:     "idempotent exchange retried",
+			statuses: []int{503, 502},
+			call:     func(s *Service) dutil.Error { return s.Logout() },
+			attempts: 3,
+			status:   0,
+		},
+		{
+			name:     "attempts exhausted",
+			statuses: []int{503, 503, 503, 503},
+			call:     func(s *Service) dutil.Error { return s.Logout() },
+			attempts: 3,
+			status:   503,
+		},
+		{
+			name:     "status not retryable",
+			statuses: []int{500},
+			call:     func(s *Service) dutil.Error { return s.Logout() },
+			attempts: 1,
+			status:   500,
+		},
+		{
+			name:     "post not retried",
+			statuses: []int{503},
+			call: func(s *Service) dutil.Error {
+				return s.ResetPassword(ResetPasswordPayload{Email: "tp@test.dottics.com"})
+			},
+			attempts: 1,
+			status:   503,
+		},
+		{
+			name:     "post with idempotency key retried",
+			statuses: []int{503},
+			call: func(s *Service) dutil.Error {
+				ctx := WithIdempotencyKey(context.Background(), "reset-1")
+				return s.ResetPasswordContext(ctx, ResetPasswordPayload{Email: "tp@test.dottics.com"})
+			},
+			attempts: 2,
+			status:   0,
+		},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			rs := newRetryServer(tc.statuses...)
+			defer rs.Close()
+
+			e := tc.call(rs.service())
+			if len(rs.requests) != tc.attempts {
+				t.Errorf("expected %d attempts got %d", tc.attempts, len(rs.requests))
+			}
+			status := 0
+			if e != nil {
+				status = dutil.Inst(e).Status
+			}
+			if status != tc.status {
+				t.Errorf("expected status %d got %d: %v", tc.status, status, e)
+			}
+			// every attempt sends the same payload
+			for _, body := range rs.bodies[1:] {
+				if body != rs.bodies[0] {
+					t.Errorf("expected body '%v' got '%v'", rs.bodies[0], body)
+				}
+			}
+		})
+	}
+}
+
+func TestService_NewRequestContext_idempotencyKey(t *testing.T) {
+	rs := newRetryServer(503)
+	defer rs.Close()
+
+	ctx := WithIdempotencyKey(context.Background(), "reset-1")
+	e := rs.service().ResetPasswordContext(ctx, ResetPasswordPayload{Email: "tp@test.dottics.com"})
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	for _, r := range rs.requests {
+		if r.Header.Get("Idempotency-Key") != "reset-1" {
+			t.Errorf("expected '%v' got '%v'", "reset-1", r.Header.Get("Idempotency-Key"))
+		}
+	}
+	if rs.bodies[0] == "" {
+		t.Errorf("expected the payload to be sent")
+	}
+}
+
+func TestService_NewRequestContext_retryAfter(t *testing.T) {
+	// a Retry-After longer than the MaxBackoff is not waited for
+	rs := newRetryServer(503, 503)
+	rs.header.Set("Retry-After", "120")
+	defer rs.Close()
+
+	e := rs.service().Logout()
+	if len(rs.requests) != 1 {
+		t.Errorf("expected %d attempts got %d", 1, len(rs.requests))
+	}
+	if dutil.Inst(e).Status != 503 {
+		t.Errorf("expected status %d got %v", 503, e)
+	}
+
+	// a cancelled context stops the retries
+	rs = newRetryServer(503, 503)
+	defer rs.Close()
+	s := rs.service()
+	s.retry.InitialBackoff = time.Minute
+	s.retry.MaxBackoff = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	e = s.LogoutContext(ctx)
+	if !errors.Is(e, context.DeadlineExceeded) {
+		t.Errorf("expected '%v' got '%v'", context.DeadlineExceeded, e)
+	}
+	if len(rs.requests) != 1 {
+		t.Errorf("expected %d attempts got %d", 1, len(rs.requests))
+	}
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	p := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+		Jitter:         0.5,
+	}
+	tests := []struct {
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{attempt: 1, min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+		{attempt: 2, min: 100 * time.Millisecond, max: 200 * time.Millisecond},
+		{attempt: 3, min: 200 * time.Millisecond, max: 400 * time.Millisecond},
+		{attempt: 10, min: 500 * time.Millisecond, max: time.Second},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("attempt %d", tc.attempt), func(t *testing.T) {
+			d, ok := p.backoff(tc.attempt, nil)
+			if !ok {
+				t.Errorf("expected to retry")
+			}
+			if d < tc.min || d > tc.max {
+				t.Errorf("expected backoff between %v and %v got %v", tc.min, tc.max, d)
+			}
+		})
+	}
+
+	res := &http.Response{Header: http.Header{"Retry-After": {"1"}}}
+	d, ok := p.backoff(1, res)
+	if !ok || d != time.Second {
+		t.Errorf("expected %v got %v", time.Second, d)
+	}
+	res.Header.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	_, ok = p.backoff(1, res)
+	if ok {
+		t.Errorf("expected not to retry")
+	}
+}
@@ -0,0 +1,210 @@
+package security
+
+import (
+	"context"
+	"github.com/dottics/dutil"
+	"github.com/google/uuid"
+	"io"
+	"net/url"
+)
+
+// ListRoles handles the exchange with the security microservice to list
+// all roles with their permissions.
+func (s *Service) ListRoles() ([]Role, dutil.Error) {
+	return s.ListRolesContext(context.Background())
+}
+
+// ListRolesContext is ListRoles bound to the context ctx.
+func (s *Service) ListRolesContext(ctx context.Context) ([]Role, dutil.Error) {
+	ctx = withOperation(ctx, "list_roles")
+	u := s.endpoint("/roles", nil)
+	return s.rolesExchange(ctx, u.String())
+}
+
+// ListUserRoles handles the exchange with the security microservice to
+// list the roles assigned to the user with the UUID.
+func (s *Service) ListUserRoles(userUUID uuid.UUID) ([]Role, dutil.Error) {
+	return s.ListUserRolesContext(context.Background(), userUUID)
+}
+
+// ListUserRolesContext is ListUserRoles bound to the context ctx.
+func (s *Service) ListUserRolesContext(ctx context.Context, userUUID uuid.UUID) ([]Role, dutil.Error) {
+	ctx = withOperation(ctx, "list_user_roles")
+	u := s.endpoint("/users/"+userUUID.String()+"/roles", nil)
+	return s.rolesExchange(ctx, u.String())
+}
+
+// GetRole handles the exchange with the security microservice to get the
+// role with the UUID.
+func (s *Service) GetRole(roleUUID uuid.UUID) (Role, dutil.Error) {
+	return s.GetRoleContext(context.Background(), roleUUID)
+}
+
+// GetRoleContext is GetRole bound to the context ctx.
+func (s *Service) GetRoleContext(ctx context.Context, roleUUID uuid.UUID) (Role, dutil.Error) {
+	ctx = withOperation(ctx, "get_role")
+	u := s.endpoint("/roles/"+roleUUID.String(), nil)
+	return s.roleExchange(ctx, "GET", u.String(), nil, 200)
+}
+
+// CreateRole handles the exchange with the security microservice to create
+// a role with the permission codes. The created role is returned.
+func (s *Service) CreateRole(p CreateRolePayload) (Role, dutil.Error) {
+	return s.CreateRoleContext(context.Background(), p)
+}
+
+// CreateRoleContext is CreateRole bound to the context ctx.
+func (s *Service) CreateRoleContext(ctx context.Context, p CreateRolePayload) (Role, dutil.Error) {
+	ctx = withOperation(ctx, "create_role")
+	u := s.endpoint("/roles", nil)
+
+	payload, e := dutil.MarshalReader(p)
+	if e != nil {
+		return Role{}, e
+	}
+	return s.roleExchange(ctx, "POST", u.String(), payload, 201)
+}
+
+// UpdateRole handles the exchange with the security microservice to update
+// the fields of the role with the UUID that are set in the payload. The
+// updated role is returned.
+func (s *Service) UpdateRole(roleUUID uuid.UUID, p UpdateRolePayload) (Role, dutil.Error) {
+	return s.UpdateRoleContext(context.Background(), roleUUID, p)
+}
+
+// UpdateRoleContext is UpdateRole bound to the context ctx.
+func (s *Service) UpdateRoleContext(ctx context.Context, roleUUID uuid.UUID, p UpdateRolePayload) (Role, dutil.Error) {
+	ctx = withOperation(ctx, "update_role")
+	u := s.endpoint("/roles/"+roleUUID.String(), nil)
+
+	payload, e := dutil.MarshalReader(p)
+	if e != nil {
+		return Role{}, e
+	}
+	return s.roleExchange(ctx, "PATCH", u.String(), payload, 200)
+}
+
+// AttachPermissions handles the exchange with the security microservice to
+// add the permission codes to the role with the UUID. The updated role is
+// returned.
+func (s *Service) AttachPermissions(roleUUID uuid.UUID, codes ...string) (Role, dutil.Error) {
+	return s.AttachPermissionsContext(context.Background(), roleUUID, codes...)
+}
+
+// AttachPermissionsContext is AttachPermissions bound to the context ctx.
+func (s *Service) AttachPermissionsContext(ctx context.Context, roleUUID uuid.UUID, codes ...string) (Role, dutil.Error) {
+	ctx = withOperation(ctx, "attach_permissions")
+	u := s.endpoint("/roles/"+roleUUID.String()+"/permissions", nil)
+
+	payload, e := dutil.MarshalReader(RolePermissionsPayload{PermissionCodes: codes})
+	if e != nil {
+		return Role{}, e
+	}
+	return s.roleExchange(ctx, "POST", u.String(), payload, 200)
+}
+
+// DetachPermissions handles the exchange with the security microservice to
+// remove the permission codes from the role with the UUID. The updated role
+// is returned.
+func (s *Service) DetachPermissions(roleUUID uuid.UUID, codes ...string) (Role, dutil.Error) {
+	return s.DetachPermissionsContext(context.Background(), roleUUID, codes...)
+}
+
+// DetachPermissionsContext is DetachPermissions bound to the context ctx.
+func (s *Service) DetachPermissionsContext(ctx context.Context, roleUUID uuid.UUID, codes ...string) (Role, dutil.Error) {
+	ctx = withOperation(ctx, "detach_permissions")
+	qs := url.Values{}
+	for _, code := range codes {
+		qs.Add("permission_code", code)
+	}
+	u := s.endpoint("/roles/"+roleUUID.String()+"/permissions", qs)
+	return s.roleExchange(ctx, "DELETE", u.String(), nil, 200)
+}
+
+// AssignRole handles the exchange with the security microservice to assign
+// the role to the user, the user is then granted the permissions of the
+// role.
+func (s *Service) AssignRole(userUUID uuid.UUID, roleUUID uuid.UUID) dutil.Error {
+	return s.AssignRoleContext(context.Background(), userUUID, roleUUID)
+}
+
+// AssignRoleContext is AssignRole bound to the context ctx.
+func (s *Service) AssignRoleContext(ctx context.Context, userUUID uuid.UUID, roleUUID uuid.UUID) dutil.Error {
+	ctx = withOperation(ctx, "assign_role")
+	u := s.endpoint("/users/"+userUUID.String()+"/roles/"+roleUUID.String(), nil)
+
+	return s.statusExchange(ctx, "PUT", u.String(), nil)
+}
+
+// UnassignRole handles the exchange with the security microservice to
+// unassign the role from the user.
+func (s *Service) UnassignRole(userUUID uuid.UUID, roleUUID uuid.UUID) dutil.Error {
+	return s.UnassignRoleContext(context.Background(), userUUID, roleUUID)
+}
+
+// UnassignRoleContext is UnassignRole bound to the context ctx.
+func (s *Service) UnassignRoleContext(ctx context.Context, userUUID uuid.UUID, roleUUID uuid.UUID) dutil.Error {
+	ctx = withOperation(ctx, "unassign_role")
+	u := s.endpoint("/users/"+userUUID.String()+"/roles/"+roleUUID.String(), nil)
+
+	return s.statusExchange(ctx, "DELETE", u.String(), nil)
+}
+
+// roleExchange makes an exchange with the security microservice of which
+// the response data is a role, status is the status of a successful
+// response.
+func (s *Service) roleExchange(ctx context.Context, method string, target string, payload io.Reader, status int) (Role, dutil.Error) {
+	type data struct {
+		Role Role `json:"role"`
+	}
+	resp := struct {
+		Message string              `json:"message"`
+		Data    data                `json:"data"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	res, e := s.NewRequestContext(ctx, method, target, nil, payload)
+	if e != nil {
+		return Role{}, e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return Role{}, e
+	}
+
+	if res.StatusCode != status {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return Role{}, e
+	}
+
+	return resp.Data.Role, nil
+}
+
+// rolesExchange makes a GET exchange with the security microservice of
+// which the response data is a list of roles.
+func (s *Service) rolesExchange(ctx context.Context, target string) ([]Role, dutil.Error) {
+	type data struct {
+		Roles []Role `json:"roles"`
+	}
+	resp := struct {
+		Message string              `json:"message"`
+		Data    data                `json:"data"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	res, e := s.NewRequestContext(ctx, "GET", target, nil, nil)
+	if e != nil {
+		return nil, e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return nil, e
+	}
+
+	if res.StatusCode != 200 {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return nil, e
+	}
+
+	return resp.Data.Roles, nil
+}
@@ -0,0 +1,291 @@
+package security
+
+import (
+	"fmt"
+	"github.com/dottics/dutil"
+	"github.com/google/uuid"
+	"github.com/johannesscr/micro/microtest"
+	"reflect"
+	"testing"
+)
+
+func TestRole_PermissionCodes(t *testing.T) {
+	r := Role{Permissions: []Permission{{Code: "abc"}, {Code: "def"}}}
+	xp := r.PermissionCodes()
+	if !reflect.DeepEqual(xp, PermissionCodes{"abc", "def"}) {
+		t.Errorf("expected '%v' got '%v'", PermissionCodes{"abc", "def"}, xp)
+	}
+}
+
+func TestService_roleExchanges(t *testing.T) {
+	roleUUID := uuid.MustParse("3c5a8f84-6d5c-4a8b-9a0e-0e1f0f1b2c3d")
+	name := "admin"
+	body := `{"message":"successful","data":{"role":{"uuid":"3c5a8f84-6d5c-4a8b-9a0e-0e1f0f1b2c3d","name":"admin","description":"administrators","permissions":[{"code":"abc","description":"all of it"}]}},"errors":{}}`
+	role := Role{
+		UUID:        roleUUID,
+		Name:        "admin",
+		Description: "administrators",
+		Permissions: []Permission{{Code: "abc", Description: "all of it"}},
+	}
+
+	tests := []struct {
+		name     string
+		call     func(s *Service) (Role, dutil.Error)
+		method   string
+		path     string
+		query    string
+		exchange *microtest.Exchange
+		role     Role
+		e        dutil.Error
+	}{
+		{
+			name:   "get role not found",
+			call:   func(s *Service) (Role, dutil.Error) { return s.GetRole(roleUUID) },
+			method: "GET",
+			path:   "/roles/3c5a8f84-6d5c-4a8b-9a0e-0e1f0f1b2c3d",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 404,
+					Body:   `{"message":"NotFound","data":{},"errors":{"role":["not found"]}}`,
+				},
+			},
+			e: &dutil.Err{
+				Status: 404,
+				Errors: map[string][]string{
+					"role": {"not found"},
+				},
+			},
+		},
+		{
+			name:     "get role",
+			call:     func(s *Service) (Role, dutil.Error) { return s.GetRole(roleUUID) },
+			method:   "GET",
+			path:     "/roles/3c5a8f84-6d5c-4a8b-9a0e-0e1f0f1b2c3d",
+			exchange: &microtest.Exchange{Response: microtest.Response{Status: 200, Body: body}},
+			role:     role,
+		},
+		{
+			name: "create role conflict",
+			call: func(s *Service) (Role, dutil.Error) {
+				return s.CreateRole(CreateRolePayload{Name: "admin"})
+			},
+			method: "POST",
+			path:   "/roles",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 409,
+					Body:   `{"message":"Conflict","data":{},"errors":{"role":["name already exists"]}}`,
+				},
+			},
+			e: &dutil.Err{
+				Status: 409,
+				Errors: map[string][]string{
+					"role": {"name already exists"},
+				},
+			},
+		},
+		{
+			name: "create role",
+			call: func(s *Service) (Role, dutil.Error) {
+				return s.CreateRole(CreateRolePayload{Name: "admin", PermissionCodes: PermissionCodes{"abc"}})
+			},
+			method:   "POST",
+			path:     "/roles",
+			exchange: &microtest.Exchange{Response: microtest.Response{Status: 201, Body: body}},
+			role:     role,
+		},
+		{
+			name: "update role",
+			call: func(s *Service) (Role, dutil.Error) {
+				return s.UpdateRole(roleUUID, UpdateRolePayload{Name: &name})
+			},
+			method:   "PATCH",
+			path:     "/roles/3c5a8f84-6d5c-4a8b-9a0e-0e1f0f1b2c3d",
+			exchange: &microtest.Exchange{Response: microtest.Response{Status: 200, Body: body}},
+			role:     role,
+		},
+		{
+			name:     "attach permissions",
+			call:     func(s *Service) (Role, dutil.Error) { return s.AttachPermissions(roleUUID, "abc") },
+			method:   "POST",
+			path:     "/roles/3c5a8f84-6d5c-4a8b-9a0e-0e1f0f1b2c3d/permissions",
+			exchange: &microtest.Exchange{Response: microtest.Response{Status: 200, Body: body}},
+			role:     role,
+		},
+		{
+			name:     "detach permissions",
+			call:     func(s *Service) (Role, dutil.Error) { return s.DetachPermissions(roleUUID, "def", "ghi") },
+			method:   "DELETE",
+			path:     "/roles/3c5a8f84-6d5c-4a8b-9a0e-0e1f0f1b2c3d/permissions",
+			query:    "permission_code=def&permission_code=ghi",
+			exchange: &microtest.Exchange{Response: microtest.Response{Status: 200, Body: body}},
+			role:     role,
+		},
+	}
+
+	s := NewService("my-very-secure-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			r, e := tc.call(s)
+			if !dutil.ErrorEqual(e, tc.e) {
+				t.Errorf("expected error %v got %v", tc.e, e)
+			}
+			if !reflect.DeepEqual(r, tc.role) {
+				t.Errorf("expected role %v got %v", tc.role, r)
+			}
+			req := tc.exchange.Request
+			if req.Method != tc.method || req.URL.Path != tc.path {
+				t.Errorf("expected '%v %v' got '%v %v'", tc.method, tc.path, req.Method, req.URL.Path)
+			}
+			if req.URL.RawQuery != tc.query {
+				t.Errorf("expected query '%v' got '%v'", tc.query, req.URL.RawQuery)
+			}
+		})
+	}
+}
+
+func TestService_ListRoles(t *testing.T) {
+	userUUID := uuid.MustParse("9b615709-cc9a-48c3-b1ea-a04d4375ea86")
+	body := `{"message":"successful","data":{"roles":[{"uuid":"3c5a8f84-6d5c-4a8b-9a0e-0e1f0f1b2c3d","name":"admin","permissions":[]}]},"errors":{}}`
+
+	tests := []struct {
+		name     string
+		call     func(s *Service) ([]Role, dutil.Error)
+		path     string
+		exchange *microtest.Exchange
+		names    []string
+		e        dutil.Error
+	}{
+		{
+			name: "unauthorised",
+			call: func(s *Service) ([]Role, dutil.Error) { return s.ListRoles() },
+			path: "/roles",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 401,
+					Body:   `{"message":"Unauthorised","data":{},"errors":{"auth":["Please login"]}}`,
+				},
+			},
+			e: &dutil.Err{
+				Status: 401,
+				Errors: map[string][]string{
+					"auth": {"Please login"},
+				},
+			},
+		},
+		{
+			name:     "list roles",
+			call:     func(s *Service) ([]Role, dutil.Error) { return s.ListRoles() },
+			path:     "/roles",
+			exchange: &microtest.Exchange{Response: microtest.Response{Status: 200, Body: body}},
+			names:    []string{"admin"},
+		},
+		{
+			name:     "list user roles",
+			call:     func(s *Service) ([]Role, dutil.Error) { return s.ListUserRoles(userUUID) },
+			path:     "/users/9b615709-cc9a-48c3-b1ea-a04d4375ea86/roles",
+			exchange: &microtest.Exchange{Response: microtest.Response{Status: 200, Body: body}},
+			names:    []string{"admin"},
+		},
+	}
+
+	s := NewService("my-very-secure-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			xr, e := tc.call(s)
+			if !dutil.ErrorEqual(e, tc.e) {
+				t.Errorf("expected error %v got %v", tc.e, e)
+			}
+			var names []string
+			for _, r := range xr {
+				names = append(names, r.Name)
+			}
+			if !reflect.DeepEqual(names, tc.names) {
+				t.Errorf("expected '%v' got '%v'", tc.names, names)
+			}
+			if tc.exchange.Request.URL.Path != tc.path {
+				t.Errorf("expected '%v' got '%v'", tc.path, tc.exchange.Request.URL.Path)
+			}
+		})
+	}
+}
+
+func TestService_AssignRole(t *testing.T) {
+	userUUID := uuid.MustParse("9b615709-cc9a-48c3-b1ea-a04d4375ea86")
+	roleUUID := uuid.MustParse("3c5a8f84-6d5c-4a8b-9a0e-0e1f0f1b2c3d")
+	path := "/users/9b615709-cc9a-48c3-b1ea-a04d4375ea86/roles/3c5a8f84-6d5c-4a8b-9a0e-0e1f0f1b2c3d"
+
+	tests := []struct {
+		name     string
+		call     func(s *Service) dutil.Error
+		method   string
+		exchange *microtest.Exchange
+		e        dutil.Error
+	}{
+		{
+			name:   "assign role forbidden",
+			call:   func(s *Service) dutil.Error { return s.AssignRole(userUUID, roleUUID) },
+			method: "PUT",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 403,
+					Body:   `{"message":"Forbidden","data":{},"errors":{"permission":["missing permission"]}}`,
+				},
+			},
+			e: &dutil.Err{
+				Status: 403,
+				Errors: map[string][]string{
+					"permission": {"missing permission"},
+				},
+			},
+		},
+		{
+			name:   "assign role",
+			call:   func(s *Service) dutil.Error { return s.AssignRole(userUUID, roleUUID) },
+			method: "PUT",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{Status: 200, Body: `{"message":"role assigned","data":{},"errors":{}}`},
+			},
+		},
+		{
+			name:   "unassign role",
+			call:   func(s *Service) dutil.Error { return s.UnassignRole(userUUID, roleUUID) },
+			method: "DELETE",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{Status: 200, Body: `{"message":"role unassigned","data":{},"errors":{}}`},
+			},
+		},
+	}
+
+	s := NewService("my-very-secure-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			e := tc.call(s)
+			if !dutil.ErrorEqual(e, tc.e) {
+				t.Errorf("expected error %v got %v", tc.e, e)
+			}
+			r := tc.exchange.Request
+			if r.Method != tc.method || r.URL.Path != path {
+				t.Errorf("expected '%v %v' got '%v %v'", tc.method, path, r.Method, r.URL.Path)
+			}
+		})
+	}
+}
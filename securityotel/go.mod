@@ -0,0 +1,20 @@
+module github.com/dottics/securityserv/securityotel
+
+go 1.18
+
+require (
+	github.com/dottics/securityserv v0.0.0
+	go.opentelemetry.io/otel v1.11.1
+	go.opentelemetry.io/otel/sdk v1.11.1
+	go.opentelemetry.io/otel/trace v1.11.1
+)
+
+require (
+	github.com/dottics/dutil v0.0.0-20220415125612-58104a0d6c88 // indirect
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	golang.org/x/sys v0.0.0-20220919091848-fb04ddd9f9c8 // indirect
+)
+
+replace github.com/dottics/securityserv => ../
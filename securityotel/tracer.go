@@ -0,0 +1,120 @@
+// Package securityotel adapts OpenTelemetry to the security.Tracer of the
+// security service integration, so that every exchange with the security
+// microservice is a client span and its trace context is propagated.
+//
+// It is a separate module so that the security package does not depend on
+// OpenTelemetry:
+//
+//	s := security.NewServiceWithOptions(
+//		security.WithEnv(),
+//		security.WithTracer(securityotel.NewTracer(nil)),
+//	)
+package securityotel
+
+import (
+	"context"
+	"fmt"
+	security "github.com/dottics/securityserv"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+// instrumentationName is the name of the OpenTelemetry tracer.
+const instrumentationName = "github.com/dottics/securityserv"
+
+// Tracer is a security.Tracer backed by an OpenTelemetry tracer.
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewTracer creates a Tracer of which the spans are created by the
+// TracerProvider tp and propagated by the global TextMapPropagator. If tp
+// is nil the global TracerProvider is used.
+func NewTracer(tp trace.TracerProvider) *Tracer {
+	return NewTracerWithPropagator(tp, nil)
+}
+
+// NewTracerWithPropagator is NewTracer of which the spans are propagated by
+// p. If p is nil the global TextMapPropagator is used.
+func NewTracerWithPropagator(tp trace.TracerProvider, p propagation.TextMapPropagator) *Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	if p == nil {
+		p = otel.GetTextMapPropagator()
+	}
+	return &Tracer{
+		tracer:     tp.Tracer(instrumentationName),
+		propagator: p,
+	}
+}
+
+// Extract returns a copy of ctx that carries the remote span context of the
+// header, unless ctx already carries a span, such as the span of an
+// OpenTelemetry middleware which extracted it.
+func (t *Tracer) Extract(ctx context.Context, header http.Header) context.Context {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	return t.propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Start starts a client span as a child of the span carried by ctx.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, security.Span) {
+	ctx, span := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, otelSpan{span}
+}
+
+// Inject sets the headers of the propagator, such as traceparent and
+// tracestate, of the span carried by ctx on the header.
+func (t *Tracer) Inject(ctx context.Context, header http.Header) {
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// otelSpan is a security.Span backed by an OpenTelemetry span.
+type otelSpan struct {
+	span trace.Span
+}
+
+// SetAttributes sets the attributes on the span.
+func (s otelSpan) SetAttributes(attrs ...security.Attribute) {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		kvs = append(kvs, keyValue(attr))
+	}
+	s.span.SetAttributes(kvs...)
+}
+
+// RecordError records the error on the span and sets its status to error.
+func (s otelSpan) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// End ends the span.
+func (s otelSpan) End() {
+	s.span.End()
+}
+
+// keyValue converts the attribute to an OpenTelemetry attribute.
+func keyValue(attr security.Attribute) attribute.KeyValue {
+	switch v := attr.Value.(type) {
+	case string:
+		return attribute.String(attr.Key, v)
+	case int:
+		return attribute.Int(attr.Key, v)
+	case int64:
+		return attribute.Int64(attr.Key, v)
+	case bool:
+		return attribute.Bool(attr.Key, v)
+	case float64:
+		return attribute.Float64(attr.Key, v)
+	default:
+		return attribute.String(attr.Key, fmt.Sprint(v))
+	}
+}
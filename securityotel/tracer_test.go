@@ -0,0 +1,122 @@
+package securityotel
+
+import (
+	"context"
+	"errors"
+	security "github.com/dottics/securityserv"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTracer(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracer := NewTracerWithPropagator(tp, propagation.TraceContext{})
+
+	ctx, span := tracer.Start(context.Background(), "security-service login")
+	span.SetAttributes(
+		security.Attribute{Key: security.AttributeOperation, Value: "login"},
+		security.Attribute{Key: security.AttributeStatus, Value: 503},
+	)
+	header := make(http.Header)
+	tracer.Inject(ctx, header)
+	span.RecordError(errors.New("security service unavailable"))
+	span.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected '%v' got '%v'", 1, len(spans))
+	}
+	s := spans[0]
+	if s.Name != "security-service login" {
+		t.Errorf("expected '%v' got '%v'", "security-service login", s.Name)
+	}
+	if s.SpanKind != trace.SpanKindClient {
+		t.Errorf("expected '%v' got '%v'", trace.SpanKindClient, s.SpanKind)
+	}
+	if s.Status.Code != codes.Error {
+		t.Errorf("expected '%v' got '%v'", codes.Error, s.Status.Code)
+	}
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range s.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	if v := attrs[security.AttributeOperation].AsString(); v != "login" {
+		t.Errorf("expected '%v' got '%v'", "login", v)
+	}
+	if v := attrs[security.AttributeStatus].AsInt64(); v != 503 {
+		t.Errorf("expected '%v' got '%v'", 503, v)
+	}
+
+	sc := s.SpanContext
+	traceParent := "00-" + sc.TraceID().String() + "-" + sc.SpanID().String() + "-01"
+	if header.Get("traceparent") != traceParent {
+		t.Errorf("expected '%v' got '%v'", traceParent, header.Get("traceparent"))
+	}
+}
+
+// TestTracer_service tests that the span of an exchange continues the
+// trace of the traceparent of an incoming request.
+func TestTracer_service(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentID = "00f067aa0ba902b7"
+
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		_, _ = w.Write([]byte(`{"message":"","data":{},"errors":{}}`))
+	}))
+	defer server.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	s := security.NewServiceWithOptions(
+		security.WithBaseURL("http", strings.TrimPrefix(server.URL, "http://")),
+		security.WithLogger(security.NopLogger{}),
+		security.WithTracer(NewTracerWithPropagator(tp, propagation.TraceContext{})),
+	)
+
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	if e := s.LogoutContext(security.PropagationContext(r)); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected '%v' got '%v'", 1, len(spans))
+	}
+	sc := spans[0].SpanContext
+	if sc.TraceID().String() != traceID {
+		t.Errorf("expected '%v' got '%v'", traceID, sc.TraceID().String())
+	}
+	if spans[0].Parent.SpanID().String() != parentID {
+		t.Errorf("expected '%v' got '%v'", parentID, spans[0].Parent.SpanID().String())
+	}
+	traceParent := "00-" + traceID + "-" + sc.SpanID().String() + "-01"
+	if received.Get("traceparent") != traceParent {
+		t.Errorf("expected '%v' got '%v'", traceParent, received.Get("traceparent"))
+	}
+}
+
+func TestTracer_Extract_activeSpan(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	tracer := NewTracerWithPropagator(tp, propagation.TraceContext{})
+	ctx, span := tp.Tracer("test").Start(context.Background(), "server")
+	defer span.End()
+
+	header := make(http.Header)
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	xctx := tracer.Extract(ctx, header)
+	if got := trace.SpanContextFromContext(xctx); !got.Equal(span.SpanContext()) {
+		t.Errorf("expected '%v' got '%v'", span.SpanContext(), got)
+	}
+}
@@ -0,0 +1,1673 @@
+// Package securitytest provides a stateful in-memory fake of the security
+// microservice for integration tests of packages that use the security
+// package.
+//
+// A Server holds users, passwords, permission codes, sessions, refresh
+// tokens, password reset tokens, email verification tokens, roles, TOTP
+// second factors, recovery codes and API keys, and handles the exchanges
+// of the security package with the same semantics as the security
+// microservice:
+//
+//	srv := securitytest.NewServer()
+//	defer srv.Close()
+//	srv.AddUser(security.User{Email: "tp@test.dottics.com", Active: true}, "password", security.PermissionCodes{"abcd"})
+//
+//	s := security.NewService("")
+//	srv.Attach(s)
+//	token, user, xp, e := s.Login(strings.NewReader(`{"email":"tp@test.dottics.com","password":"password"}`))
+package securitytest
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"github.com/dottics/dutil"
+	security "github.com/dottics/securityserv"
+	"github.com/google/uuid"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSessionTTL is the time a session created by a login is valid for.
+const DefaultSessionTTL = 24 * time.Hour
+
+// MFAChallengeTTL is the time a login has to complete its second factor
+// challenge.
+const MFAChallengeTTL = 5 * time.Minute
+
+// RecoveryCodeCount is the number of recovery codes that are generated for
+// a user.
+const RecoveryCodeCount = 10
+
+// mock is the interface of any service that can be pointed to the Server,
+// such as *security.Service.
+type mock interface {
+	SetURL(scheme string, host string)
+}
+
+// MinPasswordLength is the password policy of the Server, new passwords
+// must have at least this many characters.
+const MinPasswordLength = 8
+
+// account is a user of the fake security service with its credentials.
+type account struct {
+	user            security.User
+	password        string
+	permissionCodes security.PermissionCodes
+	// roles are the UUIDs of the roles assigned to the user
+	roles []uuid.UUID
+	// totpSecret is the secret of the confirmed TOTP authenticator and
+	// totpPending that of an enrolment which is not confirmed yet
+	totpSecret  string
+	totpPending string
+	// recoveryCodes are the recovery codes of the user and whether they
+	// were used
+	recoveryCodes map[string]bool
+	// previous are the passwords the user had before
+	previous []string
+}
+
+// setPassword changes the password of the account, keeping the history of
+// passwords.
+func (a *account) setPassword(password string) {
+	a.previous = append(a.previous, a.password)
+	a.password = password
+}
+
+// used reports whether the password is or was a password of the account.
+func (a *account) used(password string) bool {
+	if password == a.password {
+		return true
+	}
+	for _, p := range a.previous {
+		if p == password {
+			return true
+		}
+	}
+	return false
+}
+
+// assigned reports whether the role is assigned to the account.
+func (a *account) assigned(roleUUID uuid.UUID) bool {
+	for _, id := range a.roles {
+		if id == roleUUID {
+			return true
+		}
+	}
+	return false
+}
+
+// challenge is a login waiting for its second factor.
+type challenge struct {
+	email     string
+	expiresAt time.Time
+}
+
+// apiKey is an API key of a user with its key.
+type apiKey struct {
+	security.APIKey
+	key   string
+	email string
+}
+
+// session is a logged-in session of a user.
+type session struct {
+	id    string
+	email string
+	// scope are the permission codes of the API key the request was
+	// authenticated with, nil for a user token
+	scope      security.PermissionCodes
+	device     string
+	ip         string
+	createdAt  time.Time
+	lastSeenAt time.Time
+	expiresAt  time.Time
+}
+
+// from records the device and IP address of the request r that created
+// the session.
+func (ss *session) from(r *http.Request) {
+	ss.device = r.UserAgent()
+	ss.ip = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ss.ip = host
+	}
+}
+
+// Server is a fake security microservice backed by an httptest.Server.
+// It is safe for concurrent use.
+type Server struct {
+	// Server is the underlying test server.
+	Server *httptest.Server
+	// SessionTTL is the time a new session is valid for, it defaults to
+	// DefaultSessionTTL.
+	SessionTTL time.Duration
+
+	mu            sync.Mutex
+	users         map[string]*account // by email
+	sessions      map[string]*session // by user token
+	refreshTokens map[string]string   // email by refresh token
+	resetTokens   map[string]string   // email by password reset token
+	verifyTokens  map[string]string   // email by verification token
+	roles         map[uuid.UUID]*security.Role
+	challenges    map[string]*challenge // by challenge
+	apiKeys       map[uuid.UUID]*apiKey
+}
+
+// NewServer starts and returns a new Server without any users. The caller
+// should call Close when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		SessionTTL:    DefaultSessionTTL,
+		users:         make(map[string]*account),
+		sessions:      make(map[string]*session),
+		refreshTokens: make(map[string]string),
+		resetTokens:   make(map[string]string),
+		verifyTokens:  make(map[string]string),
+		roles:         make(map[uuid.UUID]*security.Role),
+		challenges:    make(map[string]*challenge),
+		apiKeys:       make(map[uuid.UUID]*apiKey),
+	}
+	s.Server = httptest.NewServer(s.handler())
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.Server.Close()
+}
+
+// Attach points the service to the server through its SetURL method.
+func (s *Server) Attach(m mock) {
+	xs := strings.SplitN(s.Server.URL, "://", 2)
+	m.SetURL(xs[0], xs[1])
+}
+
+// Service creates a security.Service for the user token which is attached
+// to the server.
+func (s *Server) Service(token string) *security.Service {
+	svc := security.NewService(token)
+	s.Attach(svc)
+	return svc
+}
+
+// AddUser adds the user with the password and permission codes to the
+// server, replacing any user with the same email. If the user has no UUID a
+// new UUID is assigned. The user as stored is returned.
+func (s *Server) AddUser(u security.User, password string, xp security.PermissionCodes) security.User {
+	if u.UUID == uuid.Nil {
+		u.UUID = uuid.New()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[u.Email] = &account{
+		user:            u,
+		password:        password,
+		permissionCodes: xp,
+	}
+	return u
+}
+
+// AddRole adds the role to the server, replacing any role with the same
+// UUID. If the role has no UUID a new UUID is assigned. The role as stored
+// is returned.
+func (s *Server) AddRole(r security.Role) security.Role {
+	if r.UUID == uuid.Nil {
+		r.UUID = uuid.New()
+	}
+	r.Permissions = append([]security.Permission{}, r.Permissions...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roles[r.UUID] = &r
+	return r
+}
+
+// permissionCodes returns the permission codes of the account together
+// with the permission codes of its roles, the caller must hold s.mu.
+func (s *Server) permissionCodes(a *account) security.PermissionCodes {
+	xp := append(security.PermissionCodes{}, a.permissionCodes...)
+	for _, id := range a.roles {
+		if role, ok := s.roles[id]; ok {
+			for _, code := range role.PermissionCodes() {
+				if !xp.Has(code) {
+					xp = append(xp, code)
+				}
+			}
+		}
+	}
+	return xp
+}
+
+// User returns the user with the email and whether the user exists.
+func (s *Server) User(email string) (security.User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.users[email]
+	if !ok {
+		return security.User{}, false
+	}
+	return a.user, true
+}
+
+// VerificationToken returns the latest email verification token sent to
+// the email, in place of reading the email. If no token was sent an empty
+// string is returned.
+func (s *Server) VerificationToken(email string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.verificationToken(email)
+}
+
+// verificationToken returns the verification token of the email, the
+// caller must hold s.mu.
+func (s *Server) verificationToken(email string) string {
+	for token, e := range s.verifyTokens {
+		if e == email {
+			return token
+		}
+	}
+	return ""
+}
+
+// NewSession creates a session for the user with the email without a login
+// and returns the user token of the session. If there is no such user an
+// empty token is returned.
+func (s *Server) NewSession(email string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[email]; !ok {
+		return ""
+	}
+	return s.newSession(email)
+}
+
+// EnableTOTP enables a TOTP second factor for the user with the email, as
+// if the user enrolled and confirmed an authenticator, and returns its
+// secret to generate codes with TOTP. It returns an empty string if the
+// user does not exist.
+func (s *Server) EnableTOTP(email string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.users[email]
+	if !ok {
+		return ""
+	}
+	a.totpSecret = NewTOTPSecret()
+	return a.totpSecret
+}
+
+// Expire expires the session of the user token, as if its time to live
+// had passed.
+func (s *Server) Expire(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ss, ok := s.sessions[token]; ok {
+		ss.expiresAt = time.Now().Add(-time.Second)
+	}
+}
+
+// Sessions returns the number of sessions, expired or not, of the user with
+// the email.
+func (s *Server) Sessions(email string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, ss := range s.sessions {
+		if ss.email == email {
+			n++
+		}
+	}
+	return n
+}
+
+// newSession creates a session for the email and returns its token, the
+// caller must hold s.mu.
+func (s *Server) newSession(email string) string {
+	token := uuid.NewString()
+	now := time.Now()
+	s.sessions[token] = &session{
+		id:         uuid.NewString(),
+		email:      email,
+		createdAt:  now,
+		lastSeenAt: now,
+		expiresAt:  now.Add(s.SessionTTL),
+	}
+	return token
+}
+
+// authenticate returns the session and account of the user token of the
+// request r, the caller must hold s.mu. A request with an X-API-Key header
+// instead is authenticated with the API key, with a session scoped to the
+// permission codes of the key. If the token is missing, unknown or expired
+// the error to respond with is returned.
+func (s *Server) authenticate(r *http.Request) (*session, *account, dutil.Error) {
+	token := r.Header.Get("X-User-Token")
+	if key := r.Header.Get("X-API-Key"); token == "" && key != "" {
+		return s.authenticateKey(key)
+	}
+	if token == "" {
+		return nil, nil, dutil.NewErr(401, "auth", []string{"Auth token required", "Please login"})
+	}
+	ss, ok := s.sessions[token]
+	if !ok {
+		return nil, nil, dutil.NewErr(401, "auth", []string{"Invalid token", "Please login"})
+	}
+	if time.Now().After(ss.expiresAt) {
+		delete(s.sessions, token)
+		return nil, nil, dutil.NewErr(401, "auth", []string{"Token expired", "Please login"})
+	}
+	a, ok := s.users[ss.email]
+	if !ok {
+		delete(s.sessions, token)
+		return nil, nil, dutil.NewErr(401, "auth", []string{"Invalid token", "Please login"})
+	}
+	ss.lastSeenAt = time.Now()
+	return ss, a, nil
+}
+
+// authenticateKey returns a session and the account of the API key, the
+// caller must hold s.mu.
+func (s *Server) authenticateKey(key string) (*session, *account, dutil.Error) {
+	for _, k := range s.apiKeys {
+		if !hmac.Equal([]byte(k.key), []byte(key)) {
+			continue
+		}
+		now := time.Now()
+		if k.ExpiresAt != nil && now.After(*k.ExpiresAt) {
+			return nil, nil, dutil.NewErr(401, "auth", []string{"API key expired"})
+		}
+		a, ok := s.users[k.email]
+		if !ok {
+			break
+		}
+		k.LastUsedAt = &now
+		ss := &session{
+			id:         "api_key:" + k.UUID.String(),
+			email:      k.email,
+			scope:      k.PermissionCodes,
+			createdAt:  k.CreatedAt,
+			lastSeenAt: now,
+			expiresAt:  now.Add(s.SessionTTL),
+		}
+		if k.ExpiresAt != nil {
+			ss.expiresAt = *k.ExpiresAt
+		}
+		return ss, a, nil
+	}
+	return nil, nil, dutil.NewErr(401, "auth", []string{"Invalid API key"})
+}
+
+// handler routes the exchanges of the security package.
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", route("GET", s.home))
+	mux.HandleFunc("/login", route("POST", s.login))
+	mux.HandleFunc("/login/mfa", route("POST", s.verifyMFA))
+	mux.HandleFunc("/login/mfa/recovery", route("POST", s.verifyRecoveryCode))
+	mux.HandleFunc("/mfa/recovery-codes", s.recoveryCodes)
+	mux.HandleFunc("/mfa/recovery-codes/regenerate", route("POST", s.regenerateRecoveryCodes))
+	mux.HandleFunc("/mfa/totp/enroll", route("POST", s.enrollTOTP))
+	mux.HandleFunc("/mfa/totp/confirm", route("POST", s.confirmTOTP))
+	mux.HandleFunc("/mfa/totp/disable", route("POST", s.disableTOTP))
+	mux.HandleFunc("/logout", route("GET", s.logout))
+	mux.HandleFunc("/token/validate", route("GET", s.validateToken))
+	mux.HandleFunc("/token/refresh", route("POST", s.refreshToken))
+	mux.HandleFunc("/register", route("POST", s.register))
+	mux.HandleFunc("/verify-email", route("POST", s.verifyEmail))
+	mux.HandleFunc("/verify-email/resend", route("POST", s.resendVerification))
+	mux.HandleFunc("/users", route("GET", s.listUsers))
+	mux.HandleFunc("/users/", s.userResource)
+	mux.HandleFunc("/sessions/", route("DELETE", s.revokeSession))
+	mux.HandleFunc("/api-keys", s.apiKeyCollection)
+	mux.HandleFunc("/api-keys/", s.apiKeyResource)
+	mux.HandleFunc("/roles", s.roleCollection)
+	mux.HandleFunc("/roles/", s.roleResource)
+	mux.HandleFunc("/change-password", route("POST", s.changePassword))
+	mux.HandleFunc("/reset-password/token", route("POST", s.passwordResetToken))
+	mux.HandleFunc("/reset-password/reset", route("POST", s.resetPassword))
+	mux.HandleFunc("/revoke-password-reset-token", route("DELETE", s.revokePasswordResetToken))
+	return mux
+}
+
+// route only lets requests with the method through to the handler h.
+func route(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Method, method) {
+			respondErr(w, dutil.NewErr(405, "method", []string{"method not allowed"}))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// respond writes the response in the structure of the security
+// microservice.
+func respond(w http.ResponseWriter, status int, message string, data interface{}) {
+	resp := dutil.Resp{
+		Message: message,
+		Data:    data,
+		Errors:  dutil.Errors{},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// respondErr writes the error e in the structure of the security
+// microservice.
+func respondErr(w http.ResponseWriter, e dutil.Error) {
+	err := dutil.Inst(e)
+	resp := dutil.Resp{
+		Message: http.StatusText(err.Status) + ": unable to process request",
+		Data:    struct{}{},
+		Errors:  err.Errors,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// decode decodes the body of the request r to the value pointed to by v.
+func decode(r *http.Request, v interface{}) dutil.Error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		return dutil.NewErr(400, "decode", []string{"unable to decode data", err.Error()})
+	}
+	return nil
+}
+
+func (s *Server) home(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		respondErr(w, dutil.NewErr(404, "path", []string{"not found"}))
+		return
+	}
+	respond(w, 200, "security service", struct{}{})
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	p := struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.users[p.Email]
+	if !ok || a.password != p.Password {
+		respondErr(w, dutil.NewErr(400, "auth", []string{"Invalid email or password"}))
+		return
+	}
+	if !a.user.Active {
+		respondErr(w, dutil.NewErr(403, "auth", []string{"User is inactive"}))
+		return
+	}
+
+	if a.totpSecret != "" {
+		c := uuid.NewString()
+		s.challenges[c] = &challenge{
+			email:     p.Email,
+			expiresAt: time.Now().Add(MFAChallengeTTL),
+		}
+		respond(w, 202, "second factor required", map[string]interface{}{
+			"challenge":  c,
+			"methods":    []string{"totp"},
+			"expires_at": s.challenges[c].expiresAt,
+		})
+		return
+	}
+	s.loggedIn(w, r, a)
+}
+
+// loggedIn creates a session for the account and responds with the login,
+// the caller must hold s.mu.
+func (s *Server) loggedIn(w http.ResponseWriter, r *http.Request, a *account) {
+	email := a.user.Email
+	token := s.newSession(email)
+	s.sessions[token].from(r)
+	refreshToken := uuid.NewString()
+	s.refreshTokens[refreshToken] = email
+	w.Header().Set("X-User-Token", token)
+	respond(w, 200, "login successful", map[string]interface{}{
+		"user":          a.user,
+		"permission":    s.permissionCodes(a),
+		"refresh_token": refreshToken,
+		"expires_at":    s.sessions[token].expiresAt,
+	})
+}
+
+// challenged returns the account of the login of the challenge, the caller
+// must hold s.mu. If the challenge is unknown or expired the error to
+// respond with is returned.
+func (s *Server) challenged(challenge string) (*account, dutil.Error) {
+	c, ok := s.challenges[challenge]
+	if ok && time.Now().Before(c.expiresAt) {
+		if a, ok := s.users[c.email]; ok {
+			return a, nil
+		}
+	}
+	delete(s.challenges, challenge)
+	return nil, dutil.NewErr(400, "mfa_challenge", []string{"challenge invalid or expired", "Please login"})
+}
+
+func (s *Server) verifyMFA(w http.ResponseWriter, r *http.Request) {
+	p := security.VerifyMFAPayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, e := s.challenged(p.Challenge)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	if !validTOTP(a.totpSecret, p.Code, time.Now()) {
+		respondErr(w, dutil.NewErr(400, "mfa_code", []string{"invalid code"}))
+		return
+	}
+	delete(s.challenges, p.Challenge)
+	s.loggedIn(w, r, a)
+}
+
+func (s *Server) enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, a, e := s.authenticate(r)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	if a.totpSecret != "" {
+		respondErr(w, dutil.NewErr(409, "mfa", []string{"totp already enabled"}))
+		return
+	}
+	a.totpPending = NewTOTPSecret()
+	respond(w, 200, "totp enrolment pending", security.TOTPEnrollment{
+		Secret: a.totpPending,
+		URI:    "otpauth://totp/securitytest:" + url.PathEscape(a.user.Email) + "?secret=" + a.totpPending + "&issuer=securitytest",
+	})
+}
+
+func (s *Server) confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	p := security.TOTPCodePayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, a, e := s.authenticate(r)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	if a.totpPending == "" {
+		respondErr(w, dutil.NewErr(400, "mfa", []string{"no pending totp enrolment"}))
+		return
+	}
+	if !validTOTP(a.totpPending, p.Code, time.Now()) {
+		respondErr(w, dutil.NewErr(400, "mfa_code", []string{"invalid code"}))
+		return
+	}
+	a.totpSecret, a.totpPending = a.totpPending, ""
+	respond(w, 200, "totp enabled", struct{}{})
+}
+
+func (s *Server) disableTOTP(w http.ResponseWriter, r *http.Request) {
+	p := security.TOTPCodePayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, a, e := s.authenticate(r)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	if a.totpSecret == "" {
+		respondErr(w, dutil.NewErr(400, "mfa", []string{"totp not enabled"}))
+		return
+	}
+	if !validTOTP(a.totpSecret, p.Code, time.Now()) {
+		respondErr(w, dutil.NewErr(400, "mfa_code", []string{"invalid code"}))
+		return
+	}
+	a.totpSecret = ""
+	a.recoveryCodes = nil
+	respond(w, 200, "totp disabled", struct{}{})
+}
+
+func (s *Server) verifyRecoveryCode(w http.ResponseWriter, r *http.Request) {
+	p := security.RecoveryCodePayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, e := s.challenged(p.Challenge)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	used, ok := a.recoveryCodes[p.RecoveryCode]
+	if !ok {
+		respondErr(w, dutil.NewErr(400, "recovery_code", []string{"invalid code"}))
+		return
+	}
+	if used {
+		respondErr(w, dutil.NewErr(400, "recovery_code", []string{"code already used"}))
+		return
+	}
+	a.recoveryCodes[p.RecoveryCode] = true
+	delete(s.challenges, p.Challenge)
+	s.loggedIn(w, r, a)
+}
+
+// newRecoveryCodes replaces the recovery codes of the account with
+// RecoveryCodeCount new codes and returns them.
+func newRecoveryCodes(a *account) []string {
+	a.recoveryCodes = make(map[string]bool, RecoveryCodeCount)
+	xc := make([]string, 0, RecoveryCodeCount)
+	for len(xc) < RecoveryCodeCount {
+		id := strings.ReplaceAll(uuid.NewString(), "-", "")
+		code := id[:5] + "-" + id[5:10]
+		if _, ok := a.recoveryCodes[code]; !ok {
+			a.recoveryCodes[code] = false
+			xc = append(xc, code)
+		}
+	}
+	return xc
+}
+
+// recoveryCodes routes the exchanges on the /mfa/recovery-codes resource.
+func (s *Server) recoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if strings.EqualFold(r.Method, "POST") {
+		s.generateRecoveryCodes(w, r)
+		return
+	}
+	route("GET", s.remainingRecoveryCodes)(w, r)
+}
+
+func (s *Server) generateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, a, e := s.authenticate(r)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	if a.totpSecret == "" {
+		respondErr(w, dutil.NewErr(400, "mfa", []string{"totp not enabled"}))
+		return
+	}
+	if a.recoveryCodes != nil {
+		respondErr(w, dutil.NewErr(409, "recovery_codes", []string{"recovery codes already generated"}))
+		return
+	}
+	respond(w, 201, "recovery codes generated", map[string]interface{}{"recovery_codes": newRecoveryCodes(a)})
+}
+
+func (s *Server) regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	p := security.RegenerateRecoveryCodesPayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, a, e := s.authenticate(r)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	if a.totpSecret == "" {
+		respondErr(w, dutil.NewErr(400, "mfa", []string{"totp not enabled"}))
+		return
+	}
+	if !validTOTP(a.totpSecret, p.Code, time.Now()) {
+		respondErr(w, dutil.NewErr(400, "mfa_code", []string{"invalid code"}))
+		return
+	}
+	respond(w, 201, "recovery codes generated", map[string]interface{}{"recovery_codes": newRecoveryCodes(a)})
+}
+
+func (s *Server) remainingRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, a, e := s.authenticate(r)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	n := 0
+	for _, used := range a.recoveryCodes {
+		if !used {
+			n++
+		}
+	}
+	respond(w, 200, "recovery codes", map[string]interface{}{"remaining": n})
+}
+
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _, e := s.authenticate(r)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	delete(s.sessions, r.Header.Get("X-User-Token"))
+	respond(w, 200, "logout successful", struct{}{})
+}
+
+func (s *Server) validateToken(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss, a, e := s.authenticate(r)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	xp := s.permissionCodes(a)
+	if ss.scope != nil {
+		scoped := security.PermissionCodes{}
+		for _, code := range ss.scope {
+			if xp.Has(code) {
+				scoped = append(scoped, code)
+			}
+		}
+		xp = scoped
+	}
+	respond(w, 200, "token valid", security.TokenInfo{
+		User:            a.user,
+		PermissionCodes: xp,
+		ExpiresAt:       ss.expiresAt,
+		SessionID:       ss.id,
+	})
+}
+
+func (s *Server) refreshToken(w http.ResponseWriter, r *http.Request) {
+	p := security.RefreshTokenPayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	email, ok := s.refreshTokens[p.RefreshToken]
+	if !ok {
+		respondErr(w, dutil.NewErr(401, "auth", []string{"Invalid refresh token", "Please login"}))
+		return
+	}
+	// refresh tokens are rotated, each can only be used once
+	delete(s.refreshTokens, p.RefreshToken)
+	token := s.newSession(email)
+	s.sessions[token].from(r)
+	refreshToken := uuid.NewString()
+	s.refreshTokens[refreshToken] = email
+	w.Header().Set("X-User-Token", token)
+	respond(w, 200, "token refresh successful", map[string]interface{}{
+		"refresh_token": refreshToken,
+		"expires_at":    s.sessions[token].expiresAt,
+	})
+}
+
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	p := security.RegisterPayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+	errs := dutil.Errors{}
+	if p.Email == "" {
+		errs["email"] = []string{"required field"}
+	}
+	if p.Password == "" {
+		errs["password"] = []string{"required field"}
+	}
+	if len(errs) > 0 {
+		respondErr(w, &dutil.Err{Status: 400, Errors: errs})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[p.Email]; ok {
+		respondErr(w, dutil.NewErr(409, "email", []string{"already registered"}))
+		return
+	}
+	u := security.User{
+		UUID:          uuid.New(),
+		FirstName:     p.FirstName,
+		LastName:      p.LastName,
+		Email:         p.Email,
+		ContactNumber: p.ContactNumber,
+	}
+	s.users[p.Email] = &account{user: u, password: p.Password}
+	s.verifyTokens[uuid.NewString()] = p.Email
+	respond(w, 201, "registration successful", map[string]interface{}{
+		"user": u,
+	})
+}
+
+func (s *Server) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	p := security.VerifyEmailPayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	email, ok := s.verifyTokens[p.VerificationToken]
+	if !ok {
+		respondErr(w, dutil.NewErr(400, "verification_token", []string{"invalid or expired"}))
+		return
+	}
+	delete(s.verifyTokens, p.VerificationToken)
+	if a, ok := s.users[email]; ok {
+		a.user.Active = true
+	}
+	respond(w, 200, "email verified", struct{}{})
+}
+
+func (s *Server) resendVerification(w http.ResponseWriter, r *http.Request) {
+	p := security.ResendVerificationPayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.users[p.Email]
+	if !ok {
+		respondErr(w, dutil.NewErr(404, "user", []string{"not found"}))
+		return
+	}
+	if a.user.Active {
+		respondErr(w, dutil.NewErr(400, "email", []string{"already verified"}))
+		return
+	}
+	// the previous verification token is replaced
+	delete(s.verifyTokens, s.verificationToken(p.Email))
+	s.verifyTokens[uuid.NewString()] = p.Email
+	respond(w, 200, "verification sent", struct{}{})
+}
+
+func (s *Server) changePassword(w http.ResponseWriter, r *http.Request) {
+	p := security.ChangePasswordPayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, a, e := s.authenticate(r)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	if p.CurrentPassword != a.password {
+		respondErr(w, dutil.NewErr(400, "current_password", []string{"incorrect"}))
+		return
+	}
+	if len(p.NewPassword) < MinPasswordLength {
+		respondErr(w, dutil.NewErr(400, "password_policy", []string{"at least 8 characters"}))
+		return
+	}
+	if a.used(p.NewPassword) {
+		respondErr(w, dutil.NewErr(400, "password_reuse", []string{"password was used before"}))
+		return
+	}
+	a.setPassword(p.NewPassword)
+
+	if p.RevokeOtherSessions {
+		current := r.Header.Get("X-User-Token")
+		for token, ss := range s.sessions {
+			if ss.email == a.user.Email && token != current {
+				delete(s.sessions, token)
+			}
+		}
+	}
+	respond(w, 200, "password changed", struct{}{})
+}
+
+// userResource routes the exchanges on the /users/ resource.
+func (s *Server) userResource(w http.ResponseWriter, r *http.Request) {
+	xs := strings.Split(strings.TrimPrefix(r.URL.Path, "/users/"), "/")
+	switch {
+	case len(xs) == 1 && xs[0] == "me":
+		route("GET", s.currentUser)(w, r)
+	case len(xs) == 1 && strings.EqualFold(r.Method, "PATCH"):
+		s.updateUser(w, r, xs[0])
+	case len(xs) == 1:
+		route("GET", func(w http.ResponseWriter, r *http.Request) { s.getUser(w, r, xs[0]) })(w, r)
+	case len(xs) == 2 && (xs[1] == "deactivate" || xs[1] == "reactivate"):
+		route("POST", func(w http.ResponseWriter, r *http.Request) { s.setActive(w, r, xs[0], xs[1] == "reactivate") })(w, r)
+	case len(xs) == 2 && xs[1] == "sessions" && strings.EqualFold(r.Method, "DELETE"):
+		s.revokeAllSessions(w, r, xs[0])
+	case len(xs) == 2 && xs[1] == "sessions":
+		route("GET", func(w http.ResponseWriter, r *http.Request) { s.listSessions(w, r, xs[0]) })(w, r)
+	case len(xs) == 2 && xs[1] == "roles":
+		route("GET", func(w http.ResponseWriter, r *http.Request) { s.listUserRoles(w, r, xs[0]) })(w, r)
+	case len(xs) == 3 && xs[1] == "roles" && strings.EqualFold(r.Method, "PUT"):
+		s.assignRole(w, r, xs[0], xs[2], true)
+	case len(xs) == 3 && xs[1] == "roles":
+		route("DELETE", func(w http.ResponseWriter, r *http.Request) { s.assignRole(w, r, xs[0], xs[2], false) })(w, r)
+	default:
+		respondErr(w, dutil.NewErr(404, "path", []string{"not found"}))
+	}
+}
+
+// DefaultPageLimit is the number of users on a page of a listing if the
+// query has no limit.
+const DefaultPageLimit = 50
+
+func (s *Server) listUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := DefaultPageLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			respondErr(w, dutil.NewErr(400, "limit", []string{"invalid limit"}))
+			return
+		}
+		limit = n
+	}
+	// the cursor is the offset of the page in the listing
+	offset := 0
+	if v := q.Get("cursor"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			respondErr(w, dutil.NewErr(400, "cursor", []string{"invalid cursor"}))
+			return
+		}
+		offset = n
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, e := s.authenticate(r); e != nil {
+		respondErr(w, e)
+		return
+	}
+	xu := make([]security.User, 0, len(s.users))
+	for _, a := range s.users {
+		u := a.user
+		name := strings.ToLower(u.FirstName + " " + u.LastName)
+		switch {
+		case !strings.Contains(u.Email, q.Get("email")):
+		case !strings.Contains(name, strings.ToLower(q.Get("name"))):
+		case q.Get("active") != "" && q.Get("active") != strconv.FormatBool(u.Active):
+		default:
+			xu = append(xu, u)
+		}
+	}
+	sort.Slice(xu, func(i, j int) bool { return xu[i].Email < xu[j].Email })
+
+	page := security.UserPage{
+		Users: []security.User{},
+		Total: len(xu),
+	}
+	if offset < len(xu) {
+		end := offset + limit
+		if end < len(xu) {
+			page.NextCursor = strconv.Itoa(end)
+		} else {
+			end = len(xu)
+		}
+		page.Users = xu[offset:end]
+	}
+	respond(w, 200, "users", page)
+}
+
+// userByUUID returns the account of the user with the UUID, the caller
+// must hold s.mu. If there is no such user the error to respond with is
+// returned.
+func (s *Server) userByUUID(userUUID string) (*account, dutil.Error) {
+	id, err := uuid.Parse(userUUID)
+	if err != nil {
+		return nil, dutil.NewErr(400, "uuid", []string{"invalid uuid"})
+	}
+	for _, a := range s.users {
+		if a.user.UUID == id {
+			return a, nil
+		}
+	}
+	return nil, dutil.NewErr(404, "user", []string{"not found"})
+}
+
+func (s *Server) currentUser(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, a, e := s.authenticate(r)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	respond(w, 200, "user", map[string]interface{}{"user": a.user})
+}
+
+func (s *Server) getUser(w http.ResponseWriter, r *http.Request, userUUID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, e := s.authenticate(r); e != nil {
+		respondErr(w, e)
+		return
+	}
+	a, e := s.userByUUID(userUUID)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	respond(w, 200, "user", map[string]interface{}{"user": a.user})
+}
+
+func (s *Server) updateUser(w http.ResponseWriter, r *http.Request, userUUID string) {
+	p := security.UpdateUserPayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, e := s.authenticate(r); e != nil {
+		respondErr(w, e)
+		return
+	}
+	a, e := s.userByUUID(userUUID)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	if p.FirstName != nil {
+		a.user.FirstName = *p.FirstName
+	}
+	if p.LastName != nil {
+		a.user.LastName = *p.LastName
+	}
+	if p.ContactNumber != nil {
+		a.user.ContactNumber = *p.ContactNumber
+	}
+	respond(w, 200, "user updated", map[string]interface{}{"user": a.user})
+}
+
+func (s *Server) setActive(w http.ResponseWriter, r *http.Request, userUUID string, active bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, e := s.authenticate(r); e != nil {
+		respondErr(w, e)
+		return
+	}
+	a, e := s.userByUUID(userUUID)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	a.user.Active = active
+	respond(w, 200, "user updated", map[string]interface{}{"user": a.user})
+}
+
+func (s *Server) passwordResetToken(w http.ResponseWriter, r *http.Request) {
+	p := security.PasswordResetTokenPayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+	if p.Email == "" {
+		respondErr(w, dutil.NewErr(400, "email", []string{"required field"}))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[p.Email]; !ok {
+		respondErr(w, dutil.NewErr(404, "user", []string{"not found"}))
+		return
+	}
+	token := uuid.NewString()
+	s.resetTokens[token] = p.Email
+	respond(w, 200, "password reset token successful", map[string]string{
+		"password_reset_token": token,
+	})
+}
+
+func (s *Server) resetPassword(w http.ResponseWriter, r *http.Request) {
+	p := security.ResetPasswordPayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+	if p.Password == "" {
+		respondErr(w, dutil.NewErr(400, "password", []string{"required field"}))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	email, ok := s.resetTokens[p.PasswordResetToken]
+	if !ok || email != p.Email {
+		respondErr(w, dutil.NewErr(400, "password_reset_token", []string{"invalid or expired"}))
+		return
+	}
+	a, ok := s.users[email]
+	if !ok {
+		respondErr(w, dutil.NewErr(404, "user", []string{"not found"}))
+		return
+	}
+	a.setPassword(p.Password)
+	delete(s.resetTokens, p.PasswordResetToken)
+	respond(w, 200, "password reset successful", nil)
+}
+
+func (s *Server) revokePasswordResetToken(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("password_reset_token")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.resetTokens[token]; !ok {
+		respondErr(w, dutil.NewErr(404, "password_reset_token", []string{"not found"}))
+		return
+	}
+	delete(s.resetTokens, token)
+	respond(w, 200, "revoke password reset token successful", struct{}{})
+}
+
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request, userUUID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, e := s.authenticate(r); e != nil {
+		respondErr(w, e)
+		return
+	}
+	a, e := s.userByUUID(userUUID)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	current := r.Header.Get("X-User-Token")
+	now := time.Now()
+	xs := []security.Session{}
+	for token, ss := range s.sessions {
+		if ss.email != a.user.Email || now.After(ss.expiresAt) {
+			continue
+		}
+		xs = append(xs, security.Session{
+			ID:         ss.id,
+			Device:     ss.device,
+			IP:         ss.ip,
+			CreatedAt:  ss.createdAt,
+			LastSeenAt: ss.lastSeenAt,
+			ExpiresAt:  ss.expiresAt,
+			Current:    token == current,
+		})
+	}
+	sort.Slice(xs, func(i, j int) bool { return xs[i].CreatedAt.Before(xs[j].CreatedAt) })
+	respond(w, 200, "sessions", map[string]interface{}{"sessions": xs})
+}
+
+func (s *Server) revokeSession(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/sessions/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, e := s.authenticate(r); e != nil {
+		respondErr(w, e)
+		return
+	}
+	for token, ss := range s.sessions {
+		if ss.id == id {
+			delete(s.sessions, token)
+			respond(w, 200, "session revoked", struct{}{})
+			return
+		}
+	}
+	respondErr(w, dutil.NewErr(404, "session", []string{"not found"}))
+}
+
+func (s *Server) revokeAllSessions(w http.ResponseWriter, r *http.Request, userUUID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, e := s.authenticate(r); e != nil {
+		respondErr(w, e)
+		return
+	}
+	a, e := s.userByUUID(userUUID)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	current := ""
+	if r.URL.Query().Get("except_current") == "true" {
+		current = r.Header.Get("X-User-Token")
+	}
+	for token, ss := range s.sessions {
+		if ss.email == a.user.Email && token != current {
+			delete(s.sessions, token)
+		}
+	}
+	respond(w, 200, "sessions revoked", struct{}{})
+}
+
+// apiKeyCollection routes the exchanges on the /api-keys resource.
+func (s *Server) apiKeyCollection(w http.ResponseWriter, r *http.Request) {
+	if strings.EqualFold(r.Method, "POST") {
+		s.createAPIKey(w, r)
+		return
+	}
+	route("GET", s.listAPIKeys)(w, r)
+}
+
+// apiKeyResource routes the exchanges on the /api-keys/ resource.
+func (s *Server) apiKeyResource(w http.ResponseWriter, r *http.Request) {
+	xs := strings.Split(strings.TrimPrefix(r.URL.Path, "/api-keys/"), "/")
+	switch {
+	case len(xs) == 1:
+		route("DELETE", func(w http.ResponseWriter, r *http.Request) { s.revokeAPIKey(w, r, xs[0]) })(w, r)
+	case len(xs) == 2 && xs[1] == "rotate":
+		route("POST", func(w http.ResponseWriter, r *http.Request) { s.rotateAPIKey(w, r, xs[0]) })(w, r)
+	default:
+		respondErr(w, dutil.NewErr(404, "path", []string{"not found"}))
+	}
+}
+
+// newKey returns a new random API key.
+func newKey() string {
+	return "sk_" + strings.ReplaceAll(uuid.NewString()+uuid.NewString(), "-", "")
+}
+
+// apiKeyOf returns the API key with the UUID of the account, the caller
+// must hold s.mu. If the account has no such key the error to respond with
+// is returned.
+func (s *Server) apiKeyOf(a *account, keyUUID string) (*apiKey, dutil.Error) {
+	id, err := uuid.Parse(keyUUID)
+	if err != nil {
+		return nil, dutil.NewErr(400, "uuid", []string{"invalid uuid"})
+	}
+	k, ok := s.apiKeys[id]
+	if !ok || k.email != a.user.Email {
+		return nil, dutil.NewErr(404, "api_key", []string{"not found"})
+	}
+	return k, nil
+}
+
+func (s *Server) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	p := security.CreateAPIKeyPayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+	if p.Name == "" {
+		respondErr(w, dutil.NewErr(400, "name", []string{"name is required"}))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss, a, e := s.authenticate(r)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	// an API key is scoped to a subset of the permission codes of the user
+	// or of the API key that creates it
+	xp := s.permissionCodes(a)
+	if ss.scope != nil {
+		xp = ss.scope
+	}
+	missing := []string{}
+	for _, code := range p.PermissionCodes {
+		if !xp.Has(code) {
+			missing = append(missing, code)
+		}
+	}
+	if len(missing) > 0 {
+		respondErr(w, dutil.NewErr(403, "permission", missing))
+		return
+	}
+
+	key := newKey()
+	k := &apiKey{
+		APIKey: security.APIKey{
+			UUID:            uuid.New(),
+			Name:            p.Name,
+			Prefix:          key[:7],
+			PermissionCodes: append(security.PermissionCodes{}, p.PermissionCodes...),
+			CreatedAt:       time.Now(),
+			ExpiresAt:       p.ExpiresAt,
+		},
+		key:   key,
+		email: a.user.Email,
+	}
+	s.apiKeys[k.UUID] = k
+	respond(w, 201, "api key created", map[string]interface{}{"api_key": k.APIKey, "key": key})
+}
+
+func (s *Server) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, a, e := s.authenticate(r)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	xk := []security.APIKey{}
+	for _, k := range s.apiKeys {
+		if k.email == a.user.Email {
+			xk = append(xk, k.APIKey)
+		}
+	}
+	sort.Slice(xk, func(i, j int) bool { return xk[i].CreatedAt.Before(xk[j].CreatedAt) })
+	respond(w, 200, "api keys", map[string]interface{}{"api_keys": xk})
+}
+
+func (s *Server) rotateAPIKey(w http.ResponseWriter, r *http.Request, keyUUID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, a, e := s.authenticate(r)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	k, e := s.apiKeyOf(a, keyUUID)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	k.key = newKey()
+	k.Prefix = k.key[:7]
+	respond(w, 200, "api key rotated", map[string]interface{}{"api_key": k.APIKey, "key": k.key})
+}
+
+func (s *Server) revokeAPIKey(w http.ResponseWriter, r *http.Request, keyUUID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, a, e := s.authenticate(r)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	k, e := s.apiKeyOf(a, keyUUID)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	delete(s.apiKeys, k.UUID)
+	respond(w, 200, "api key revoked", struct{}{})
+}
+
+// roleCollection routes the exchanges on the /roles resource.
+func (s *Server) roleCollection(w http.ResponseWriter, r *http.Request) {
+	if strings.EqualFold(r.Method, "POST") {
+		s.createRole(w, r)
+		return
+	}
+	route("GET", s.listRoles)(w, r)
+}
+
+// roleResource routes the exchanges on the /roles/ resource.
+func (s *Server) roleResource(w http.ResponseWriter, r *http.Request) {
+	xs := strings.Split(strings.TrimPrefix(r.URL.Path, "/roles/"), "/")
+	switch {
+	case len(xs) == 1 && strings.EqualFold(r.Method, "PATCH"):
+		s.updateRole(w, r, xs[0])
+	case len(xs) == 1:
+		route("GET", func(w http.ResponseWriter, r *http.Request) { s.getRole(w, r, xs[0]) })(w, r)
+	case len(xs) == 2 && xs[1] == "permissions" && strings.EqualFold(r.Method, "POST"):
+		s.attachPermissions(w, r, xs[0])
+	case len(xs) == 2 && xs[1] == "permissions":
+		route("DELETE", func(w http.ResponseWriter, r *http.Request) { s.detachPermissions(w, r, xs[0]) })(w, r)
+	default:
+		respondErr(w, dutil.NewErr(404, "path", []string{"not found"}))
+	}
+}
+
+// roleByUUID returns the role with the UUID, the caller must hold s.mu. If
+// there is no such role the error to respond with is returned.
+func (s *Server) roleByUUID(roleUUID string) (*security.Role, dutil.Error) {
+	id, err := uuid.Parse(roleUUID)
+	if err != nil {
+		return nil, dutil.NewErr(400, "uuid", []string{"invalid uuid"})
+	}
+	role, ok := s.roles[id]
+	if !ok {
+		return nil, dutil.NewErr(404, "role", []string{"not found"})
+	}
+	return role, nil
+}
+
+// sortedRoles returns the roles sorted by name.
+func sortedRoles(xr []security.Role) []security.Role {
+	sort.Slice(xr, func(i, j int) bool { return xr[i].Name < xr[j].Name })
+	return xr
+}
+
+func (s *Server) listRoles(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, e := s.authenticate(r); e != nil {
+		respondErr(w, e)
+		return
+	}
+	xr := make([]security.Role, 0, len(s.roles))
+	for _, role := range s.roles {
+		xr = append(xr, *role)
+	}
+	respond(w, 200, "roles", map[string]interface{}{"roles": sortedRoles(xr)})
+}
+
+func (s *Server) listUserRoles(w http.ResponseWriter, r *http.Request, userUUID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, e := s.authenticate(r); e != nil {
+		respondErr(w, e)
+		return
+	}
+	a, e := s.userByUUID(userUUID)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	xr := make([]security.Role, 0, len(a.roles))
+	for _, id := range a.roles {
+		if role, ok := s.roles[id]; ok {
+			xr = append(xr, *role)
+		}
+	}
+	respond(w, 200, "roles", map[string]interface{}{"roles": sortedRoles(xr)})
+}
+
+func (s *Server) getRole(w http.ResponseWriter, r *http.Request, roleUUID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, e := s.authenticate(r); e != nil {
+		respondErr(w, e)
+		return
+	}
+	role, e := s.roleByUUID(roleUUID)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	respond(w, 200, "role", map[string]interface{}{"role": role})
+}
+
+func (s *Server) createRole(w http.ResponseWriter, r *http.Request) {
+	p := security.CreateRolePayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+	if p.Name == "" {
+		respondErr(w, dutil.NewErr(400, "name", []string{"name is required"}))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, e := s.authenticate(r); e != nil {
+		respondErr(w, e)
+		return
+	}
+	for _, role := range s.roles {
+		if role.Name == p.Name {
+			respondErr(w, dutil.NewErr(409, "role", []string{"name already exists"}))
+			return
+		}
+	}
+	role := &security.Role{
+		UUID:        uuid.New(),
+		Name:        p.Name,
+		Description: p.Description,
+		Permissions: []security.Permission{},
+	}
+	attach(role, p.PermissionCodes)
+	s.roles[role.UUID] = role
+	respond(w, 201, "role created", map[string]interface{}{"role": role})
+}
+
+func (s *Server) updateRole(w http.ResponseWriter, r *http.Request, roleUUID string) {
+	p := security.UpdateRolePayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, e := s.authenticate(r); e != nil {
+		respondErr(w, e)
+		return
+	}
+	role, e := s.roleByUUID(roleUUID)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	if p.Name != nil {
+		for _, other := range s.roles {
+			if other != role && other.Name == *p.Name {
+				respondErr(w, dutil.NewErr(409, "role", []string{"name already exists"}))
+				return
+			}
+		}
+		role.Name = *p.Name
+	}
+	if p.Description != nil {
+		role.Description = *p.Description
+	}
+	respond(w, 200, "role updated", map[string]interface{}{"role": role})
+}
+
+// attach adds the permission codes the role does not have yet to the role.
+func attach(role *security.Role, xp security.PermissionCodes) {
+	for _, code := range xp {
+		if !role.PermissionCodes().Has(code) {
+			role.Permissions = append(role.Permissions, security.Permission{Code: code})
+		}
+	}
+}
+
+func (s *Server) attachPermissions(w http.ResponseWriter, r *http.Request, roleUUID string) {
+	p := security.RolePermissionsPayload{}
+	if e := decode(r, &p); e != nil {
+		respondErr(w, e)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, e := s.authenticate(r); e != nil {
+		respondErr(w, e)
+		return
+	}
+	role, e := s.roleByUUID(roleUUID)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	attach(role, p.PermissionCodes)
+	respond(w, 200, "role updated", map[string]interface{}{"role": role})
+}
+
+func (s *Server) detachPermissions(w http.ResponseWriter, r *http.Request, roleUUID string) {
+	detach := security.PermissionCodes(r.URL.Query()["permission_code"])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, e := s.authenticate(r); e != nil {
+		respondErr(w, e)
+		return
+	}
+	role, e := s.roleByUUID(roleUUID)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	xp := []security.Permission{}
+	for _, p := range role.Permissions {
+		if !detach.Has(p.Code) {
+			xp = append(xp, p)
+		}
+	}
+	role.Permissions = xp
+	respond(w, 200, "role updated", map[string]interface{}{"role": role})
+}
+
+func (s *Server) assignRole(w http.ResponseWriter, r *http.Request, userUUID string, roleUUID string, assign bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, e := s.authenticate(r); e != nil {
+		respondErr(w, e)
+		return
+	}
+	a, e := s.userByUUID(userUUID)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+	role, e := s.roleByUUID(roleUUID)
+	if e != nil {
+		respondErr(w, e)
+		return
+	}
+
+	if !assign {
+		xr := []uuid.UUID{}
+		for _, id := range a.roles {
+			if id != role.UUID {
+				xr = append(xr, id)
+			}
+		}
+		a.roles = xr
+		respond(w, 200, "role unassigned", struct{}{})
+		return
+	}
+	if !a.assigned(role.UUID) {
+		a.roles = append(a.roles, role.UUID)
+	}
+	respond(w, 200, "role assigned", struct{}{})
+}
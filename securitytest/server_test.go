@@ -0,0 +1,731 @@
+package securitytest
+
+import (
+	"context"
+	"errors"
+	"github.com/dottics/dutil"
+	security "github.com/dottics/securityserv"
+	"github.com/google/uuid"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_login(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	u := srv.AddUser(security.User{Email: "tp@test.dottics.com", FirstName: "james", Active: true}, "password", security.PermissionCodes{"abcd"})
+	srv.AddUser(security.User{Email: "inactive@test.dottics.com"}, "password", nil)
+
+	s := srv.Service("")
+
+	tests := []struct {
+		name    string
+		payload string
+		status  int
+	}{
+		{name: "unknown user", payload: `{"email":"i@dont.exist","password":"password"}`, status: 400},
+		{name: "wrong password", payload: `{"email":"tp@test.dottics.com","password":"wrong"}`, status: 400},
+		{name: "inactive user", payload: `{"email":"inactive@test.dottics.com","password":"password"}`, status: 403},
+		{name: "bad payload", payload: `{"email":`, status: 400},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			token, _, _, e := s.Login(strings.NewReader(tc.payload))
+			if token != "" {
+				t.Errorf("expected empty token got '%v'", token)
+			}
+			if dutil.Inst(e).Status != tc.status {
+				t.Errorf("expected status %d got %d: %v", tc.status, dutil.Inst(e).Status, e)
+			}
+		})
+	}
+
+	token, user, xp, e := s.Login(strings.NewReader(`{"email":"tp@test.dottics.com","password":"password"}`))
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if token == "" {
+		t.Errorf("expected a token")
+	}
+	if user != u {
+		t.Errorf("expected user %v got %v", u, user)
+	}
+	if !xp.Has("abcd") {
+		t.Errorf("expected permission codes %v got %v", security.PermissionCodes{"abcd"}, xp)
+	}
+
+	// the token is valid until logout
+	info, e := s.ValidateToken(token)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if info.User.UUID != u.UUID || info.SessionID == "" || info.ExpiresAt.IsZero() {
+		t.Errorf("unexpected token info %v", info)
+	}
+
+	e = srv.Service(token).Logout()
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	_, e = s.ValidateToken(token)
+	if dutil.Inst(e).Status != 401 {
+		t.Errorf("expected status %d got %v", 401, e)
+	}
+	e = srv.Service(token).Logout()
+	if dutil.Inst(e).Status != 401 {
+		t.Errorf("expected status %d got %v", 401, e)
+	}
+}
+
+func TestServer_resetPassword(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.AddUser(security.User{Email: "tp@test.dottics.com", Active: true}, "password", nil)
+
+	s := srv.Service("")
+
+	_, e := s.PasswordResetToken(security.PasswordResetTokenPayload{Email: "i@dont.exist"})
+	if dutil.Inst(e).Status != 404 {
+		t.Errorf("expected status %d got %v", 404, e)
+	}
+
+	token, e := s.PasswordResetToken(security.PasswordResetTokenPayload{Email: "tp@test.dottics.com"})
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	e = s.ResetPassword(security.ResetPasswordPayload{
+		Email:              "tp@test.dottics.com",
+		PasswordResetToken: token,
+		Password:           "new-password",
+	})
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	// the reset token can only be used once
+	e = s.ResetPassword(security.ResetPasswordPayload{
+		Email:              "tp@test.dottics.com",
+		PasswordResetToken: token,
+		Password:           "another-password",
+	})
+	if dutil.Inst(e).Status != 400 {
+		t.Errorf("expected status %d got %v", 400, e)
+	}
+
+	_, _, _, e = s.Login(strings.NewReader(`{"email":"tp@test.dottics.com","password":"new-password"}`))
+	if e != nil {
+		t.Errorf("unexpected error: %v", e)
+	}
+}
+
+func TestServer_revokePasswordResetToken(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.AddUser(security.User{Email: "tp@test.dottics.com", Active: true}, "password", nil)
+
+	s := srv.Service("")
+
+	token, e := s.PasswordResetToken(security.PasswordResetTokenPayload{Email: "tp@test.dottics.com"})
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	e = s.RevokePasswordResetToken(uuid.MustParse(token))
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	e = s.RevokePasswordResetToken(uuid.MustParse(token))
+	if dutil.Inst(e).Status != 404 {
+		t.Errorf("expected status %d got %v", 404, e)
+	}
+	e = s.ResetPassword(security.ResetPasswordPayload{
+		Email:              "tp@test.dottics.com",
+		PasswordResetToken: token,
+		Password:           "new-password",
+	})
+	if dutil.Inst(e).Status != 400 {
+		t.Errorf("expected status %d got %v", 400, e)
+	}
+}
+
+func TestServer_home(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	alive, e := srv.Service("").GetHome()
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if !alive {
+		t.Errorf("expected the server to be alive")
+	}
+}
+
+func TestServer_refreshToken(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.AddUser(security.User{Email: "tp@test.dottics.com", Active: true}, "password", nil)
+
+	result, e := srv.Service("").Authenticate(strings.NewReader(`{"email":"tp@test.dottics.com","password":"password"}`))
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if result.RefreshToken == "" {
+		t.Fatalf("expected a refresh token")
+	}
+
+	var refreshed []security.TokenPair
+	s := security.NewServiceWithOptions(
+		security.WithToken(result.Token),
+		security.WithAutoRefresh(result.RefreshToken, func(pair security.TokenPair) {
+			refreshed = append(refreshed, pair)
+		}),
+	)
+	srv.Attach(s)
+
+	// an expired session is refreshed and the exchange made again
+	srv.Expire(result.Token)
+	e = s.Logout()
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if len(refreshed) != 1 {
+		t.Fatalf("expected %d refresh got %d", 1, len(refreshed))
+	}
+	if s.Token() != refreshed[0].Token {
+		t.Errorf("expected '%v' got '%v'", refreshed[0].Token, s.Token())
+	}
+
+	// the old refresh token was rotated
+	_, e = s.RefreshToken(result.RefreshToken)
+	if dutil.Inst(e).Status != 401 {
+		t.Errorf("expected status %d got %v", 401, e)
+	}
+}
+
+func TestServer_register(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	s := srv.Service("")
+	p := security.RegisterPayload{
+		FirstName: "james",
+		Email:     "jb@test.dottics.com",
+		Password:  "password",
+	}
+	u, e := s.Register(p)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if u.UUID == uuid.Nil || u.Active {
+		t.Errorf("expected a new inactive user got %v", u)
+	}
+	_, e = s.Register(p)
+	if !errors.Is(e, security.ErrConflict) {
+		t.Errorf("expected '%v' got '%v'", security.ErrConflict, e)
+	}
+
+	// the user cannot login until the email is verified
+	login := `{"email":"jb@test.dottics.com","password":"password"}`
+	_, _, _, e = s.Login(strings.NewReader(login))
+	if !errors.Is(e, security.ErrUserInactive) {
+		t.Errorf("expected '%v' got '%v'", security.ErrUserInactive, e)
+	}
+
+	first := srv.VerificationToken(p.Email)
+	e = s.ResendVerification(p.Email)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	e = s.VerifyEmail(first)
+	if !errors.Is(e, security.ErrVerificationTokenInvalid) {
+		t.Errorf("expected '%v' got '%v'", security.ErrVerificationTokenInvalid, e)
+	}
+	e = s.VerifyEmail(srv.VerificationToken(p.Email))
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	_, _, _, e = s.Login(strings.NewReader(login))
+	if e != nil {
+		t.Errorf("unexpected error: %v", e)
+	}
+}
+
+func TestServer_changePassword(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.AddUser(security.User{Email: "tp@test.dottics.com", Active: true}, "password", nil)
+
+	token := srv.NewSession("tp@test.dottics.com")
+	srv.NewSession("tp@test.dottics.com")
+	s := srv.Service(token)
+
+	tests := []struct {
+		name    string
+		payload security.ChangePasswordPayload
+		kind    error
+	}{
+		{
+			name:    "wrong current password",
+			payload: security.ChangePasswordPayload{CurrentPassword: "wrong", NewPassword: "new-password"},
+			kind:    security.ErrWrongPassword,
+		},
+		{
+			name:    "password policy",
+			payload: security.ChangePasswordPayload{CurrentPassword: "password", NewPassword: "short"},
+			kind:    security.ErrPasswordPolicy,
+		},
+		{
+			name:    "password reused",
+			payload: security.ChangePasswordPayload{CurrentPassword: "password", NewPassword: "password"},
+			kind:    security.ErrPasswordReused,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			e := s.ChangePassword(tc.payload)
+			if !errors.Is(e, tc.kind) {
+				t.Errorf("expected '%v' got '%v'", tc.kind, e)
+			}
+		})
+	}
+
+	e := s.ChangePassword(security.ChangePasswordPayload{
+		CurrentPassword:     "password",
+		NewPassword:         "new-password",
+		RevokeOtherSessions: true,
+	})
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if n := srv.Sessions("tp@test.dottics.com"); n != 1 {
+		t.Errorf("expected %d session got %d", 1, n)
+	}
+	_, _, _, e = s.Login(strings.NewReader(`{"email":"tp@test.dottics.com","password":"new-password"}`))
+	if e != nil {
+		t.Errorf("unexpected error: %v", e)
+	}
+}
+
+func TestServer_users(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	admin := srv.AddUser(security.User{Email: "admin@test.dottics.com", Active: true}, "password", nil)
+	u := srv.AddUser(security.User{Email: "jb@test.dottics.com", FirstName: "james", LastName: "bond", Active: true}, "password", nil)
+
+	s := srv.Service(srv.NewSession(admin.Email))
+
+	me, e := s.GetCurrentUser()
+	if e != nil || me != admin {
+		t.Errorf("expected %v got %v %v", admin, me, e)
+	}
+	_, e = s.GetUser(uuid.New())
+	if !errors.Is(e, security.ErrNotFound) {
+		t.Errorf("expected '%v' got '%v'", security.ErrNotFound, e)
+	}
+
+	after := u
+	after.FirstName = "jimmy"
+	updated, e := s.UpdateUser(u.UUID, security.UserChanges(u, after))
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if updated != after {
+		t.Errorf("expected %v got %v", after, updated)
+	}
+
+	_, e = s.DeactivateUser(u.UUID)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	got, _ := s.GetUser(u.UUID)
+	if got.Active {
+		t.Errorf("expected the user to be inactive")
+	}
+	got, e = s.ReactivateUser(u.UUID)
+	if e != nil || !got.Active {
+		t.Errorf("expected the user to be active got %v %v", got, e)
+	}
+}
+
+func TestServer_listUsers(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	for i, name := range []string{"anna", "bond", "carl", "dave", "bonnie"} {
+		u := security.User{
+			Email:     name + "@test.dottics.com",
+			FirstName: name,
+			Active:    i%2 == 0,
+		}
+		srv.AddUser(u, "password", nil)
+	}
+
+	s := srv.Service(srv.NewSession("anna@test.dottics.com"))
+
+	page, e := s.ListUsers(security.ListUsersQuery{Limit: 2})
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if len(page.Users) != 2 || page.Total != 5 || page.NextCursor == "" {
+		t.Errorf("unexpected page %v", page)
+	}
+
+	active := true
+	it := s.IterateUsers(context.Background(), security.ListUsersQuery{Name: "bon", Active: &active, Limit: 1})
+	var emails []string
+	for it.Next() {
+		emails = append(emails, it.User().Email)
+	}
+	if e := it.Err(); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if len(emails) != 1 || emails[0] != "bonnie@test.dottics.com" {
+		t.Errorf("expected %v got %v", []string{"bonnie@test.dottics.com"}, emails)
+	}
+
+	it = s.IterateUsers(context.Background(), security.ListUsersQuery{Limit: 2})
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if n != 5 {
+		t.Errorf("expected %d users got %d", 5, n)
+	}
+}
+
+func TestServer_roles(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	admin := srv.AddUser(security.User{Email: "admin@test.dottics.com", Active: true}, "password", security.PermissionCodes{"abcd"})
+	srv.AddRole(security.Role{Name: "viewer", Permissions: []security.Permission{{Code: "view"}}})
+
+	s := srv.Service(srv.NewSession(admin.Email))
+
+	role, e := s.CreateRole(security.CreateRolePayload{Name: "editor", PermissionCodes: security.PermissionCodes{"edit"}})
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	_, e = s.CreateRole(security.CreateRolePayload{Name: "editor"})
+	if !errors.Is(e, security.ErrConflict) {
+		t.Errorf("expected '%v' got '%v'", security.ErrConflict, e)
+	}
+
+	description := "can edit"
+	role, e = s.UpdateRole(role.UUID, security.UpdateRolePayload{Description: &description})
+	if e != nil || role.Description != description {
+		t.Errorf("expected description '%v' got %v %v", description, role, e)
+	}
+	role, e = s.AttachPermissions(role.UUID, "publish", "edit")
+	if e != nil || strings.Join(role.PermissionCodes(), ",") != "edit,publish" {
+		t.Errorf("expected 'edit,publish' got %v %v", role.PermissionCodes(), e)
+	}
+
+	xr, e := s.ListRoles()
+	if e != nil || len(xr) != 2 || xr[0].Name != "editor" || xr[1].Name != "viewer" {
+		t.Errorf("expected [editor viewer] got %v %v", xr, e)
+	}
+
+	e = s.AssignRole(admin.UUID, role.UUID)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	info, _ := s.ValidateToken(s.Token())
+	if !info.PermissionCodes.HasAll("abcd", "edit", "publish") {
+		t.Errorf("expected the permission codes of the role got %v", info.PermissionCodes)
+	}
+
+	role, e = s.DetachPermissions(role.UUID, "edit")
+	if e != nil || strings.Join(role.PermissionCodes(), ",") != "publish" {
+		t.Errorf("expected 'publish' got %v %v", role.PermissionCodes(), e)
+	}
+	xr, _ = s.ListUserRoles(admin.UUID)
+	if len(xr) != 1 || xr[0].UUID != role.UUID {
+		t.Errorf("expected [editor] got %v", xr)
+	}
+
+	e = s.UnassignRole(admin.UUID, role.UUID)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	info, _ = s.ValidateToken(s.Token())
+	if info.PermissionCodes.Has("publish") {
+		t.Errorf("expected no permission codes of the role got %v", info.PermissionCodes)
+	}
+	_, e = s.GetRole(uuid.New())
+	if !errors.Is(e, security.ErrNotFound) {
+		t.Errorf("expected '%v' got '%v'", security.ErrNotFound, e)
+	}
+}
+
+func TestServer_sessions(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	u := srv.AddUser(security.User{Email: "jb@test.dottics.com", Active: true}, "password", nil)
+
+	s := srv.Service("")
+	s.Header.Set("User-Agent", "laptop")
+	result, e := s.Authenticate(strings.NewReader(`{"email":"jb@test.dottics.com","password":"password"}`))
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	s.SetToken(result.Token)
+	other := srv.NewSession(u.Email)
+	another := srv.NewSession(u.Email)
+
+	xs, e := s.ListSessions(u.UUID)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if len(xs) != 3 {
+		t.Fatalf("expected 3 sessions got %d", len(xs))
+	}
+	current := xs[0]
+	if !current.Current || current.Device != "laptop" || current.IP != "127.0.0.1" {
+		t.Errorf("unexpected current session %v", current)
+	}
+	if xs[1].Current || xs[2].Current {
+		t.Errorf("expected only one current session got %v", xs)
+	}
+
+	e = s.RevokeSession(xs[1].ID)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	e = s.RevokeSession(xs[1].ID)
+	if !errors.Is(e, security.ErrNotFound) {
+		t.Errorf("expected '%v' got '%v'", security.ErrNotFound, e)
+	}
+	if n := srv.Sessions(u.Email); n != 2 {
+		t.Errorf("expected 2 sessions got %d", n)
+	}
+
+	e = s.RevokeAllSessions(u.UUID, true)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	for _, token := range []string{other, another} {
+		_, e = s.ValidateToken(token)
+		if !errors.Is(e, security.ErrUnauthorised) {
+			t.Errorf("expected '%v' got '%v'", security.ErrUnauthorised, e)
+		}
+	}
+	if _, e = s.GetCurrentUser(); e != nil {
+		t.Errorf("expected the current session to be kept got %v", e)
+	}
+
+	e = s.RevokeAllSessions(u.UUID, false)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if n := srv.Sessions(u.Email); n != 0 {
+		t.Errorf("expected no sessions got %d", n)
+	}
+}
+
+func TestServer_mfa(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	u := srv.AddUser(security.User{Email: "jb@test.dottics.com", Active: true}, "password", nil)
+	payload := `{"email":"jb@test.dottics.com","password":"password"}`
+
+	s := srv.Service(srv.NewSession(u.Email))
+	enrolment, e := s.EnrollTOTP()
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if !strings.Contains(enrolment.URI, enrolment.Secret) {
+		t.Errorf("expected the secret in the uri got %v", enrolment)
+	}
+	e = s.ConfirmTOTP("000000")
+	if !errors.Is(e, security.ErrMFACodeInvalid) {
+		t.Errorf("expected '%v' got '%v'", security.ErrMFACodeInvalid, e)
+	}
+	code, _ := TOTP(enrolment.Secret, time.Now())
+	if e = s.ConfirmTOTP(code); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+
+	_, _, _, e = s.Login(strings.NewReader(payload))
+	var mfa *security.MFARequiredError
+	if !errors.As(e, &mfa) {
+		t.Fatalf("expected a MFARequiredError got '%v'", e)
+	}
+	if len(mfa.Challenge.Methods) != 1 || mfa.Challenge.Methods[0] != "totp" {
+		t.Errorf("expected the totp method got %v", mfa.Challenge.Methods)
+	}
+	_, e = s.VerifyMFA(mfa.Challenge.Challenge, "000000")
+	if !errors.Is(e, security.ErrMFACodeInvalid) {
+		t.Errorf("expected '%v' got '%v'", security.ErrMFACodeInvalid, e)
+	}
+	result, e := s.VerifyMFA(mfa.Challenge.Challenge, code)
+	if e != nil || result.Token == "" || result.User.UUID != u.UUID {
+		t.Fatalf("expected a login got %v %v", result, e)
+	}
+	// a challenge can only be completed once
+	_, e = s.VerifyMFA(mfa.Challenge.Challenge, code)
+	if !errors.Is(e, security.ErrMFAChallengeInvalid) {
+		t.Errorf("expected '%v' got '%v'", security.ErrMFAChallengeInvalid, e)
+	}
+
+	if e = s.DisableTOTP(code); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	token, _, _, e := s.Login(strings.NewReader(payload))
+	if e != nil || token == "" {
+		t.Errorf("expected a login without second factor got '%v' %v", token, e)
+	}
+}
+
+func TestServer_EnableTOTP(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.AddUser(security.User{Email: "jb@test.dottics.com", Active: true}, "password", nil)
+
+	secret := srv.EnableTOTP("jb@test.dottics.com")
+	if srv.EnableTOTP("unknown@test.dottics.com") != "" {
+		t.Errorf("expected no secret for an unknown user")
+	}
+
+	s := srv.Service("")
+	_, e := s.Authenticate(strings.NewReader(`{"email":"jb@test.dottics.com","password":"password"}`))
+	var mfa *security.MFARequiredError
+	if !errors.As(e, &mfa) {
+		t.Fatalf("expected a MFARequiredError got '%v'", e)
+	}
+	code, _ := TOTP(secret, time.Now())
+	if _, e = s.VerifyMFA(mfa.Challenge.Challenge, code); e != nil {
+		t.Errorf("unexpected error: %v", e)
+	}
+}
+
+func TestServer_recoveryCodes(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	u := srv.AddUser(security.User{Email: "jb@test.dottics.com", Active: true}, "password", nil)
+	payload := `{"email":"jb@test.dottics.com","password":"password"}`
+
+	s := srv.Service(srv.NewSession(u.Email))
+	_, e := s.GenerateRecoveryCodes()
+	if !errors.Is(e, security.ErrBadRequest) {
+		t.Errorf("expected '%v' got '%v'", security.ErrBadRequest, e)
+	}
+
+	secret := srv.EnableTOTP(u.Email)
+	xc, e := s.GenerateRecoveryCodes()
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if len(xc) != RecoveryCodeCount {
+		t.Errorf("expected %d codes got %d", RecoveryCodeCount, len(xc))
+	}
+	_, e = s.GenerateRecoveryCodes()
+	if !errors.Is(e, security.ErrConflict) {
+		t.Errorf("expected '%v' got '%v'", security.ErrConflict, e)
+	}
+
+	login := func() string {
+		_, e := s.Authenticate(strings.NewReader(payload))
+		var mfa *security.MFARequiredError
+		if !errors.As(e, &mfa) {
+			t.Fatalf("expected a MFARequiredError got '%v'", e)
+		}
+		return mfa.Challenge.Challenge
+	}
+
+	challenge := login()
+	_, e = s.VerifyRecoveryCode(challenge, "00000-00000")
+	if !errors.Is(e, security.ErrRecoveryCodeInvalid) {
+		t.Errorf("expected '%v' got '%v'", security.ErrRecoveryCodeInvalid, e)
+	}
+	result, e := s.VerifyRecoveryCode(challenge, xc[0])
+	if e != nil || result.Token == "" {
+		t.Fatalf("expected a login got %v %v", result, e)
+	}
+	_, e = s.VerifyRecoveryCode(login(), xc[0])
+	if !errors.Is(e, security.ErrRecoveryCodeUsed) {
+		t.Errorf("expected '%v' got '%v'", security.ErrRecoveryCodeUsed, e)
+	}
+	n, e := s.RemainingRecoveryCodes()
+	if e != nil || n != RecoveryCodeCount-1 {
+		t.Errorf("expected %d remaining got %d %v", RecoveryCodeCount-1, n, e)
+	}
+
+	_, e = s.RegenerateRecoveryCodes("000000")
+	if !errors.Is(e, security.ErrMFACodeInvalid) {
+		t.Errorf("expected '%v' got '%v'", security.ErrMFACodeInvalid, e)
+	}
+	code, _ := TOTP(secret, time.Now())
+	regenerated, e := s.RegenerateRecoveryCodes(code)
+	if e != nil || len(regenerated) != RecoveryCodeCount {
+		t.Fatalf("expected %d codes got %v %v", RecoveryCodeCount, regenerated, e)
+	}
+	_, e = s.VerifyRecoveryCode(login(), xc[1])
+	if !errors.Is(e, security.ErrRecoveryCodeInvalid) {
+		t.Errorf("expected the previous codes to be invalid got '%v'", e)
+	}
+	n, _ = s.RemainingRecoveryCodes()
+	if n != RecoveryCodeCount {
+		t.Errorf("expected %d remaining got %d", RecoveryCodeCount, n)
+	}
+}
+
+func TestServer_apiKeys(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	u := srv.AddUser(security.User{Email: "batch@test.dottics.com", Active: true}, "password", security.PermissionCodes{"abcd", "efgh"})
+
+	s := srv.Service(srv.NewSession(u.Email))
+	_, _, e := s.CreateAPIKey(security.CreateAPIKeyPayload{Name: "batch", PermissionCodes: security.PermissionCodes{"xyz"}})
+	if !errors.Is(e, security.ErrForbidden) {
+		t.Errorf("expected '%v' got '%v'", security.ErrForbidden, e)
+	}
+	apiKey, key, e := s.CreateAPIKey(security.CreateAPIKeyPayload{Name: "batch", PermissionCodes: security.PermissionCodes{"abcd"}})
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if !strings.HasPrefix(key, apiKey.Prefix) {
+		t.Errorf("expected the key to start with '%v' got '%v'", apiKey.Prefix, key)
+	}
+
+	svc := security.NewServiceWithOptions(security.WithAPIKey(key))
+	srv.Attach(svc)
+	me, e := svc.GetCurrentUser()
+	if e != nil || me.UUID != u.UUID {
+		t.Errorf("expected %v got %v %v", u, me, e)
+	}
+	// an API key cannot create a key with more permission codes than it has
+	_, _, e = svc.CreateAPIKey(security.CreateAPIKeyPayload{Name: "other", PermissionCodes: security.PermissionCodes{"efgh"}})
+	if !errors.Is(e, security.ErrForbidden) {
+		t.Errorf("expected '%v' got '%v'", security.ErrForbidden, e)
+	}
+
+	xk, e := s.ListAPIKeys()
+	if e != nil || len(xk) != 1 || xk[0].UUID != apiKey.UUID || xk[0].LastUsedAt == nil {
+		t.Errorf("expected the used api key got %v %v", xk, e)
+	}
+
+	_, rotated, e := s.RotateAPIKey(apiKey.UUID)
+	if e != nil || rotated == key {
+		t.Fatalf("expected a new key got '%v' %v", rotated, e)
+	}
+	_, e = svc.GetCurrentUser()
+	if !errors.Is(e, security.ErrUnauthorised) {
+		t.Errorf("expected '%v' got '%v'", security.ErrUnauthorised, e)
+	}
+
+	svc = security.NewServiceWithOptions(security.WithAPIKey(rotated))
+	srv.Attach(svc)
+	if _, e = svc.GetCurrentUser(); e != nil {
+		t.Errorf("unexpected error: %v", e)
+	}
+	if e = s.RevokeAPIKey(apiKey.UUID); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	_, e = svc.GetCurrentUser()
+	if !errors.Is(e, security.ErrUnauthorised) {
+		t.Errorf("expected '%v' got '%v'", security.ErrUnauthorised, e)
+	}
+	e = s.RevokeAPIKey(apiKey.UUID)
+	if !errors.Is(e, security.ErrNotFound) {
+		t.Errorf("expected '%v' got '%v'", security.ErrNotFound, e)
+	}
+}
@@ -0,0 +1,80 @@
+package securitytest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The parameters of the TOTP codes of the Server, which are the defaults
+// of RFC 6238 and of authenticator apps.
+const (
+	TOTPDigits = 6
+	TOTPPeriod = 30 * time.Second
+)
+
+// encoding is the base32 encoding of TOTP secrets, without padding as in
+// otpauth URIs.
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a new random base32 encoded TOTP secret.
+func NewTOTPSecret() string {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return encoding.EncodeToString(key)
+}
+
+// TOTP returns the RFC 6238 code of the base32 encoded secret at the time
+// t, as an authenticator app would show it. The secret is case insensitive
+// and may be padded.
+func TOTP(secret string, t time.Time) (string, error) {
+	key, err := encoding.DecodeString(strings.TrimRight(strings.ToUpper(secret), "="))
+	if err != nil {
+		return "", err
+	}
+	return totp(key, t, TOTPDigits), nil
+}
+
+// totp returns the code with the number of digits of the key at the time
+// t, using HMAC-SHA1 and the TOTPPeriod.
+func totp(key []byte, t time.Time, digits int) string {
+	counter := uint64(t.Unix() / int64(TOTPPeriod/time.Second))
+	return hotp(key, counter, digits)
+}
+
+// hotp returns the RFC 4226 code with the number of digits of the key for
+// the counter.
+func hotp(key []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+// validTOTP reports whether the code is the code of the secret at the time
+// t or of the period before or after it, to allow for clock skew.
+func validTOTP(secret string, code string, t time.Time) bool {
+	for _, skew := range []time.Duration{0, -TOTPPeriod, TOTPPeriod} {
+		c, err := TOTP(secret, t.Add(skew))
+		if err == nil && hmac.Equal([]byte(c), []byte(code)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package securitytest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestTOTP tests the SHA1 test vectors of RFC 6238, appendix B.
+func TestTOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "94287082"},
+		{unix: 1111111109, code: "07081804"},
+		{unix: 1111111111, code: "14050471"},
+		{unix: 1234567890, code: "89005924"},
+		{unix: 2000000000, code: "69279037"},
+		{unix: 20000000000, code: "65353130"},
+	}
+
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d %d", i, tc.unix), func(t *testing.T) {
+			code := totp(key, time.Unix(tc.unix, 0), 8)
+			if code != tc.code {
+				t.Errorf("expected '%v' got '%v'", tc.code, code)
+			}
+		})
+	}
+
+	// the base32 encoding of the key
+	code, err := TOTP("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", time.Unix(59, 0))
+	if err != nil || code != "287082" {
+		t.Errorf("expected '%v' got '%v' %v", "287082", code, err)
+	}
+	_, err = TOTP("not base32!", time.Now())
+	if err == nil {
+		t.Errorf("expected an error for an invalid secret")
+	}
+}
+
+func TestValidTOTP(t *testing.T) {
+	secret := NewTOTPSecret()
+	now := time.Now()
+	for _, skew := range []time.Duration{-TOTPPeriod, 0, TOTPPeriod} {
+		code, _ := TOTP(secret, now.Add(skew))
+		if !validTOTP(secret, code, now) {
+			t.Errorf("expected the code at skew %v to be valid", skew)
+		}
+	}
+	code, _ := TOTP(secret, now.Add(-3*TOTPPeriod))
+	if validTOTP(secret, code, now) {
+		t.Errorf("expected the old code to be invalid")
+	}
+}
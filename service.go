@@ -1,6 +1,7 @@
 package security
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/dottics/dutil"
 	"io"
@@ -8,26 +9,70 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sync"
+	"time"
 )
 
 // Service is the shorthand for the integration to the Security Micro-Service
+//
+// A Service is safe for concurrent use by multiple goroutines. Header and URL
+// are the base configuration shared by all exchanges, every exchange works
+// on its own copy of them. Once a Service is in use they should only be
+// changed through its methods, such as SetURL.
 type Service struct {
-	Header http.Header
-	URL    url.URL
+	Header    http.Header
+	URL       url.URL
+	client    *http.Client
+	retry     RetryPolicy
+	breaker   *CircuitBreaker
+	refresher *refresher
+	onRevoke  func(Revocation)
+	logger    Logger
+	metrics   Metrics
+	tracer    Tracer
+	// mu guards Header and URL
+	mu sync.RWMutex
 }
 
+// NewService creates a Service for the user with the token, the location of
+// the security service is read from the environment. NewService is the
+// shorthand for
+//
+//	NewServiceWithOptions(WithEnv(), WithToken(token))
 func NewService(token string) *Service {
+	return NewServiceWithOptions(WithEnv(), WithToken(token))
+}
+
+// NewServiceWithOptions creates a Service configured by the options opts.
+// Without any options the Service has no URL set and makes exchanges with a
+// default http.Client and the DefaultRetryPolicy.
+func NewServiceWithOptions(opts ...Option) *Service {
+	o := &options{
+		header: make(http.Header),
+		retry:  DefaultRetryPolicy(),
+		logger: NewStdLogger(log.Default()),
+	}
+	// default microservice required headers
+	o.header.Set("Content-Type", "application/json")
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	s := &Service{
 		URL: url.URL{
-			Scheme: os.Getenv("SECURITY_SERVICE_SCHEME"),
-			Host:   os.Getenv("SECURITY_SERVICE_HOST"),
+			Scheme: o.scheme,
+			Host:   o.host,
 		},
-		Header: make(http.Header),
+		Header:    o.header,
+		client:    o.httpClient(),
+		retry:     o.retry,
+		breaker:   o.breaker,
+		refresher: o.refresher,
+		onRevoke:  o.onRevoke,
+		logger:    o.logger,
+		metrics:   o.metrics,
+		tracer:    o.tracer,
 	}
-	// default microservice required headers
-	(*s).Header.Set("Content-Type", "application/json")
-	(*s).Header.Set("X-User-Token", token)
-
 	return s
 }
 
@@ -35,6 +80,8 @@ func NewService(token string) *Service {
 // the micro-service. SetURL is also the interface function that makes it a
 // mock service
 func (s *Service) SetURL(sc string, h string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.URL.Scheme = sc
 	s.URL.Host = h
 }
@@ -44,6 +91,8 @@ func (s *Service) SetURL(sc string, h string) {
 // Mostly used for testing when the Env Vars need to be set dynamically when
 // service instances need to be mocked in tests
 func (s *Service) SetEnv() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	err := os.Setenv("SECURITY_SERVICE_SCHEME", s.URL.Scheme)
 	if err != nil {
 		return err
@@ -55,40 +104,189 @@ func (s *Service) SetEnv() error {
 	return nil
 }
 
+// StatusClientClosedRequest is the status used for exchanges that were
+// abandoned because the caller's context was cancelled. It follows the
+// nginx convention of 499 as there is no standard HTTP status for it.
+const StatusClientClosedRequest = 499
+
 // NewRequest consistently maps and executes requests to the security service
 // and returns the response
 func (s *Service) NewRequest(method string, target string, headers map[string][]string, payload io.Reader) (*http.Response, dutil.Error) {
-	client := http.Client{}
-	req, err := http.NewRequest(method, target, payload)
+	return s.NewRequestContext(context.Background(), method, target, headers, payload)
+}
+
+// NewRequestContext is NewRequest bound to the context ctx. Cancellation,
+// deadlines and values of ctx are carried to the outgoing request, and if
+// the exchange is abandoned because of ctx the error is keyed "context"
+// rather than "request". Failed attempts are retried according to the
+// RetryPolicy of the Service, and unauthorised exchanges are refreshed if
+// the Service was created WithAutoRefresh. The exchange is observed by the
+// Metrics and traced by the Tracer of the Service, if it has any, and the
+// request ID and trace context carried by ctx are propagated.
+func (s *Service) NewRequestContext(ctx context.Context, method string, target string, headers map[string][]string, payload io.Reader) (*http.Response, dutil.Error) {
+	ctx, span := s.startSpan(ctx, method)
+	start := time.Now()
+	var res *http.Response
+	var e dutil.Error
+	if s.refreshable(ctx, headers) {
+		res, e = s.sendRefreshing(ctx, method, target, headers, payload)
+	} else {
+		res, e = s.send(ctx, method, target, headers, payload)
+	}
+	s.observe(ctx, method, start, res, e)
+	endSpan(span, res, e)
+	return res, e
+}
+
+// send makes the exchange, retrying failed attempts according to the
+// RetryPolicy of the Service. A probe is not retried, as every attempt of a
+// probe through an open circuit breaker would open it again.
+func (s *Service) send(ctx context.Context, method string, target string, headers map[string][]string, payload io.Reader) (*http.Response, dutil.Error) {
+	attempts := s.retry.attempts(ctx, method)
+	if attempts == 1 || isProbe(ctx) {
+		return s.do(ctx, method, target, headers, payload)
+	}
+
+	body, e := replayable(payload)
+	if e != nil {
+		return nil, e
+	}
+	for attempt := 1; ; attempt++ {
+		res, e := s.do(withAttempt(ctx, attempt), method, target, headers, body())
+		if attempt == attempts || !s.retry.retryable(ctx, res, e) {
+			return res, e
+		}
+		d, ok := s.retry.backoff(attempt, res)
+		if !ok {
+			return res, e
+		}
+		if res != nil {
+			discard(res)
+		}
+		if err := sleep(ctx, d); err != nil {
+			return nil, requestErr(ctx, err)
+		}
+	}
+}
+
+// do makes a single attempt of an exchange through the circuit breaker of
+// the Service, if it has one.
+func (s *Service) do(ctx context.Context, method string, target string, headers map[string][]string, payload io.Reader) (*http.Response, dutil.Error) {
+	if s.breaker == nil {
+		return s.attempt(ctx, method, target, headers, payload)
+	}
+	if !s.breaker.allow(isProbe(ctx)) {
+		return nil, newCircuitOpenError()
+	}
+	res, e := s.attempt(ctx, method, target, headers, payload)
+	s.breaker.done(outcomeOf(ctx, res, e))
+	return res, e
+}
+
+// attempt makes a single attempt of an exchange.
+func (s *Service) attempt(ctx context.Context, method string, target string, headers map[string][]string, payload io.Reader) (*http.Response, dutil.Error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, payload)
 	if err != nil {
-		e := dutil.NewErr(500, "request", []string{err.Error()})
+		e := newTransportError(500, "request", err)
 		return nil, e
 	}
-	// set the default security service headers
-	req.Header = s.Header
+	// set the default security service headers, the headers are copied so
+	// that the additional headers do not leak into other exchanges
+	s.mu.RLock()
+	req.Header = s.Header.Clone()
+	s.mu.RUnlock()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if key := idempotencyKey(ctx); key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	propagate(ctx, req.Header)
+	if s.tracer != nil {
+		s.tracer.Inject(ctx, req.Header)
+	}
 	// set/override additional headers iff necessary
 	for key, values := range headers {
 		req.Header.Set(key, values[0])
 	}
-	res, err := client.Do(req)
-	log.Printf("- security-service -> [ %v %v ] <- %d",
-		req.Method, req.URL.String(), res.StatusCode)
+	start := time.Now()
+	res, err := s.httpClient().Do(req)
+	if s.logger != nil {
+		s.logger.LogExchange(ctx, newExchangeRecord(ctx, req, res, time.Since(start), err))
+	}
 	if err != nil {
-		e := dutil.NewErr(500, "request", []string{err.Error()})
-		return nil, e
+		return nil, requestErr(ctx, err)
 	}
 	return res, nil
 }
 
+// endpoint returns a copy of the base URL of the security service with the
+// path and query set. The copy is owned by the caller so that concurrent
+// exchanges do not change each other's URL.
+func (s *Service) endpoint(path string, query url.Values) url.URL {
+	s.mu.RLock()
+	u := s.URL
+	s.mu.RUnlock()
+	u.Path = path
+	u.RawQuery = query.Encode()
+	return u
+}
+
+// httpClient returns the client used to make the exchanges, a Service that
+// was not created by a constructor uses http.DefaultClient.
+func (s *Service) httpClient() *http.Client {
+	if s.client == nil {
+		return http.DefaultClient
+	}
+	return s.client
+}
+
+// detachedContext is a context which carries the values of its parent but
+// not its cancellation or deadline.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// detach returns a context with the values of ctx which is cancelled after
+// the timeout rather than with ctx, for work shared by several callers
+// which must not fail because the caller that started it went away.
+func detach(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(detachedContext{ctx}, timeout)
+}
+
+// requestErr maps the error of a failed exchange to a TransportError. If
+// the exchange failed because ctx was cancelled or its deadline expired,
+// the error is keyed "context" with the status StatusClientClosedRequest or
+// http.StatusGatewayTimeout respectively.
+func requestErr(ctx context.Context, err error) dutil.Error {
+	switch ctx.Err() {
+	case context.Canceled:
+		return newTransportError(StatusClientClosedRequest, "context", err)
+	case context.DeadlineExceeded:
+		return newTransportError(http.StatusGatewayTimeout, "context", err)
+	}
+	return newTransportError(500, "request", err)
+}
+
 // decode id a function that decodes a body into a slice of bytes and
 // error if there is one. Of the interface pointer value is given then
 // unmarshal the slice of bytes into the value pointed to by the
 // interface and return the slice of bytes.
 func (s *Service) decode(res *http.Response, v interface{}) ([]byte, dutil.Error) {
 	xb, err := io.ReadAll(res.Body)
-	err = res.Body.Close()
+	if cerr := res.Body.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
-		e := dutil.NewErr(500, "decode", []string{err.Error()})
+		e := newDecodeError("decode", err)
 		return []byte{}, e
 	}
 	//log.Printf("SECURITY SERVICE DECODE: %s\n", xb)
@@ -96,7 +294,7 @@ func (s *Service) decode(res *http.Response, v interface{}) ([]byte, dutil.Error
 	if v != nil {
 		err = json.Unmarshal(xb, v)
 		if err != nil {
-			e := dutil.NewErr(500, "marshal", []string{err.Error()})
+			e := newDecodeError("marshal", err)
 			return []byte{}, e
 		}
 	}
@@ -104,15 +302,48 @@ func (s *Service) decode(res *http.Response, v interface{}) ([]byte, dutil.Error
 }
 
 // GetHome is a PING function to test connection to the Security Micro-Service
-// is healthy.
+// is healthy. GetHome is let through an open circuit breaker as a probe, if
+// the security service is healthy the breaker is closed.
 func (s *Service) GetHome() (bool, dutil.Error) {
-	res, err := http.Get(s.URL.String())
-	if err != nil {
-		e := dutil.NewErr(500, "request", []string{err.Error()})
+	return s.GetHomeContext(context.Background())
+}
+
+// GetHomeContext is GetHome bound to the context ctx.
+func (s *Service) GetHomeContext(ctx context.Context) (bool, dutil.Error) {
+	ctx = withOperation(ctx, "get_home")
+	u := s.endpoint("", nil)
+	res, e := s.NewRequestContext(withProbe(ctx), "GET", u.String(), nil, nil)
+	if e != nil {
 		return false, e
 	}
+	_ = res.Body.Close()
 	if res.StatusCode == 200 {
 		return true, nil
 	}
 	return false, nil
 }
+
+// statusExchange makes an exchange with the security microservice of which
+// only the success of the response matters.
+func (s *Service) statusExchange(ctx context.Context, method string, target string, payload io.Reader) dutil.Error {
+	resp := struct {
+		Message string              `json:"message"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	res, e := s.NewRequestContext(ctx, method, target, nil, payload)
+	if e != nil {
+		return e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return e
+	}
+
+	if res.StatusCode != 200 {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return e
+	}
+
+	return nil
+}
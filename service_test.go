@@ -1,15 +1,21 @@
 package security
 
 import (
+	"context"
+	"fmt"
 	"github.com/dottics/dutil"
+	"github.com/google/uuid"
 	"github.com/johannesscr/micro/microtest"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewService(t *testing.T) {
@@ -295,3 +301,150 @@ func TestService_GetHome(t *testing.T) {
 		})
 	}
 }
+
+// TestService_NewRequestContext tests that a cancelled context or an
+// expired deadline is reported as a context error rather than a generic
+// request error.
+func TestService_NewRequestContext(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(block)
+
+	s := NewService("")
+	s.SetURL("http", strings.TrimPrefix(server.URL, "http://"))
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		e    dutil.Error
+	}{
+		{
+			name: "cancelled",
+			ctx:  cancelled,
+			e: &dutil.Err{
+				Status: StatusClientClosedRequest,
+			},
+		},
+		{
+			name: "deadline exceeded",
+			ctx:  expired,
+			e: &dutil.Err{
+				Status: 504,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res, e := s.NewRequestContext(tc.ctx, "GET", s.URL.String(), nil, nil)
+			if res != nil {
+				t.Errorf("expected nil response got %v", res)
+			}
+			if e == nil {
+				t.Fatalf("expected error got nil")
+			}
+			err := dutil.Inst(e)
+			if err.Status != dutil.Inst(tc.e).Status {
+				t.Errorf("expected status %d got %d", dutil.Inst(tc.e).Status, err.Status)
+			}
+			if _, ok := err.Errors["context"]; !ok {
+				t.Errorf("expected context error got %v", err.Errors)
+			}
+		})
+	}
+}
+
+// TestService_concurrent tests that a single Service can be shared by many
+// goroutines. It is intended to be run with the race detector enabled.
+func TestService_concurrent(t *testing.T) {
+	var mu sync.Mutex
+	leaked := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// X-Random is only set by the /random exchanges, each with its own
+		// value which it also sends as the query
+		mu.Lock()
+		random := r.Header.Get("X-Random")
+		if (r.URL.Path != "/random" && random != "") || (r.URL.Path == "/random" && random != r.URL.Query().Get("i")) {
+			leaked++
+		}
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/login":
+			w.Header().Set("X-User-Token", "token")
+			_, _ = w.Write([]byte(`{"message":"login successful","data":{"user":{"uuid":"9b615709-cc9a-48c3-b1ea-a04d4375ea86"},"permission":["abcd"]},"errors":{}}`))
+		case "/reset-password/token":
+			_, _ = w.Write([]byte(`{"message":"password reset token successful","data":{"password_reset_token":"f7c349f6-fbde-4241-871d-6a20827ef74e"},"errors":null}`))
+		default:
+			_, _ = w.Write([]byte(`{"message":"successful","data":{},"errors":{}}`))
+		}
+	}))
+	defer server.Close()
+
+	s := NewService("my-very-secure-token")
+	host := strings.TrimPrefix(server.URL, "http://")
+	s.SetURL("http", host)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := context.Background()
+			s.SetURL("http", host)
+
+			_, _, _, e := s.LoginContext(ctx, strings.NewReader(`{"email":"tp@test.dottics.com","password":"password123"}`))
+			if e != nil {
+				t.Errorf("login: unexpected error: %v", e)
+			}
+			if e := s.LogoutContext(ctx); e != nil {
+				t.Errorf("logout: unexpected error: %v", e)
+			}
+			_, e = s.PasswordResetTokenContext(ctx, PasswordResetTokenPayload{Email: "tp@test.dottics.com"})
+			if e != nil {
+				t.Errorf("password reset token: unexpected error: %v", e)
+			}
+			e = s.ResetPasswordContext(ctx, ResetPasswordPayload{Email: "tp@test.dottics.com"})
+			if e != nil {
+				t.Errorf("reset password: unexpected error: %v", e)
+			}
+			e = s.RevokePasswordResetTokenContext(ctx, uuid.New())
+			if e != nil {
+				t.Errorf("revoke password reset token: unexpected error: %v", e)
+			}
+			h := map[string][]string{
+				"X-Random": {fmt.Sprintf("%d", i)},
+			}
+			res, e := s.NewRequestContext(ctx, "GET", fmt.Sprintf("%s/random?i=%d", server.URL, i), h, nil)
+			if e != nil {
+				t.Errorf("new request: unexpected error: %v", e)
+			} else {
+				_ = res.Body.Close()
+			}
+			if _, e := s.GetHomeContext(ctx); e != nil {
+				t.Errorf("get home: unexpected error: %v", e)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if leaked != 0 {
+		t.Errorf("expected no headers to leak between exchanges got %d", leaked)
+	}
+	if s.Header.Get("X-Random") != "" {
+		t.Errorf("expected the base headers to be unchanged got X-Random '%v'", s.Header.Get("X-Random"))
+	}
+	if s.URL.Path != "" || s.URL.RawQuery != "" {
+		t.Errorf("expected the base URL to be unchanged got '%v'", s.URL.String())
+	}
+}
@@ -0,0 +1,94 @@
+package security
+
+import (
+	"context"
+	"github.com/dottics/dutil"
+	"github.com/google/uuid"
+	"net/url"
+	"strconv"
+)
+
+// ListSessions handles the exchange with the security microservice to list
+// the sessions of the user with the UUID, with the device and IP address
+// each session was created from and when it was last seen.
+func (s *Service) ListSessions(userUUID uuid.UUID) ([]Session, dutil.Error) {
+	return s.ListSessionsContext(context.Background(), userUUID)
+}
+
+// ListSessionsContext is ListSessions bound to the context ctx.
+func (s *Service) ListSessionsContext(ctx context.Context, userUUID uuid.UUID) ([]Session, dutil.Error) {
+	ctx = withOperation(ctx, "list_sessions")
+	u := s.endpoint("/users/"+userUUID.String()+"/sessions", nil)
+
+	type data struct {
+		Sessions []Session `json:"sessions"`
+	}
+	resp := struct {
+		Message string              `json:"message"`
+		Data    data                `json:"data"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	res, e := s.NewRequestContext(ctx, "GET", u.String(), nil, nil)
+	if e != nil {
+		return nil, e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return nil, e
+	}
+
+	if res.StatusCode != 200 {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return nil, e
+	}
+
+	return resp.Data.Sessions, nil
+}
+
+// RevokeSession handles the exchange with the security microservice to
+// revoke the session with the ID, the token of the session can no longer
+// be used.
+func (s *Service) RevokeSession(sessionID string) dutil.Error {
+	return s.RevokeSessionContext(context.Background(), sessionID)
+}
+
+// RevokeSessionContext is RevokeSession bound to the context ctx.
+func (s *Service) RevokeSessionContext(ctx context.Context, sessionID string) dutil.Error {
+	ctx = withOperation(ctx, "revoke_session")
+	u := s.endpoint("/sessions/"+url.PathEscape(sessionID), nil)
+	e := s.statusExchange(ctx, "DELETE", u.String(), nil)
+	if e != nil {
+		return e
+	}
+	s.revoked(Revocation{SessionID: sessionID})
+	return nil
+}
+
+// RevokeAllSessions handles the exchange with the security microservice to
+// revoke all the sessions of the user with the UUID. If exceptCurrent is
+// true the session of the token in the header of the Service is kept, so
+// that a user can sign out everywhere else.
+func (s *Service) RevokeAllSessions(userUUID uuid.UUID, exceptCurrent bool) dutil.Error {
+	return s.RevokeAllSessionsContext(context.Background(), userUUID, exceptCurrent)
+}
+
+// RevokeAllSessionsContext is RevokeAllSessions bound to the context ctx.
+func (s *Service) RevokeAllSessionsContext(ctx context.Context, userUUID uuid.UUID, exceptCurrent bool) dutil.Error {
+	ctx = withOperation(ctx, "revoke_all_sessions")
+	qs := url.Values{}
+	if exceptCurrent {
+		qs.Set("except_current", strconv.FormatBool(exceptCurrent))
+	}
+	u := s.endpoint("/users/"+userUUID.String()+"/sessions", qs)
+	e := s.statusExchange(ctx, "DELETE", u.String(), nil)
+	if e != nil {
+		return e
+	}
+	r := Revocation{UserUUID: userUUID}
+	if exceptCurrent {
+		r.Except = s.Token()
+	}
+	s.revoked(r)
+	return nil
+}
@@ -0,0 +1,157 @@
+package security
+
+import (
+	"fmt"
+	"github.com/dottics/dutil"
+	"github.com/google/uuid"
+	"github.com/johannesscr/micro/microtest"
+	"testing"
+	"time"
+)
+
+func TestService_ListSessions(t *testing.T) {
+	userUUID := uuid.MustParse("9b615709-cc9a-48c3-b1ea-a04d4375ea86")
+	createdAt := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		exchange *microtest.Exchange
+		sessions []Session
+		e        dutil.Error
+	}{
+		{
+			name: "forbidden",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 403,
+					Body:   `{"message":"Forbidden","data":{},"errors":{"permission":["missing permission"]}}`,
+				},
+			},
+			e: &dutil.Err{
+				Status: 403,
+				Errors: map[string][]string{
+					"permission": {"missing permission"},
+				},
+			},
+		},
+		{
+			name: "sessions",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 200,
+					Body:   `{"message":"sessions","data":{"sessions":[{"id":"a1","device":"curl/7.79","ip":"10.0.0.1","created_at":"2022-03-01T10:00:00Z","last_seen_at":"2022-03-01T10:00:00Z","current":true}]},"errors":{}}`,
+				},
+			},
+			sessions: []Session{
+				{ID: "a1", Device: "curl/7.79", IP: "10.0.0.1", CreatedAt: createdAt, LastSeenAt: createdAt, Current: true},
+			},
+		},
+	}
+
+	s := NewService("my-very-secure-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			xs, e := s.ListSessions(userUUID)
+			if !dutil.ErrorEqual(e, tc.e) {
+				t.Errorf("expected error %v got %v", tc.e, e)
+			}
+			if len(xs) != len(tc.sessions) {
+				t.Fatalf("expected %d sessions got %d", len(tc.sessions), len(xs))
+			}
+			for j := range xs {
+				if xs[j] != tc.sessions[j] {
+					t.Errorf("expected '%v' got '%v'", tc.sessions[j], xs[j])
+				}
+			}
+			r := tc.exchange.Request
+			if r.Method != "GET" || r.URL.Path != "/users/9b615709-cc9a-48c3-b1ea-a04d4375ea86/sessions" {
+				t.Errorf("unexpected request '%v %v'", r.Method, r.URL.Path)
+			}
+		})
+	}
+}
+
+func TestService_RevokeSession(t *testing.T) {
+	userUUID := uuid.MustParse("9b615709-cc9a-48c3-b1ea-a04d4375ea86")
+
+	tests := []struct {
+		name     string
+		call     func(s *Service) dutil.Error
+		path     string
+		query    string
+		exchange *microtest.Exchange
+		e        dutil.Error
+	}{
+		{
+			name: "session not found",
+			call: func(s *Service) dutil.Error { return s.RevokeSession("a1") },
+			path: "/sessions/a1",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 404,
+					Body:   `{"message":"NotFound","data":{},"errors":{"session":["not found"]}}`,
+				},
+			},
+			e: &dutil.Err{
+				Status: 404,
+				Errors: map[string][]string{
+					"session": {"not found"},
+				},
+			},
+		},
+		{
+			name: "revoke session",
+			call: func(s *Service) dutil.Error { return s.RevokeSession("a1") },
+			path: "/sessions/a1",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{Status: 200, Body: `{"message":"session revoked","data":{},"errors":{}}`},
+			},
+		},
+		{
+			name: "revoke all sessions",
+			call: func(s *Service) dutil.Error { return s.RevokeAllSessions(userUUID, false) },
+			path: "/users/9b615709-cc9a-48c3-b1ea-a04d4375ea86/sessions",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{Status: 200, Body: `{"message":"sessions revoked","data":{},"errors":{}}`},
+			},
+		},
+		{
+			name:  "revoke all sessions except current",
+			call:  func(s *Service) dutil.Error { return s.RevokeAllSessions(userUUID, true) },
+			path:  "/users/9b615709-cc9a-48c3-b1ea-a04d4375ea86/sessions",
+			query: "except_current=true",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{Status: 200, Body: `{"message":"sessions revoked","data":{},"errors":{}}`},
+			},
+		},
+	}
+
+	s := NewService("my-very-secure-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			e := tc.call(s)
+			if !dutil.ErrorEqual(e, tc.e) {
+				t.Errorf("expected error %v got %v", tc.e, e)
+			}
+			r := tc.exchange.Request
+			if r.Method != "DELETE" || r.URL.Path != tc.path {
+				t.Errorf("expected 'DELETE %v' got '%v %v'", tc.path, r.Method, r.URL.Path)
+			}
+			if r.URL.RawQuery != tc.query {
+				t.Errorf("expected query '%v' got '%v'", tc.query, r.URL.RawQuery)
+			}
+		})
+	}
+}
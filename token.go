@@ -0,0 +1,97 @@
+package security
+
+import (
+	"context"
+	"github.com/dottics/dutil"
+	"time"
+)
+
+// ValidateToken asks the security microservice whether the user token is
+// valid. The token is sent as the X-User-Token header in place of the token
+// of the Service. If the token is valid the user, permission codes, expiry
+// and session of the token are returned.
+func (s *Service) ValidateToken(token string) (TokenInfo, dutil.Error) {
+	return s.ValidateTokenContext(context.Background(), token)
+}
+
+// ValidateTokenContext is ValidateToken bound to the context ctx.
+func (s *Service) ValidateTokenContext(ctx context.Context, token string) (TokenInfo, dutil.Error) {
+	ctx = withOperation(ctx, "validate_token")
+	u := s.endpoint("/token/validate", nil)
+
+	resp := struct {
+		Message string              `json:"message"`
+		Data    TokenInfo           `json:"data"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	h := map[string][]string{
+		"X-User-Token": {token},
+	}
+	res, e := s.NewRequestContext(ctx, "GET", u.String(), h, nil)
+	if e != nil {
+		return TokenInfo{}, e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return TokenInfo{}, e
+	}
+
+	if res.StatusCode != 200 {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return TokenInfo{}, e
+	}
+
+	return resp.Data, nil
+}
+
+// RefreshToken handles the exchange with the security microservice to
+// renew a user token with the refresh token. The new user token is returned
+// with, if the security microservice rotates refresh tokens, a new refresh
+// token which replaces the refresh token given.
+func (s *Service) RefreshToken(refreshToken string) (TokenPair, dutil.Error) {
+	return s.RefreshTokenContext(context.Background(), refreshToken)
+}
+
+// RefreshTokenContext is RefreshToken bound to the context ctx.
+func (s *Service) RefreshTokenContext(ctx context.Context, refreshToken string) (TokenPair, dutil.Error) {
+	ctx = withOperation(ctx, "refresh_token")
+	u := s.endpoint("/token/refresh", nil)
+
+	type data struct {
+		RefreshToken string    `json:"refresh_token"`
+		ExpiresAt    time.Time `json:"expires_at"`
+	}
+	resp := struct {
+		Message string              `json:"message"`
+		Data    data                `json:"data"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	payload, e := dutil.MarshalReader(RefreshTokenPayload{RefreshToken: refreshToken})
+	if e != nil {
+		return TokenPair{}, e
+	}
+
+	// a refresh must not itself trigger a refresh
+	res, e := s.NewRequestContext(withoutRefresh(ctx), "POST", u.String(), nil, payload)
+	if e != nil {
+		return TokenPair{}, e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return TokenPair{}, e
+	}
+
+	if res.StatusCode != 200 {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return TokenPair{}, e
+	}
+
+	pair := TokenPair{
+		Token:        res.Header.Get("X-User-Token"),
+		RefreshToken: resp.Data.RefreshToken,
+		ExpiresAt:    resp.Data.ExpiresAt,
+	}
+	return pair, nil
+}
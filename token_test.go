@@ -0,0 +1,176 @@
+package security
+
+import (
+	"fmt"
+	"github.com/dottics/dutil"
+	"github.com/google/uuid"
+	"github.com/johannesscr/micro/microtest"
+	"testing"
+	"time"
+)
+
+func TestService_ValidateToken(t *testing.T) {
+	type E struct {
+		info TokenInfo
+		e    dutil.Error
+	}
+	tests := []struct {
+		name     string
+		token    string
+		exchange *microtest.Exchange
+		E        E
+	}{
+		{
+			name:  "unauthorised",
+			token: "expired-token",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 401,
+					Body:   `{"message":"Unauthorised: unable to process request","data":{},"errors":{"auth":["Token expired","Please login"]}}`,
+				},
+			},
+			E: E{
+				info: TokenInfo{},
+				e: &dutil.Err{
+					Status: 401,
+					Errors: map[string][]string{
+						"auth": {"Token expired", "Please login"},
+					},
+				},
+			},
+		},
+		{
+			name:  "valid token",
+			token: "some-long-jwt-encrypted-token",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 200,
+					Body:   `{"message":"token valid","data":{"user":{"uuid":"9b615709-cc9a-48c3-b1ea-a04d4375ea86","first_name":"james","last_name":"bond","active":true},"permission":["abcd","1234"],"expires_at":"2022-05-01T12:00:00Z","session_id":"3f0a3e1c"},"errors":{}}`,
+				},
+			},
+			E: E{
+				info: TokenInfo{
+					User: User{
+						UUID:      uuid.MustParse("9b615709-cc9a-48c3-b1ea-a04d4375ea86"),
+						FirstName: "james",
+						LastName:  "bond",
+						Active:    true,
+					},
+					PermissionCodes: PermissionCodes{"abcd", "1234"},
+					ExpiresAt:       time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC),
+					SessionID:       "3f0a3e1c",
+				},
+				e: nil,
+			},
+		},
+	}
+
+	s := NewService("service-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			info, e := s.ValidateToken(tc.token)
+			if !dutil.ErrorEqual(e, tc.E.e) {
+				t.Errorf("expected error %v got %v", tc.E.e, e)
+			}
+			// the token being validated replaces the token of the service
+			reqToken := tc.exchange.Request.Header.Get("X-User-Token")
+			if reqToken != tc.token {
+				t.Errorf("expected '%v' got '%v'", tc.token, reqToken)
+			}
+			if tc.exchange.Request.URL.Path != "/token/validate" {
+				t.Errorf("expected '%v' got '%v'", "/token/validate", tc.exchange.Request.URL.Path)
+			}
+			if info.User != tc.E.info.User {
+				t.Errorf("expected user %v got %v", tc.E.info.User, info.User)
+			}
+			if len(info.PermissionCodes) != len(tc.E.info.PermissionCodes) {
+				t.Errorf("expected permission codes %v got %v", tc.E.info.PermissionCodes, info.PermissionCodes)
+			}
+			if !info.ExpiresAt.Equal(tc.E.info.ExpiresAt) {
+				t.Errorf("expected expiry %v got %v", tc.E.info.ExpiresAt, info.ExpiresAt)
+			}
+			if info.SessionID != tc.E.info.SessionID {
+				t.Errorf("expected session '%v' got '%v'", tc.E.info.SessionID, info.SessionID)
+			}
+		})
+	}
+}
+
+func TestService_RefreshToken(t *testing.T) {
+	type E struct {
+		pair TokenPair
+		e    dutil.Error
+	}
+	tests := []struct {
+		name     string
+		exchange *microtest.Exchange
+		E        E
+	}{
+		{
+			name: "invalid refresh token",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 401,
+					Body:   `{"message":"Unauthorised: unable to process request","data":{},"errors":{"auth":["Invalid refresh token","Please login"]}}`,
+				},
+			},
+			E: E{
+				pair: TokenPair{},
+				e: &dutil.Err{
+					Status: 401,
+					Errors: map[string][]string{
+						"auth": {"Invalid refresh token", "Please login"},
+					},
+				},
+			},
+		},
+		{
+			name: "token refreshed",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 200,
+					Header: map[string][]string{
+						"X-User-Token": {"new-user-token"},
+					},
+					Body: `{"message":"token refresh successful","data":{"refresh_token":"new-refresh-token","expires_at":"2022-05-01T12:00:00Z"},"errors":{}}`,
+				},
+			},
+			E: E{
+				pair: TokenPair{
+					Token:        "new-user-token",
+					RefreshToken: "new-refresh-token",
+					ExpiresAt:    time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC),
+				},
+				e: nil,
+			},
+		},
+	}
+
+	s := NewService("")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			pair, e := s.RefreshToken("refresh-token")
+			if !dutil.ErrorEqual(e, tc.E.e) {
+				t.Errorf("expected error %v got %v", tc.E.e, e)
+			}
+			if pair != tc.E.pair {
+				t.Errorf("expected %v got %v", tc.E.pair, pair)
+			}
+			if tc.exchange.Request.URL.Path != "/token/refresh" {
+				t.Errorf("expected '%v' got '%v'", "/token/refresh", tc.exchange.Request.URL.Path)
+			}
+		})
+	}
+}
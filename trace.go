@@ -0,0 +1,220 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Tracer creates a client span for every exchange of a Service and
+// propagates it to the security microservice, see WithTracer. It is small
+// enough to be backed by OpenTelemetry, see the securityotel package.
+type Tracer interface {
+	// Extract returns a copy of ctx that carries the remote parent of the
+	// propagation headers, such as traceparent and tracestate, of an
+	// incoming request, so that the span started with it continues the
+	// trace. It is called with the trace context carried by ctx, see
+	// WithTraceContext, before Start.
+	Extract(ctx context.Context, header http.Header) context.Context
+	// Start starts the span named name as a child of the span carried by
+	// ctx, if any, and returns a copy of ctx that carries the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+	// Inject sets the propagation headers of the span carried by ctx, such
+	// as traceparent and tracestate, on the header of an outgoing request.
+	Inject(ctx context.Context, header http.Header)
+}
+
+// Span is the span of an exchange created by a Tracer. A span is ended
+// once, after which it is not used again.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// Attribute is an attribute of a Span, of which the Value is a string, an
+// int or a bool.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// The attributes of the span of an exchange.
+const (
+	// AttributeOperation is the name of the operation of the exchange,
+	// such as "login", see Observation.
+	AttributeOperation = "security.operation"
+	// AttributeMethod is the HTTP method of the exchange.
+	AttributeMethod = "http.method"
+	// AttributeStatus is the status of the response, if any.
+	AttributeStatus = "http.status_code"
+	// AttributeErrorCategory is the category of the error of an exchange
+	// that did not succeed: "client" or "server" for 4xx and 5xx
+	// responses, and "circuit_open", "context" or "transport" for an
+	// exchange without a response.
+	AttributeErrorCategory = "security.error_category"
+)
+
+// WithTracer sets the Tracer of the exchanges of the Service. A Service has
+// no Tracer by default, in which case the trace context and request ID
+// carried by the context of an exchange are still propagated. With a Tracer
+// the span of an exchange is the child of the trace context carried by the
+// context, and its own trace context is propagated instead.
+func WithTracer(t Tracer) Option {
+	return func(o *options) {
+		o.tracer = t
+	}
+}
+
+// traceContext is the W3C trace context of an incoming request.
+type traceContext struct {
+	traceParent string
+	traceState  string
+}
+
+// WithTraceContext returns a copy of ctx that carries the W3C traceparent
+// and tracestate headers to send to the security microservice. An invalid
+// traceParent is ignored.
+func WithTraceContext(ctx context.Context, traceParent string, traceState string) context.Context {
+	if !validTraceParent(traceParent) {
+		return ctx
+	}
+	return context.WithValue(ctx, traceContextKey, traceContext{traceParent, traceState})
+}
+
+// WithRequestID returns a copy of ctx that carries the request ID to send
+// to the security microservice as the X-Request-ID header.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestIDFromContext returns the request ID carried by ctx and whether
+// ctx carries one.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	requestID, ok := ctx.Value(requestIDKey).(string)
+	return requestID, ok && requestID != ""
+}
+
+// PropagationContext returns the context of the incoming request r which
+// carries the X-Request-ID, traceparent and tracestate headers of r, so
+// that they are propagated by the exchanges made with it. Middleware adds
+// them to the context of the requests it lets through.
+func PropagationContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if requestID := r.Header.Get("X-Request-ID"); requestID != "" {
+		ctx = WithRequestID(ctx, requestID)
+	}
+	return WithTraceContext(ctx, r.Header.Get("traceparent"), r.Header.Get("tracestate"))
+}
+
+// propagate sets the X-Request-ID, traceparent and tracestate headers
+// carried by ctx on the header of an outgoing request.
+func propagate(ctx context.Context, header http.Header) {
+	if requestID, ok := RequestIDFromContext(ctx); ok {
+		header.Set("X-Request-ID", requestID)
+	}
+	propagateTrace(ctx, header)
+}
+
+// propagateTrace sets the traceparent and tracestate headers carried by ctx
+// on the header and reports whether ctx carries them.
+func propagateTrace(ctx context.Context, header http.Header) bool {
+	tc, ok := ctx.Value(traceContextKey).(traceContext)
+	if !ok {
+		return false
+	}
+	header.Set("traceparent", tc.traceParent)
+	if tc.traceState != "" {
+		header.Set("tracestate", tc.traceState)
+	}
+	return true
+}
+
+// validTraceParent reports whether v is a valid W3C traceparent of the form
+// version-traceid-parentid-flags, of which the trace and parent IDs are not
+// all zeros.
+func validTraceParent(v string) bool {
+	xs := strings.Split(v, "-")
+	if len(xs) < 4 || len(xs[0]) != 2 || xs[0] == "ff" {
+		return false
+	}
+	// version 00 has exactly four fields, later versions may add fields
+	if xs[0] == "00" && len(xs) != 4 {
+		return false
+	}
+	lengths := []int{2, 32, 16, 2}
+	for i, n := range lengths {
+		if len(xs[i]) != n || !isLowerHex(xs[i]) {
+			return false
+		}
+	}
+	return strings.Trim(xs[1], "0") != "" && strings.Trim(xs[2], "0") != ""
+}
+
+// isLowerHex reports whether s only has lowercase hexadecimal digits.
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// startSpan starts the span of the exchange with the Tracer of the
+// Service, if it has one, as the child of the trace context carried by ctx.
+func (s *Service) startSpan(ctx context.Context, method string) (context.Context, Span) {
+	if s.tracer == nil {
+		return ctx, nil
+	}
+	header := make(http.Header)
+	if propagateTrace(ctx, header) {
+		ctx = s.tracer.Extract(ctx, header)
+	}
+	operation := operationOf(ctx)
+	ctx, span := s.tracer.Start(ctx, "security-service "+operation)
+	span.SetAttributes(
+		Attribute{AttributeOperation, operation},
+		Attribute{AttributeMethod, strings.ToUpper(method)},
+	)
+	return ctx, span
+}
+
+// endSpan ends the span of the exchange of which res, which may be nil, is
+// the response.
+func endSpan(span Span, res *http.Response, e error) {
+	if span == nil {
+		return
+	}
+	if res != nil {
+		span.SetAttributes(Attribute{AttributeStatus, res.StatusCode})
+	}
+	if category := errorCategory(res, e); category != "" {
+		span.SetAttributes(Attribute{AttributeErrorCategory, category})
+	}
+	if e != nil {
+		span.RecordError(e)
+	}
+	span.End()
+}
+
+// errorCategory returns the category of the error of an exchange, or an
+// empty string if the exchange succeeded.
+func errorCategory(res *http.Response, e error) string {
+	switch {
+	case res != nil && res.StatusCode >= 500:
+		return "server"
+	case res != nil && res.StatusCode >= 400:
+		return "client"
+	case res != nil || e == nil:
+		return ""
+	case errors.Is(e, ErrCircuitOpen):
+		return "circuit_open"
+	}
+	var te *TransportError
+	if errors.As(e, &te) && te.Errors["context"] != nil {
+		return "context"
+	}
+	return "transport"
+}
@@ -0,0 +1,351 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dottics/dutil"
+	"github.com/google/uuid"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// traceParent is a valid W3C traceparent.
+const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// recordingSpan is a Span which records its attributes and errors.
+type recordingSpan struct {
+	name       string
+	parent     string
+	attributes map[string]interface{}
+	errs       []error
+	ended      bool
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...Attribute) {
+	for _, attr := range attrs {
+		s.attributes[attr.Key] = attr.Value
+	}
+}
+
+func (s *recordingSpan) RecordError(err error) {
+	s.errs = append(s.errs, err)
+}
+
+func (s *recordingSpan) End() {
+	s.ended = true
+}
+
+// recordingTracer is a Tracer which records its spans and injects the
+// name of the span carried by the context as the traceparent. The parent
+// of a span is the extracted traceparent.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordingSpan
+}
+
+type spanKey struct{}
+
+type parentKey struct{}
+
+func (t *recordingTracer) Extract(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, parentKey{}, header.Get("traceparent"))
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(parentKey{}).(string)
+	span := &recordingSpan{name: name, parent: parent, attributes: make(map[string]interface{})}
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (t *recordingTracer) Inject(ctx context.Context, header http.Header) {
+	if span, ok := ctx.Value(spanKey{}).(*recordingSpan); ok {
+		header.Set("traceparent", span.name)
+	}
+}
+
+func TestValidTraceParent(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		valid bool
+	}{
+		{name: "valid", value: traceParent, valid: true},
+		{name: "later version", value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", valid: true},
+		{name: "empty", value: "", valid: false},
+		{name: "version 00 extra field", value: traceParent + "-extra", valid: false},
+		{name: "invalid version", value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", valid: false},
+		{name: "uppercase", value: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", valid: false},
+		{name: "zero trace id", value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", valid: false},
+		{name: "zero parent id", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", valid: false},
+		{name: "short parent id", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902-01", valid: false},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			if valid := validTraceParent(tc.value); valid != tc.valid {
+				t.Errorf("expected '%v' got '%v'", tc.valid, valid)
+			}
+		})
+	}
+}
+
+func TestService_propagate(t *testing.T) {
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		headers     map[string][]string
+		requestID   string
+		traceParent string
+		traceState  string
+	}{
+		{
+			name: "nothing to propagate",
+			ctx:  context.Background(),
+		},
+		{
+			name:        "request id and trace context",
+			ctx:         WithTraceContext(WithRequestID(context.Background(), "request-1"), traceParent, "dottics=1"),
+			requestID:   "request-1",
+			traceParent: traceParent,
+			traceState:  "dottics=1",
+		},
+		{
+			name: "invalid trace context ignored",
+			ctx:  WithTraceContext(context.Background(), "not a traceparent", "dottics=1"),
+		},
+		{
+			name:        "additional headers take precedence",
+			ctx:         WithRequestID(context.Background(), "request-1"),
+			headers:     map[string][]string{"X-Request-ID": {"request-2"}},
+			requestID:   "request-2",
+			traceParent: "",
+		},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			rs := newRetryServer()
+			defer rs.Close()
+
+			s := rs.service()
+			_, e := s.NewRequestContext(tc.ctx, http.MethodGet, rs.URL+"/home", tc.headers, nil)
+			if e != nil {
+				t.Fatalf("unexpected error: %v", e)
+			}
+
+			h := rs.requests[0].Header
+			if h.Get("X-Request-ID") != tc.requestID {
+				t.Errorf("expected '%v' got '%v'", tc.requestID, h.Get("X-Request-ID"))
+			}
+			if h.Get("traceparent") != tc.traceParent {
+				t.Errorf("expected '%v' got '%v'", tc.traceParent, h.Get("traceparent"))
+			}
+			if h.Get("tracestate") != tc.traceState {
+				t.Errorf("expected '%v' got '%v'", tc.traceState, h.Get("tracestate"))
+			}
+		})
+	}
+}
+
+func TestPropagationContext(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	r.Header.Set("X-Request-ID", "request-1")
+	r.Header.Set("traceparent", traceParent)
+	r.Header.Set("tracestate", "dottics=1")
+
+	ctx := PropagationContext(r)
+	requestID, ok := RequestIDFromContext(ctx)
+	if !ok || requestID != "request-1" {
+		t.Errorf("expected '%v' got '%v'", "request-1", requestID)
+	}
+	h := make(http.Header)
+	propagate(ctx, h)
+	if h.Get("traceparent") != traceParent {
+		t.Errorf("expected '%v' got '%v'", traceParent, h.Get("traceparent"))
+	}
+	if h.Get("tracestate") != "dottics=1" {
+		t.Errorf("expected '%v' got '%v'", "dottics=1", h.Get("tracestate"))
+	}
+
+	_, ok = RequestIDFromContext(PropagationContext(httptest.NewRequest(http.MethodGet, "/users", nil)))
+	if ok {
+		t.Errorf("expected no request id")
+	}
+}
+
+func TestMiddleware_propagate(t *testing.T) {
+	var requestID string
+	validator := TokenValidatorFunc(func(ctx context.Context, token string) (TokenInfo, dutil.Error) {
+		requestID, _ = RequestIDFromContext(ctx)
+		return TokenInfo{User: User{UUID: uuid.New(), Active: true}}, nil
+	})
+	var handlerRequestID string
+	handler := Middleware(MiddlewareConfig{Validator: validator})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerRequestID, _ = RequestIDFromContext(r.Context())
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	r.Header.Set("X-User-Token", "my secret token")
+	r.Header.Set("X-Request-ID", "request-1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if requestID != "request-1" {
+		t.Errorf("expected '%v' got '%v'", "request-1", requestID)
+	}
+	if handlerRequestID != "request-1" {
+		t.Errorf("expected '%v' got '%v'", "request-1", handlerRequestID)
+	}
+}
+
+func TestService_tracer(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		transport  bool
+		attributes map[string]interface{}
+		errs       int
+	}{
+		{
+			name:     "success",
+			statuses: []int{200},
+			attributes: map[string]interface{}{
+				AttributeOperation: "logout",
+				AttributeMethod:    "GET",
+				AttributeStatus:    200,
+			},
+		},
+		{
+			name:     "server error",
+			statuses: []int{503, 503, 503},
+			attributes: map[string]interface{}{
+				AttributeOperation:     "logout",
+				AttributeMethod:        "GET",
+				AttributeStatus:        503,
+				AttributeErrorCategory: "server",
+			},
+		},
+		{
+			name:     "client error",
+			statuses: []int{401},
+			attributes: map[string]interface{}{
+				AttributeOperation:     "logout",
+				AttributeMethod:        "GET",
+				AttributeStatus:        401,
+				AttributeErrorCategory: "client",
+			},
+		},
+		{
+			name:      "transport error",
+			transport: true,
+			attributes: map[string]interface{}{
+				AttributeOperation:     "logout",
+				AttributeMethod:        "GET",
+				AttributeErrorCategory: "transport",
+			},
+			errs: 1,
+		},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			rs := newRetryServer(tc.statuses...)
+			defer rs.Close()
+
+			tracer := &recordingTracer{}
+			s := rs.service()
+			s.tracer = tracer
+			s.logger = NopLogger{}
+			if tc.transport {
+				s.client = &http.Client{Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+					return nil, errors.New("connection refused")
+				})}
+			}
+			_ = s.LogoutContext(WithTraceContext(context.Background(), traceParent, ""))
+
+			if len(tracer.spans) != 1 {
+				t.Fatalf("expected '%v' got '%v'", 1, len(tracer.spans))
+			}
+			span := tracer.spans[0]
+			if span.name != "security-service logout" {
+				t.Errorf("expected '%v' got '%v'", "security-service logout", span.name)
+			}
+			if len(span.attributes) != len(tc.attributes) {
+				t.Errorf("expected '%v' got '%v'", tc.attributes, span.attributes)
+			}
+			for key, value := range tc.attributes {
+				if span.attributes[key] != value {
+					t.Errorf("expected '%v' got '%v'", value, span.attributes[key])
+				}
+			}
+			if len(span.errs) != tc.errs {
+				t.Errorf("expected '%v' got '%v'", tc.errs, len(span.errs))
+			}
+			if !span.ended {
+				t.Errorf("expected the span to be ended")
+			}
+			if span.parent != traceParent {
+				t.Errorf("expected the parent '%v' got '%v'", traceParent, span.parent)
+			}
+			// the span injected by the tracer takes precedence over the
+			// trace context of the context
+			for _, r := range rs.requests {
+				if r.Header.Get("traceparent") != span.name {
+					t.Errorf("expected '%v' got '%v'", span.name, r.Header.Get("traceparent"))
+				}
+			}
+		})
+	}
+}
+
+func TestErrorCategory(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		e        error
+		category string
+	}{
+		{name: "success", status: 200, category: ""},
+		{name: "client", status: 404, category: "client"},
+		{name: "server", status: 502, category: "server"},
+		{name: "circuit open", e: newCircuitOpenError(), category: "circuit_open"},
+		{name: "context", e: newTransportError(StatusClientClosedRequest, "context", context.Canceled), category: "context"},
+		{name: "transport", e: newTransportError(500, "request", errors.New("connection refused")), category: "transport"},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			var res *http.Response
+			if tc.status != 0 {
+				res = &http.Response{StatusCode: tc.status}
+			}
+			if category := errorCategory(res, tc.e); category != tc.category {
+				t.Errorf("expected '%v' got '%v'", tc.category, category)
+			}
+		})
+	}
+}
+
+func TestService_tracer_root(t *testing.T) {
+	rs := newRetryServer()
+	defer rs.Close()
+
+	tracer := &recordingTracer{}
+	s := rs.service()
+	s.tracer = tracer
+	if e := s.LogoutContext(context.Background()); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if len(tracer.spans) != 1 || tracer.spans[0].parent != "" {
+		t.Errorf("expected a root span got '%v'", tracer.spans)
+	}
+}
@@ -1,6 +1,9 @@
 package security
 
-import "github.com/google/uuid"
+import (
+	"github.com/google/uuid"
+	"time"
+)
 
 type User struct {
 	UUID               uuid.UUID `json:"uuid"`
@@ -13,3 +16,102 @@ type User struct {
 }
 
 type PermissionCodes []string
+
+// TokenInfo is what the security service knows about a valid user token,
+// the user it belongs to, the user's permission codes and the session.
+type TokenInfo struct {
+	User            User            `json:"user"`
+	PermissionCodes PermissionCodes `json:"permission"`
+	ExpiresAt       time.Time       `json:"expires_at"`
+	SessionID       string          `json:"session_id"`
+}
+
+// TokenPair is a user token with the refresh token to renew it, see
+// RefreshToken. RefreshToken is empty if the security service did not
+// issue one.
+type TokenPair struct {
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// LoginResult is the result of a successful login.
+type LoginResult struct {
+	TokenPair
+	User            User            `json:"user"`
+	PermissionCodes PermissionCodes `json:"permission"`
+}
+
+// UserPage is a page of users of a listing. NextCursor is the cursor of the
+// next page, it is empty on the last page. Total is the number of users in
+// the listing across all pages.
+type UserPage struct {
+	Users      []User `json:"users"`
+	NextCursor string `json:"next_cursor"`
+	Total      int    `json:"total"`
+}
+
+// Permission is a permission code with the description of what it
+// permits.
+type Permission struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+// Role is a named group of permissions that is assigned to users.
+type Role struct {
+	UUID        uuid.UUID    `json:"uuid"`
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// PermissionCodes returns the codes of the permissions of the role.
+func (r Role) PermissionCodes() PermissionCodes {
+	xp := make(PermissionCodes, len(r.Permissions))
+	for i, p := range r.Permissions {
+		xp[i] = p.Code
+	}
+	return xp
+}
+
+// Session is a logged-in session of a user. Current is true for the session
+// of the token that listed the sessions.
+type Session struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// MFAChallenge is the handle of a login that requires a second factor, with
+// the second factor methods the user can complete it with, such as "totp".
+type MFAChallenge struct {
+	Challenge string    `json:"challenge"`
+	Methods   []string  `json:"methods"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TOTPEnrollment is a pending enrolment of a TOTP authenticator, the Secret
+// is base32 encoded and URI is the otpauth URI to show as a QR code.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// APIKey is a long-lived credential of a user for machine-to-machine
+// exchanges, scoped to a subset of the permission codes of the user. The
+// key itself is only known when it is created or rotated, Prefix is its
+// first characters to recognise it by.
+type APIKey struct {
+	UUID            uuid.UUID       `json:"uuid"`
+	Name            string          `json:"name"`
+	Prefix          string          `json:"prefix"`
+	PermissionCodes PermissionCodes `json:"permission"`
+	CreatedAt       time.Time       `json:"created_at"`
+	ExpiresAt       *time.Time      `json:"expires_at"`
+	LastUsedAt      *time.Time      `json:"last_used_at"`
+}
@@ -0,0 +1,134 @@
+package security
+
+import (
+	"context"
+	"github.com/dottics/dutil"
+	"github.com/google/uuid"
+	"io"
+)
+
+// UserChanges returns the UpdateUserPayload with the updatable fields of
+// after that differ from before, so that only the changed fields are sent.
+func UserChanges(before User, after User) UpdateUserPayload {
+	p := UpdateUserPayload{}
+	if after.FirstName != before.FirstName {
+		p.FirstName = &after.FirstName
+	}
+	if after.LastName != before.LastName {
+		p.LastName = &after.LastName
+	}
+	if after.ContactNumber != before.ContactNumber {
+		p.ContactNumber = &after.ContactNumber
+	}
+	return p
+}
+
+// Empty reports whether the payload changes no fields.
+func (p UpdateUserPayload) Empty() bool {
+	return p.FirstName == nil && p.LastName == nil && p.ContactNumber == nil
+}
+
+// GetUser handles the exchange with the security microservice to get the
+// user with the UUID.
+func (s *Service) GetUser(userUUID uuid.UUID) (User, dutil.Error) {
+	return s.GetUserContext(context.Background(), userUUID)
+}
+
+// GetUserContext is GetUser bound to the context ctx.
+func (s *Service) GetUserContext(ctx context.Context, userUUID uuid.UUID) (User, dutil.Error) {
+	ctx = withOperation(ctx, "get_user")
+	u := s.endpoint("/users/"+userUUID.String(), nil)
+	return s.userExchange(ctx, "GET", u.String(), nil)
+}
+
+// GetCurrentUser handles the exchange with the security microservice to
+// get the logged-in user whose token is in the header of the Service.
+func (s *Service) GetCurrentUser() (User, dutil.Error) {
+	return s.GetCurrentUserContext(context.Background())
+}
+
+// GetCurrentUserContext is GetCurrentUser bound to the context ctx.
+func (s *Service) GetCurrentUserContext(ctx context.Context) (User, dutil.Error) {
+	ctx = withOperation(ctx, "get_current_user")
+	u := s.endpoint("/users/me", nil)
+	return s.userExchange(ctx, "GET", u.String(), nil)
+}
+
+// UpdateUser handles the exchange with the security microservice to update
+// the fields of the user with the UUID that are set in the payload. The
+// updated user is returned.
+func (s *Service) UpdateUser(userUUID uuid.UUID, p UpdateUserPayload) (User, dutil.Error) {
+	return s.UpdateUserContext(context.Background(), userUUID, p)
+}
+
+// UpdateUserContext is UpdateUser bound to the context ctx.
+func (s *Service) UpdateUserContext(ctx context.Context, userUUID uuid.UUID, p UpdateUserPayload) (User, dutil.Error) {
+	ctx = withOperation(ctx, "update_user")
+	u := s.endpoint("/users/"+userUUID.String(), nil)
+
+	payload, e := dutil.MarshalReader(p)
+	if e != nil {
+		return User{}, e
+	}
+	return s.userExchange(ctx, "PATCH", u.String(), payload)
+}
+
+// DeactivateUser handles the exchange with the security microservice to
+// deactivate the user with the UUID, an inactive user cannot login.
+func (s *Service) DeactivateUser(userUUID uuid.UUID) (User, dutil.Error) {
+	return s.DeactivateUserContext(context.Background(), userUUID)
+}
+
+// DeactivateUserContext is DeactivateUser bound to the context ctx.
+func (s *Service) DeactivateUserContext(ctx context.Context, userUUID uuid.UUID) (User, dutil.Error) {
+	ctx = withOperation(ctx, "deactivate_user")
+	u := s.endpoint("/users/"+userUUID.String()+"/deactivate", nil)
+	user, e := s.userExchange(ctx, "POST", u.String(), nil)
+	if e != nil {
+		return User{}, e
+	}
+	s.revoked(Revocation{UserUUID: userUUID})
+	return user, nil
+}
+
+// ReactivateUser handles the exchange with the security microservice to
+// reactivate the user with the UUID.
+func (s *Service) ReactivateUser(userUUID uuid.UUID) (User, dutil.Error) {
+	return s.ReactivateUserContext(context.Background(), userUUID)
+}
+
+// ReactivateUserContext is ReactivateUser bound to the context ctx.
+func (s *Service) ReactivateUserContext(ctx context.Context, userUUID uuid.UUID) (User, dutil.Error) {
+	ctx = withOperation(ctx, "reactivate_user")
+	u := s.endpoint("/users/"+userUUID.String()+"/reactivate", nil)
+	return s.userExchange(ctx, "POST", u.String(), nil)
+}
+
+// userExchange makes an exchange with the security microservice of which
+// the response data is a user.
+func (s *Service) userExchange(ctx context.Context, method string, target string, payload io.Reader) (User, dutil.Error) {
+	type data struct {
+		User User `json:"user"`
+	}
+	resp := struct {
+		Message string              `json:"message"`
+		Data    data                `json:"data"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	res, e := s.NewRequestContext(ctx, method, target, nil, payload)
+	if e != nil {
+		return User{}, e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return User{}, e
+	}
+
+	if res.StatusCode != 200 {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return User{}, e
+	}
+
+	return resp.Data.User, nil
+}
@@ -0,0 +1,155 @@
+package security
+
+import (
+	"context"
+	"github.com/dottics/dutil"
+	"net/url"
+	"strconv"
+)
+
+// ListUsersQuery filters and pages a listing of users. Zero fields are not
+// filtered on.
+type ListUsersQuery struct {
+	// Email matches users whose email contains it.
+	Email string
+	// Name matches users whose first or last name contains it.
+	Name string
+	// Active matches users that are active or inactive.
+	Active *bool
+	// Limit is the maximum number of users on a page, the security
+	// microservice decides the default.
+	Limit int
+	// Cursor is the NextCursor of the previous page, empty for the first
+	// page.
+	Cursor string
+}
+
+// ListUsers handles the exchange with the security microservice to list a
+// page of the users that match the query.
+func (s *Service) ListUsers(q ListUsersQuery) (UserPage, dutil.Error) {
+	return s.ListUsersContext(context.Background(), q)
+}
+
+// ListUsersContext is ListUsers bound to the context ctx.
+func (s *Service) ListUsersContext(ctx context.Context, q ListUsersQuery) (UserPage, dutil.Error) {
+	ctx = withOperation(ctx, "list_users")
+	qs := url.Values{}
+	if q.Email != "" {
+		qs.Add("email", q.Email)
+	}
+	if q.Name != "" {
+		qs.Add("name", q.Name)
+	}
+	if q.Active != nil {
+		qs.Add("active", strconv.FormatBool(*q.Active))
+	}
+	if q.Limit > 0 {
+		qs.Add("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Cursor != "" {
+		qs.Add("cursor", q.Cursor)
+	}
+	u := s.endpoint("/users", qs)
+
+	resp := struct {
+		Message string              `json:"message"`
+		Data    UserPage            `json:"data"`
+		Errors  map[string][]string `json:"errors"`
+	}{}
+
+	res, e := s.NewRequestContext(ctx, "GET", u.String(), nil, nil)
+	if e != nil {
+		return UserPage{}, e
+	}
+	_, e = s.decode(res, &resp)
+	if e != nil {
+		return UserPage{}, e
+	}
+
+	if res.StatusCode != 200 {
+		e := newStatusError(res.StatusCode, resp.Errors)
+		return UserPage{}, e
+	}
+
+	return resp.Data, nil
+}
+
+// UserIterator iterates over all the users of a listing, fetching the
+// pages from the security microservice as they are needed:
+//
+//	it := s.IterateUsers(ctx, security.ListUsersQuery{Name: "james"})
+//	for it.Next() {
+//		u := it.User()
+//		...
+//	}
+//	if e := it.Err(); e != nil {
+//		...
+//	}
+type UserIterator struct {
+	s     *Service
+	ctx   context.Context
+	query ListUsersQuery
+	page  UserPage
+	// i is the index in the page of the current user
+	i       int
+	fetched bool
+	e       dutil.Error
+}
+
+// IterateUsers returns a UserIterator over the users that match the query,
+// starting from the page of the query's Cursor.
+func (s *Service) IterateUsers(ctx context.Context, q ListUsersQuery) *UserIterator {
+	return &UserIterator{
+		s:     s,
+		ctx:   ctx,
+		query: q,
+		i:     -1,
+	}
+}
+
+// Next advances the iterator to the next user, which is then available
+// from User. It returns false when there are no more users or an exchange
+// failed, in which case Err returns the error.
+func (it *UserIterator) Next() bool {
+	if it.e != nil {
+		return false
+	}
+	it.i++
+	for it.i >= len(it.page.Users) {
+		if it.fetched && it.page.NextCursor == "" {
+			return false
+		}
+		if it.fetched {
+			it.query.Cursor = it.page.NextCursor
+		}
+		page, e := it.s.ListUsersContext(it.ctx, it.query)
+		if e != nil {
+			it.e = e
+			return false
+		}
+		it.page = page
+		it.fetched = true
+		it.i = 0
+	}
+	return true
+}
+
+// User returns the current user.
+func (it *UserIterator) User() User {
+	if it.i < 0 || it.i >= len(it.page.Users) {
+		return User{}
+	}
+	return it.page.Users[it.i]
+}
+
+// Total returns the number of users in the listing, as reported with the
+// last page fetched.
+func (it *UserIterator) Total() int {
+	return it.page.Total
+}
+
+// Err returns the error of the exchange that stopped the iteration, if
+// any.
+func (it *UserIterator) Err() dutil.Error {
+	return it.e
+}
@@ -0,0 +1,153 @@
+package security
+
+import (
+	"context"
+	"fmt"
+	"github.com/dottics/dutil"
+	"github.com/johannesscr/micro/microtest"
+	"testing"
+)
+
+func TestService_ListUsers(t *testing.T) {
+	active := false
+	tests := []struct {
+		name     string
+		query    ListUsersQuery
+		rawQuery string
+		exchange *microtest.Exchange
+		page     UserPage
+		e        dutil.Error
+	}{
+		{
+			name:     "forbidden",
+			query:    ListUsersQuery{},
+			rawQuery: "",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 403,
+					Body:   `{"message":"Forbidden","data":{},"errors":{"permission":["abcd"]}}`,
+				},
+			},
+			e: &dutil.Err{
+				Status: 403,
+				Errors: map[string][]string{
+					"permission": {"abcd"},
+				},
+			},
+		},
+		{
+			name: "search",
+			query: ListUsersQuery{
+				Email:  "dottics.com",
+				Name:   "james",
+				Active: &active,
+				Limit:  2,
+				Cursor: "c2",
+			},
+			rawQuery: "active=false&cursor=c2&email=dottics.com&limit=2&name=james",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 200,
+					Body:   `{"message":"users","data":{"users":[{"email":"a@test.dottics.com"},{"email":"b@test.dottics.com"}],"next_cursor":"c4","total":5},"errors":{}}`,
+				},
+			},
+			page: UserPage{
+				Users:      []User{{Email: "a@test.dottics.com"}, {Email: "b@test.dottics.com"}},
+				NextCursor: "c4",
+				Total:      5,
+			},
+		},
+	}
+
+	s := NewService("my-very-secure-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			page, e := s.ListUsers(tc.query)
+			if !dutil.ErrorEqual(e, tc.e) {
+				t.Errorf("expected error %v got %v", tc.e, e)
+			}
+			r := tc.exchange.Request
+			if r.URL.Path != "/users" {
+				t.Errorf("expected '%v' got '%v'", "/users", r.URL.Path)
+			}
+			if r.URL.RawQuery != tc.rawQuery {
+				t.Errorf("expected '%v' got '%v'", tc.rawQuery, r.URL.RawQuery)
+			}
+			if len(page.Users) != len(tc.page.Users) || page.NextCursor != tc.page.NextCursor || page.Total != tc.page.Total {
+				t.Errorf("expected %v got %v", tc.page, page)
+			}
+		})
+	}
+}
+
+func TestUserIterator(t *testing.T) {
+	s := NewService("my-very-secure-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	pages := []*microtest.Exchange{
+		{Response: microtest.Response{Status: 200, Body: `{"data":{"users":[{"email":"a"},{"email":"b"}],"next_cursor":"c2","total":5}}`}},
+		{Response: microtest.Response{Status: 200, Body: `{"data":{"users":[],"next_cursor":"c3","total":5}}`}},
+		{Response: microtest.Response{Status: 200, Body: `{"data":{"users":[{"email":"c"},{"email":"d"}],"next_cursor":"c4","total":5}}`}},
+		{Response: microtest.Response{Status: 200, Body: `{"data":{"users":[{"email":"e"}],"next_cursor":"","total":5}}`}},
+	}
+	for _, ex := range pages {
+		ms.Append(ex)
+	}
+
+	it := s.IterateUsers(context.Background(), ListUsersQuery{Limit: 2})
+	emails := ""
+	for it.Next() {
+		emails += it.User().Email
+		// the next page is only fetched once the current page is exhausted
+		if emails == "ab" && pages[1].Request != nil {
+			t.Errorf("expected the pages to be fetched lazily")
+		}
+	}
+	if e := it.Err(); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if emails != "abcde" {
+		t.Errorf("expected '%v' got '%v'", "abcde", emails)
+	}
+	if it.Total() != 5 {
+		t.Errorf("expected %d got %d", 5, it.Total())
+	}
+	cursors := []string{"", "c2", "c3", "c4"}
+	for i, ex := range pages {
+		cursor := ex.Request.URL.Query().Get("cursor")
+		if cursor != cursors[i] {
+			t.Errorf("expected cursor '%v' got '%v'", cursors[i], cursor)
+		}
+	}
+	if it.Next() {
+		t.Errorf("expected the iteration to have ended")
+	}
+}
+
+func TestUserIterator_error(t *testing.T) {
+	s := NewService("my-very-secure-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	ms.Append(&microtest.Exchange{Response: microtest.Response{Status: 200, Body: `{"data":{"users":[{"email":"a"}],"next_cursor":"c2","total":2}}`}})
+	ms.Append(&microtest.Exchange{Response: microtest.Response{Status: 401, Body: `{"errors":{"auth":["Token expired"]}}`}})
+
+	it := s.IterateUsers(context.Background(), ListUsersQuery{})
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if n != 1 {
+		t.Errorf("expected %d user got %d", 1, n)
+	}
+	if dutil.Inst(it.Err()).Status != 401 {
+		t.Errorf("expected status %d got %v", 401, it.Err())
+	}
+}
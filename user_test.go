@@ -0,0 +1,159 @@
+package security
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dottics/dutil"
+	"github.com/google/uuid"
+	"github.com/johannesscr/micro/microtest"
+	"testing"
+)
+
+func TestUserChanges(t *testing.T) {
+	before := User{
+		FirstName:     "james",
+		LastName:      "bond",
+		ContactNumber: "007",
+		Email:         "jb@test.dottics.com",
+	}
+	tests := []struct {
+		name  string
+		after User
+		json  string
+	}{
+		{name: "no changes", after: before, json: `{}`},
+		{
+			name:  "email is not updatable",
+			after: User{FirstName: "james", LastName: "bond", ContactNumber: "007", Email: "other@test.dottics.com"},
+			json:  `{}`,
+		},
+		{
+			name:  "first name",
+			after: User{FirstName: "jimmy", LastName: "bond", ContactNumber: "007"},
+			json:  `{"first_name":"jimmy"}`,
+		},
+		{
+			name:  "cleared contact number",
+			after: User{FirstName: "james", LastName: "bond"},
+			json:  `{"contact_number":""}`,
+		},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			p := UserChanges(before, tc.after)
+			xb, err := json.Marshal(p)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(xb) != tc.json {
+				t.Errorf("expected '%v' got '%s'", tc.json, xb)
+			}
+			if p.Empty() != (tc.json == `{}`) {
+				t.Errorf("expected empty %v got %v", tc.json == `{}`, p.Empty())
+			}
+		})
+	}
+}
+
+func TestService_userExchanges(t *testing.T) {
+	userUUID := uuid.MustParse("9b615709-cc9a-48c3-b1ea-a04d4375ea86")
+	firstName := "jimmy"
+	body := `{"message":"successful","data":{"user":{"uuid":"9b615709-cc9a-48c3-b1ea-a04d4375ea86","first_name":"james","active":true}},"errors":{}}`
+
+	tests := []struct {
+		name     string
+		call     func(s *Service) (User, dutil.Error)
+		method   string
+		path     string
+		exchange *microtest.Exchange
+		user     User
+		e        dutil.Error
+	}{
+		{
+			name:   "get user not found",
+			call:   func(s *Service) (User, dutil.Error) { return s.GetUser(userUUID) },
+			method: "GET",
+			path:   "/users/9b615709-cc9a-48c3-b1ea-a04d4375ea86",
+			exchange: &microtest.Exchange{
+				Response: microtest.Response{
+					Status: 404,
+					Body:   `{"message":"NotFound","data":{},"errors":{"user":["not found"]}}`,
+				},
+			},
+			user: User{},
+			e: &dutil.Err{
+				Status: 404,
+				Errors: map[string][]string{
+					"user": {"not found"},
+				},
+			},
+		},
+		{
+			name:     "get user",
+			call:     func(s *Service) (User, dutil.Error) { return s.GetUser(userUUID) },
+			method:   "GET",
+			path:     "/users/9b615709-cc9a-48c3-b1ea-a04d4375ea86",
+			exchange: &microtest.Exchange{Response: microtest.Response{Status: 200, Body: body}},
+			user:     User{UUID: userUUID, FirstName: "james", Active: true},
+		},
+		{
+			name:     "get current user",
+			call:     func(s *Service) (User, dutil.Error) { return s.GetCurrentUser() },
+			method:   "GET",
+			path:     "/users/me",
+			exchange: &microtest.Exchange{Response: microtest.Response{Status: 200, Body: body}},
+			user:     User{UUID: userUUID, FirstName: "james", Active: true},
+		},
+		{
+			name: "update user",
+			call: func(s *Service) (User, dutil.Error) {
+				return s.UpdateUser(userUUID, UpdateUserPayload{FirstName: &firstName})
+			},
+			method:   "PATCH",
+			path:     "/users/9b615709-cc9a-48c3-b1ea-a04d4375ea86",
+			exchange: &microtest.Exchange{Response: microtest.Response{Status: 200, Body: body}},
+			user:     User{UUID: userUUID, FirstName: "james", Active: true},
+		},
+		{
+			name:     "deactivate user",
+			call:     func(s *Service) (User, dutil.Error) { return s.DeactivateUser(userUUID) },
+			method:   "POST",
+			path:     "/users/9b615709-cc9a-48c3-b1ea-a04d4375ea86/deactivate",
+			exchange: &microtest.Exchange{Response: microtest.Response{Status: 200, Body: body}},
+			user:     User{UUID: userUUID, FirstName: "james", Active: true},
+		},
+		{
+			name:     "reactivate user",
+			call:     func(s *Service) (User, dutil.Error) { return s.ReactivateUser(userUUID) },
+			method:   "POST",
+			path:     "/users/9b615709-cc9a-48c3-b1ea-a04d4375ea86/reactivate",
+			exchange: &microtest.Exchange{Response: microtest.Response{Status: 200, Body: body}},
+			user:     User{UUID: userUUID, FirstName: "james", Active: true},
+		},
+	}
+
+	s := NewService("my-very-secure-token")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			ms.Append(tc.exchange)
+
+			u, e := tc.call(s)
+			if !dutil.ErrorEqual(e, tc.e) {
+				t.Errorf("expected error %v got %v", tc.e, e)
+			}
+			if u != tc.user {
+				t.Errorf("expected user %v got %v", tc.user, u)
+			}
+			r := tc.exchange.Request
+			if r.Method != tc.method || r.URL.Path != tc.path {
+				t.Errorf("expected '%v %v' got '%v %v'", tc.method, tc.path, r.Method, r.URL.Path)
+			}
+		})
+	}
+}
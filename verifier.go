@@ -0,0 +1,366 @@
+package security
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/dottics/dutil"
+	"github.com/google/uuid"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Claims are the verified claims of a user token. UserUUID is the UUID of
+// the user, the subject of the token.
+type Claims struct {
+	UserUUID        uuid.UUID
+	PermissionCodes PermissionCodes
+	Issuer          string
+	Audience        []string
+	ExpiresAt       time.Time
+	IssuedAt        time.Time
+	SessionID       string
+}
+
+// VerifierConfig configures a Verifier.
+type VerifierConfig struct {
+	// Issuer is the required iss claim, if it is not empty.
+	Issuer string
+	// Audience is the audience the aud claim must contain, if it is not
+	// empty.
+	Audience string
+	// Leeway is the clock skew allowed when checking the exp and nbf
+	// claims.
+	Leeway time.Duration
+	// CacheTTL is the time the keys are used before they are fetched
+	// again, it defaults to an hour.
+	CacheTTL time.Duration
+	// MinRefreshInterval is the least time between fetches of the keys,
+	// failed or not, when they are stale or a token is signed by an
+	// unknown key. It defaults to a minute.
+	MinRefreshInterval time.Duration
+	// FetchTimeout is the time a fetch of the keys may take. A fetch is
+	// shared by the concurrent verifications, so it is not cancelled with
+	// the context of the verification that started it. It defaults to ten
+	// seconds.
+	FetchTimeout time.Duration
+}
+
+// Verifier verifies user tokens which are JWTs signed by the security
+// microservice locally, with the public keys of the JSONWebKeySet of the
+// security microservice. The keys are cached and fetched again when they
+// are older than the CacheTTL or a token is signed by an unknown key. If
+// the keys cannot be fetched the stale keys are used until they can.
+//
+// A Verifier is a TokenValidator, so the Middleware can authenticate
+// requests without an exchange with the security microservice for every
+// request. It is safe for concurrent use.
+type Verifier struct {
+	service *Service
+	config  VerifierConfig
+	now     func() time.Time
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey // by kid
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	// e is the error of the last fetch, if it failed
+	e     dutil.Error
+	fetch *keyFetch
+}
+
+// keyFetch is a fetch of the keys in flight, which concurrent
+// verifications wait for.
+type keyFetch struct {
+	done chan struct{}
+	e    dutil.Error
+}
+
+// NewVerifier creates a Verifier which fetches the keys with the Service.
+func NewVerifier(s *Service, config VerifierConfig) *Verifier {
+	if config.CacheTTL == 0 {
+		config.CacheTTL = time.Hour
+	}
+	if config.MinRefreshInterval == 0 {
+		config.MinRefreshInterval = time.Minute
+	}
+	if config.FetchTimeout == 0 {
+		config.FetchTimeout = 10 * time.Second
+	}
+	return &Verifier{
+		service: s,
+		config:  config,
+		now:     time.Now,
+	}
+}
+
+// Verify verifies the signature and claims of the token and returns its
+// claims. An invalid or expired token is a 401 error, see ErrUnauthorised
+// and ErrTokenExpired.
+func (v *Verifier) Verify(token string) (Claims, dutil.Error) {
+	return v.VerifyContext(context.Background(), token)
+}
+
+// VerifyContext is Verify bound to the context ctx, which is used to fetch
+// the keys.
+func (v *Verifier) VerifyContext(ctx context.Context, token string) (Claims, dutil.Error) {
+	xs := strings.Split(token, ".")
+	if len(xs) != 3 {
+		return Claims{}, invalidToken("malformed token")
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeSegment(xs[0], &header); err != nil {
+		return Claims{}, invalidToken("malformed header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(xs[2])
+	if err != nil {
+		return Claims{}, invalidToken("malformed signature")
+	}
+
+	key, e := v.key(ctx, header.Kid)
+	if e != nil {
+		return Claims{}, e
+	}
+	if !verifySignature(header.Alg, key, []byte(xs[0]+"."+xs[1]), sig) {
+		return Claims{}, invalidToken("invalid signature")
+	}
+
+	raw := struct {
+		Subject         string          `json:"sub"`
+		Issuer          string          `json:"iss"`
+		Audience        json.RawMessage `json:"aud"`
+		ExpiresAt       int64           `json:"exp"`
+		NotBefore       int64           `json:"nbf"`
+		IssuedAt        int64           `json:"iat"`
+		SessionID       string          `json:"sid"`
+		PermissionCodes PermissionCodes `json:"permission"`
+	}{}
+	if err := decodeSegment(xs[1], &raw); err != nil {
+		return Claims{}, invalidToken("malformed claims")
+	}
+	userUUID, err := uuid.Parse(raw.Subject)
+	if err != nil {
+		return Claims{}, invalidToken("invalid subject")
+	}
+	aud, ok := audience(raw.Audience)
+	if !ok {
+		return Claims{}, invalidToken("invalid audience")
+	}
+
+	now := v.now()
+	if raw.ExpiresAt == 0 {
+		return Claims{}, invalidToken("missing expiry")
+	}
+	if now.After(time.Unix(raw.ExpiresAt, 0).Add(v.config.Leeway)) {
+		return Claims{}, newStatusError(401, map[string][]string{"auth": {"Token expired", "Please login"}})
+	}
+	if raw.NotBefore != 0 && now.Add(v.config.Leeway).Before(time.Unix(raw.NotBefore, 0)) {
+		return Claims{}, invalidToken("token not valid yet")
+	}
+	if v.config.Issuer != "" && raw.Issuer != v.config.Issuer {
+		return Claims{}, invalidToken("invalid issuer")
+	}
+	if v.config.Audience != "" && !contains(aud, v.config.Audience) {
+		return Claims{}, invalidToken("invalid audience")
+	}
+
+	claims := Claims{
+		UserUUID:        userUUID,
+		PermissionCodes: raw.PermissionCodes,
+		Issuer:          raw.Issuer,
+		Audience:        aud,
+		ExpiresAt:       time.Unix(raw.ExpiresAt, 0),
+		SessionID:       raw.SessionID,
+	}
+	if raw.IssuedAt != 0 {
+		claims.IssuedAt = time.Unix(raw.IssuedAt, 0)
+	}
+	return claims, nil
+}
+
+// ValidateTokenContext verifies the token, the TokenInfo only has the UUID
+// of the user and the user is taken to be active, as the token has no
+// other details of the user.
+func (v *Verifier) ValidateTokenContext(ctx context.Context, token string) (TokenInfo, dutil.Error) {
+	claims, e := v.VerifyContext(ctx, token)
+	if e != nil {
+		return TokenInfo{}, e
+	}
+	info := TokenInfo{
+		User:            User{UUID: claims.UserUUID, Active: true},
+		PermissionCodes: claims.PermissionCodes,
+		ExpiresAt:       claims.ExpiresAt,
+		SessionID:       claims.SessionID,
+	}
+	return info, nil
+}
+
+// key returns the key with the kid. The keys are fetched if they are older
+// than the CacheTTL or there is no such key, unless they were fetched, or
+// failed to be fetched, in the last MinRefreshInterval. Concurrent
+// verifications share a fetch, and if it fails the stale key is used.
+func (v *Verifier) key(ctx context.Context, kid string) (crypto.PublicKey, dutil.Error) {
+	v.mu.Lock()
+	now := v.now()
+	key, ok := v.keys[kid]
+	if ok && now.Sub(v.fetchedAt) < v.config.CacheTTL {
+		v.mu.Unlock()
+		return key, nil
+	}
+	f := v.fetch
+	if f == nil && (v.attemptedAt.IsZero() || now.Sub(v.attemptedAt) >= v.config.MinRefreshInterval) {
+		f = &keyFetch{done: make(chan struct{})}
+		v.fetch = f
+		v.attemptedAt = now
+		go v.fetchKeys(ctx, f, now)
+	}
+	if f == nil {
+		e := v.e
+		v.mu.Unlock()
+		return v.known(key, ok, e)
+	}
+	v.mu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, requestErr(ctx, ctx.Err())
+	}
+	if f.e == nil {
+		// the key may have been rotated out
+		v.mu.Lock()
+		key, ok = v.keys[kid]
+		v.mu.Unlock()
+	}
+	return v.known(key, ok, f.e)
+}
+
+// known returns the key if it is known, or else the error of the failed
+// fetch e, if any, or an unknown key error.
+func (v *Verifier) known(key crypto.PublicKey, ok bool, e dutil.Error) (crypto.PublicKey, dutil.Error) {
+	switch {
+	case ok:
+		return key, nil
+	case e != nil:
+		return nil, e
+	}
+	return nil, invalidToken("unknown key")
+}
+
+// fetchKeys fetches the keys for the fetch f in flight, started at the
+// time now. It runs on a context detached from ctx, so that the concurrent
+// verifications waiting for f do not fail if the verification that started
+// it goes away. If the fetch fails the keys are kept.
+func (v *Verifier) fetchKeys(ctx context.Context, f *keyFetch, now time.Time) {
+	ctx, cancel := detach(ctx, v.config.FetchTimeout)
+	defer cancel()
+	set, e := v.service.GetJWKSContext(ctx)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	defer close(f.done)
+	v.fetch = nil
+	v.e = e
+	f.e = e
+	if e != nil {
+		return
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.PublicKey()
+		if err != nil {
+			// a key that cannot be used does not invalidate the others
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	v.keys = keys
+	v.fetchedAt = now
+}
+
+// verifySignature reports whether sig is the signature with the algorithm
+// alg of the key over the signing input. The algorithm must match the type
+// of the key.
+func verifySignature(alg string, key crypto.PublicKey, input []byte, sig []byte) bool {
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		sum := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		sum := sha256.Sum256(input)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, sum[:], r, s)
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(pub, input, sig)
+	}
+	return false
+}
+
+// decodeSegment decodes the base64url JSON segment of a JWT to the value
+// pointed to by v.
+func decodeSegment(segment string, v interface{}) error {
+	xb, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(xb, v)
+}
+
+// audience decodes the aud claim, which is a string or an array of
+// strings.
+func audience(raw json.RawMessage) ([]string, bool) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, true
+	}
+	var aud string
+	if err := json.Unmarshal(raw, &aud); err == nil {
+		return []string{aud}, true
+	}
+	var xa []string
+	if err := json.Unmarshal(raw, &xa); err == nil {
+		return xa, true
+	}
+	return nil, false
+}
+
+// contains reports whether xs contains s.
+func contains(xs []string, s string) bool {
+	for _, x := range xs {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidToken creates the error of a token that is not valid for the
+// reason.
+func invalidToken(reason string) dutil.Error {
+	return newStatusError(401, map[string][]string{"auth": {"Invalid token: " + reason, "Please login"}})
+}
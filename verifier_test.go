@@ -0,0 +1,441 @@
+package security
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dottics/dutil"
+	"github.com/google/uuid"
+	"github.com/johannesscr/micro/microtest"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testKeys are the private keys the tests sign tokens with, by kid.
+type testKeys map[string]crypto.Signer
+
+func newTestKeys(t *testing.T) testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return testKeys{"rsa": rsaKey, "ec": ecKey, "ed": edKey}
+}
+
+// jwks returns the JSON Web Key Set of the public keys with the kids.
+func (keys testKeys) jwks(kids ...string) string {
+	enc := base64.RawURLEncoding
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, kid := range kids {
+		switch pub := keys[kid].Public().(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JSONWebKey{
+				Kty: "RSA", Kid: kid, Use: "sig",
+				N: enc.EncodeToString(pub.N.Bytes()),
+				E: enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			set.Keys = append(set.Keys, JSONWebKey{
+				Kty: "EC", Kid: kid, Crv: "P-256",
+				X: enc.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+				Y: enc.EncodeToString(pub.Y.FillBytes(make([]byte, 32))),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JSONWebKey{Kty: "OKP", Kid: kid, Crv: "Ed25519", X: enc.EncodeToString(pub)})
+		}
+	}
+	xb, _ := json.Marshal(set)
+	return string(xb)
+}
+
+// sign returns the JWT of the claims signed with the key with the kid.
+func (keys testKeys) sign(t *testing.T, kid string, claims map[string]interface{}) string {
+	enc := base64.RawURLEncoding
+	key := keys[kid]
+	alg := map[string]string{"rsa": "RS256", "ec": "ES256", "ed": "EdDSA"}[kid]
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(input))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		sum := sha256.Sum256([]byte(input))
+		r, s, e := ecdsa.Sign(rand.Reader, k, sum[:])
+		err = e
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(input))
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return input + "." + enc.EncodeToString(sig)
+}
+
+// tamper returns the token with the claims of the other token.
+func tamper(token string, other string) string {
+	xs := strings.Split(token, ".")
+	xs[1] = strings.Split(other, ".")[1]
+	return strings.Join(xs, ".")
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	keys := newTestKeys(t)
+	userUUID := uuid.MustParse("9b615709-cc9a-48c3-b1ea-a04d4375ea86")
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":        userUUID.String(),
+			"iss":        "https://security.dottics.com",
+			"aud":        []string{"api", "web"},
+			"exp":        now.Add(time.Hour).Unix(),
+			"iat":        now.Unix(),
+			"sid":        "some-session",
+			"permission": []string{"abcd"},
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		e     error
+	}{
+		{name: "RS256", token: keys.sign(t, "rsa", claims(nil))},
+		{name: "ES256", token: keys.sign(t, "ec", claims(nil))},
+		{name: "EdDSA", token: keys.sign(t, "ed", claims(nil))},
+		{name: "audience string", token: keys.sign(t, "rsa", claims(map[string]interface{}{"aud": "api"}))},
+		{name: "malformed", token: "some-long-jwt-encrypted-token", e: ErrUnauthorised},
+		{name: "tampered", token: tamper(keys.sign(t, "ed", claims(nil)), keys.sign(t, "rsa", claims(map[string]interface{}{"permission": []string{"admin"}}))), e: ErrUnauthorised},
+		{name: "expired", token: keys.sign(t, "rsa", claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})), e: ErrTokenExpired},
+		{name: "within leeway", token: keys.sign(t, "rsa", claims(map[string]interface{}{"exp": now.Add(-time.Second).Unix()}))},
+		{name: "no expiry", token: keys.sign(t, "rsa", claims(map[string]interface{}{"exp": nil})), e: ErrUnauthorised},
+		{name: "not valid yet", token: keys.sign(t, "rsa", claims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})), e: ErrUnauthorised},
+		{name: "wrong issuer", token: keys.sign(t, "rsa", claims(map[string]interface{}{"iss": "https://evil.com"})), e: ErrUnauthorised},
+		{name: "wrong audience", token: keys.sign(t, "rsa", claims(map[string]interface{}{"aud": "admin"})), e: ErrUnauthorised},
+		{name: "invalid subject", token: keys.sign(t, "rsa", claims(map[string]interface{}{"sub": "james"})), e: ErrUnauthorised},
+	}
+
+	s := NewService("")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+	ms.Append(&microtest.Exchange{
+		Response: microtest.Response{Status: 200, Body: keys.jwks("rsa", "ec", "ed")},
+	})
+
+	v := NewVerifier(s, VerifierConfig{
+		Issuer:   "https://security.dottics.com",
+		Audience: "api",
+		Leeway:   5 * time.Second,
+	})
+	v.now = func() time.Time { return now }
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			c, e := v.Verify(tc.token)
+			if tc.e == nil {
+				if e != nil {
+					t.Fatalf("unexpected error: %v", e)
+				}
+				if c.UserUUID != userUUID || !c.PermissionCodes.Has("abcd") || c.SessionID != "some-session" {
+					t.Errorf("unexpected claims %v", c)
+				}
+				return
+			}
+			if !errors.Is(e, tc.e) {
+				t.Errorf("expected '%v' got '%v'", tc.e, e)
+			}
+			if e != nil && dutil.Inst(e).Status != 401 {
+				t.Errorf("expected status 401 got %d", dutil.Inst(e).Status)
+			}
+		})
+	}
+}
+
+func TestVerifier_unknownKid(t *testing.T) {
+	keys := newTestKeys(t)
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	claims := map[string]interface{}{
+		"sub": "9b615709-cc9a-48c3-b1ea-a04d4375ea86",
+		"exp": now.Add(time.Hour).Unix(),
+	}
+
+	s := NewService("")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+	xe := []*microtest.Exchange{
+		{Response: microtest.Response{Status: 200, Body: keys.jwks("rsa")}},
+		{Response: microtest.Response{Status: 200, Body: keys.jwks("rsa", "ed")}},
+		{Response: microtest.Response{Status: 200, Body: keys.jwks("ed")}},
+	}
+	for _, x := range xe {
+		ms.Append(x)
+	}
+
+	v := NewVerifier(s, VerifierConfig{MinRefreshInterval: time.Minute, CacheTTL: time.Hour})
+	v.now = func() time.Time { return now }
+
+	if _, e := v.Verify(keys.sign(t, "rsa", claims)); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if xe[0].Request == nil || xe[0].Request.URL.Path != "/.well-known/jwks.json" {
+		t.Fatalf("expected the keys to be fetched")
+	}
+	// the keys were just fetched, an unknown key is not fetched again yet
+	_, e := v.Verify(keys.sign(t, "ed", claims))
+	if !errors.Is(e, ErrUnauthorised) || xe[1].Request != nil {
+		t.Errorf("expected '%v' without a fetch got '%v'", ErrUnauthorised, e)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, e = v.Verify(keys.sign(t, "ed", claims)); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if xe[1].Request == nil {
+		t.Errorf("expected the keys to be fetched for the unknown key")
+	}
+	// known keys are used from the cache
+	if _, e = v.Verify(keys.sign(t, "rsa", claims)); e != nil {
+		t.Errorf("unexpected error: %v", e)
+	}
+
+	// stale keys are fetched again, the rsa key was rotated out
+	now = now.Add(time.Hour)
+	claims["exp"] = now.Add(time.Hour).Unix()
+	_, e = v.Verify(keys.sign(t, "rsa", claims))
+	if !errors.Is(e, ErrUnauthorised) || xe[2].Request == nil {
+		t.Errorf("expected '%v' after a fetch got '%v'", ErrUnauthorised, e)
+	}
+}
+
+func TestVerifier_ValidateTokenContext(t *testing.T) {
+	keys := newTestKeys(t)
+	s := NewService("")
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+	ms.Append(&microtest.Exchange{
+		Response: microtest.Response{Status: 200, Body: keys.jwks("ec")},
+	})
+
+	var validator TokenValidator = NewVerifier(s, VerifierConfig{})
+	token := keys.sign(t, "ec", map[string]interface{}{
+		"sub":        "9b615709-cc9a-48c3-b1ea-a04d4375ea86",
+		"exp":        time.Now().Add(time.Hour).Unix(),
+		"permission": []string{"abcd"},
+	})
+	info, e := validator.ValidateTokenContext(context.Background(), token)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if !info.User.Active || info.User.UUID.String() != "9b615709-cc9a-48c3-b1ea-a04d4375ea86" || !info.PermissionCodes.Has("abcd") {
+		t.Errorf("unexpected token info %v", info)
+	}
+}
+
+func TestVerifier_jwksUnavailable(t *testing.T) {
+	s := NewService("")
+	s.retry = RetryPolicy{}
+	ms := microtest.MockServer(s)
+	defer ms.Server.Close()
+	ms.Append(&microtest.Exchange{
+		Response: microtest.Response{Status: 503, Body: `service unavailable`},
+	})
+
+	v := NewVerifier(s, VerifierConfig{})
+	_, e := v.Verify("eyJhbGciOiJSUzI1NiJ9.e30.c2ln")
+	if !errors.Is(e, ErrServer) {
+		t.Errorf("expected '%v' got '%v'", ErrServer, e)
+	}
+}
+
+// jwksServer is a test server of the keys, which fails with 503 while
+// down and holds the requests until release is closed while holding.
+type jwksServer struct {
+	*httptest.Server
+	fetches  int32
+	down     int32
+	holding  int32
+	release  chan struct{}
+	received chan struct{}
+}
+
+func newJWKSServer(keys testKeys, kids ...string) *jwksServer {
+	js := &jwksServer{release: make(chan struct{}), received: make(chan struct{}, 10)}
+	js.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&js.fetches, 1)
+		js.received <- struct{}{}
+		if atomic.LoadInt32(&js.holding) == 1 {
+			<-js.release
+		}
+		if atomic.LoadInt32(&js.down) == 1 {
+			w.WriteHeader(503)
+			_, _ = w.Write([]byte(`service unavailable`))
+			return
+		}
+		_, _ = w.Write([]byte(keys.jwks(kids...)))
+	}))
+	return js
+}
+
+func (js *jwksServer) service() *Service {
+	return NewServiceWithOptions(
+		WithBaseURL("http", strings.TrimPrefix(js.URL, "http://")),
+		WithRetryPolicy(RetryPolicy{}),
+		WithLogger(NopLogger{}),
+	)
+}
+
+func TestVerifier_staleKeys(t *testing.T) {
+	keys := newTestKeys(t)
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	claims := map[string]interface{}{
+		"sub": "9b615709-cc9a-48c3-b1ea-a04d4375ea86",
+		"exp": now.Add(3 * time.Hour).Unix(),
+	}
+	js := newJWKSServer(keys, "rsa")
+	defer js.Close()
+
+	v := NewVerifier(js.service(), VerifierConfig{MinRefreshInterval: time.Minute, CacheTTL: time.Hour})
+	v.now = func() time.Time { return now }
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		down    int32
+		kid     string
+		fetches int32
+		e       error
+	}{
+		{name: "fetched", kid: "rsa", fetches: 1},
+		{name: "stale keys used when the fetch fails", elapsed: time.Hour, down: 1, kid: "rsa", fetches: 2},
+		{name: "failed fetch not repeated", elapsed: 30 * time.Second, down: 1, kid: "rsa", fetches: 2},
+		{name: "unknown key not fetched", down: 1, kid: "ed", fetches: 2, e: ErrServer},
+		{name: "fetched again after the interval", elapsed: 30 * time.Second, down: 1, kid: "rsa", fetches: 3},
+	}
+
+	for i, tc := range tests {
+		name := fmt.Sprintf("%d %s", i, tc.name)
+		t.Run(name, func(t *testing.T) {
+			atomic.StoreInt32(&js.down, tc.down)
+			now = now.Add(tc.elapsed)
+			_, e := v.Verify(keys.sign(t, tc.kid, claims))
+			if !errors.Is(e, tc.e) || (tc.e == nil && e != nil) {
+				t.Errorf("expected '%v' got '%v'", tc.e, e)
+			}
+			if n := atomic.LoadInt32(&js.fetches); n != tc.fetches {
+				t.Errorf("expected %d fetches got %d", tc.fetches, n)
+			}
+		})
+	}
+}
+
+func TestVerifier_jwksUnavailable_rateLimited(t *testing.T) {
+	js := newJWKSServer(newTestKeys(t))
+	defer js.Close()
+	atomic.StoreInt32(&js.down, 1)
+
+	v := NewVerifier(js.service(), VerifierConfig{})
+	for i := 0; i < 3; i++ {
+		_, e := v.Verify("eyJhbGciOiJSUzI1NiJ9.e30.c2ln")
+		if !errors.Is(e, ErrServer) {
+			t.Errorf("expected '%v' got '%v'", ErrServer, e)
+		}
+	}
+	if n := atomic.LoadInt32(&js.fetches); n != 1 {
+		t.Errorf("expected %d fetches got %d", 1, n)
+	}
+}
+
+// TestVerifier_fetchNotBlocking tests that a verification with a known key
+// does not wait for a fetch in flight, and that the verifications waiting
+// for the fetch share it.
+func TestVerifier_fetchNotBlocking(t *testing.T) {
+	keys := newTestKeys(t)
+	claims := map[string]interface{}{
+		"sub": "9b615709-cc9a-48c3-b1ea-a04d4375ea86",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	js := newJWKSServer(keys, "rsa")
+	defer js.Close()
+
+	v := NewVerifier(js.service(), VerifierConfig{MinRefreshInterval: time.Nanosecond})
+	if _, e := v.Verify(keys.sign(t, "rsa", claims)); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	<-js.received
+
+	atomic.StoreInt32(&js.holding, 1)
+	var wg sync.WaitGroup
+	xe := make([]dutil.Error, 3)
+	for i := range xe {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, xe[i] = v.Verify(keys.sign(t, "ed", claims))
+		}(i)
+	}
+	<-js.received
+	// let the other verifications wait for the fetch in flight
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan dutil.Error)
+	go func() {
+		_, e := v.Verify(keys.sign(t, "rsa", claims))
+		done <- e
+	}()
+	select {
+	case e := <-done:
+		if e != nil {
+			t.Errorf("unexpected error: %v", e)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected the known key not to wait for the fetch")
+	}
+
+	close(js.release)
+	wg.Wait()
+	for _, e := range xe {
+		if !errors.Is(e, ErrUnauthorised) {
+			t.Errorf("expected '%v' got '%v'", ErrUnauthorised, e)
+		}
+	}
+	if n := atomic.LoadInt32(&js.fetches); n != 2 {
+		t.Errorf("expected %d fetches got %d", 2, n)
+	}
+}